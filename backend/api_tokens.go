@@ -0,0 +1,239 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// Scopes an API token can be limited to. Sessions have all of them.
+const (
+	ScopeReadPortfolio  = "read:portfolio"  // every read
+	ScopeWriteCapitals  = "write:capitals"  // capitals, withdrawals and realized losses
+	ScopeWriteOrders    = "write:orders"    // orders
+	ScopeWriteTransfers = "write:transfers" // transfers
+	ScopeWriteWatchlist = "write:watchlist" // the watchlist
+	ScopeWritePortfolio = "write:portfolio" // creating, changing and resetting portfolios and their members
+)
+
+var apiTokenScopes = []string{
+	ScopeReadPortfolio, ScopeWriteCapitals, ScopeWriteOrders,
+	ScopeWriteTransfers, ScopeWriteWatchlist, ScopeWritePortfolio,
+}
+
+// apiTokenPrefix tells API tokens from session tokens.
+const apiTokenPrefix = "pm_"
+
+// scopesKey holds the scopes of the API token a request was made with in
+// the gin context; it is unset for sessions.
+const scopesKey = "scopes"
+
+// APIToken is a long-lived token for scripts, limited to its scopes.
+type APIToken struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"` // the start of the token, to recognize it
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+}
+
+const apiTokenColumns = "id, name, prefix, scopes, created_at, last_used_at, expires_at, revoked_at"
+
+func scanAPIToken(row interface{ Scan(...interface{}) error }) (APIToken, error) {
+	var t APIToken
+	var lastUsedAt, expiresAt, revokedAt sql.NullTime
+	err := row.Scan(&t.ID, &t.Name, &t.Prefix, pq.Array(&t.Scopes), &t.CreatedAt, &lastUsedAt, &expiresAt, &revokedAt)
+	t.LastUsedAt = nullTimePtr(lastUsedAt)
+	t.ExpiresAt = nullTimePtr(expiresAt)
+	t.RevokedAt = nullTimePtr(revokedAt)
+	return t, err
+}
+
+func nullTimePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+// authenticateAPIToken signs a request in with an API token, recording when
+// the token was last used. It reports false when the token is unknown,
+// revoked or expired.
+func authenticateAPIToken(c *gin.Context, token string) (bool, error) {
+	var userID int
+	var scopes []string
+	err := db.QueryRow(`
+		UPDATE api_tokens SET last_used_at = CURRENT_TIMESTAMP
+		WHERE token_hash = $1 AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > CURRENT_TIMESTAMP)
+		RETURNING user_id, scopes
+	`, hashToken(token)).Scan(&userID, pq.Array(&scopes))
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	c.Set(userKey, userID)
+	c.Set(scopesKey, scopes)
+	return true, nil
+}
+
+// hasScope reports whether the request may do what scope covers.
+func hasScope(c *gin.Context, scope string) bool {
+	scopes, ok := c.Get(scopesKey)
+	if !ok {
+		return true
+	}
+	for _, s := range scopes.([]string) {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// requireScope refuses requests made with an API token lacking scope.
+func requireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !hasScope(c, scope) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "API token lacks the " + scope + " scope"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// requireSession refuses requests made with an API token, so a token cannot
+// mint or revoke tokens.
+func requireSession(c *gin.Context) {
+	if _, ok := c.Get(scopesKey); ok {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Sign in to manage API tokens"})
+		return
+	}
+	c.Next()
+}
+
+// getAPITokens lists the user's API tokens, revoked ones included.
+func getAPITokens(c *gin.Context) {
+	rows, err := db.Query("SELECT "+apiTokenColumns+" FROM api_tokens WHERE user_id = $1 ORDER BY created_at DESC", currentUser(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	tokens := []APIToken{}
+	for rows.Next() {
+		t, err := scanAPIToken(rows)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		tokens = append(tokens, t)
+	}
+
+	c.JSON(http.StatusOK, tokens)
+}
+
+// createAPIToken issues a token with the given scopes. The token itself is
+// only returned here; it is stored hashed.
+func createAPIToken(c *gin.Context) {
+	var input struct {
+		Name      string   `json:"name" binding:"required"`
+		Scopes    []string `json:"scopes" binding:"required"`
+		ExpiresAt string   `json:"expires_at"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	input.Name = strings.TrimSpace(input.Name)
+	if input.Name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Name is required"})
+		return
+	}
+	if len(input.Scopes) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "At least one scope is required"})
+		return
+	}
+	for _, s := range input.Scopes {
+		if !validScope(s) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid scope " + s + ", use " + strings.Join(apiTokenScopes, ", ")})
+			return
+		}
+	}
+
+	var expiresAt sql.NullTime
+	if input.ExpiresAt != "" {
+		t, err := parseTimeParam(input.ExpiresAt, time.Time{})
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid expires_at, use RFC 3339 or YYYY-MM-DD"})
+			return
+		}
+		if !t.After(time.Now()) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "expires_at must be in the future"})
+			return
+		}
+		expiresAt = sql.NullTime{Time: t, Valid: true}
+	}
+
+	// Stored as the hash of the whole token, prefix included
+	secret, _, err := newToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	token := apiTokenPrefix + secret
+
+	t, err := scanAPIToken(db.QueryRow(
+		"INSERT INTO api_tokens (user_id, name, token_hash, prefix, scopes, expires_at) VALUES ($1, $2, $3, $4, $5, $6) RETURNING "+apiTokenColumns,
+		currentUser(c), input.Name, hashToken(token), token[:len(apiTokenPrefix)+6], pq.Array(input.Scopes), expiresAt,
+	))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"token": token, "api_token": t, "message": "Store this token now; it cannot be shown again"})
+}
+
+func validScope(scope string) bool {
+	for _, s := range apiTokenScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// revokeAPIToken stops a token from working. It stays listed as revoked.
+func revokeAPIToken(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid token id"})
+		return
+	}
+
+	result, err := db.Exec(
+		"UPDATE api_tokens SET revoked_at = CURRENT_TIMESTAMP WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL",
+		id, currentUser(c),
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Token not found or already revoked"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Token revoked successfully"})
+}
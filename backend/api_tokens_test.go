@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRequireScope(t *testing.T) {
+	tests := []struct {
+		name   string
+		scopes []string // nil for a session
+		scope  string
+		want   int
+	}{
+		{name: "session", scope: ScopeWritePortfolio, want: http.StatusNoContent},
+		{name: "token with the scope", scopes: []string{ScopeReadPortfolio, ScopeWriteOrders}, scope: ScopeWriteOrders, want: http.StatusNoContent},
+		{name: "token without the scope", scopes: []string{ScopeReadPortfolio}, scope: ScopeWriteOrders, want: http.StatusForbidden},
+		{name: "token with no scopes", scopes: []string{}, scope: ScopeReadPortfolio, want: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values := map[string]interface{}{}
+			if tt.scopes != nil {
+				values[scopesKey] = tt.scopes
+			}
+			if w := serveWith(values, requireScope(tt.scope)); w.Code != tt.want {
+				t.Errorf("status %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequireSession(t *testing.T) {
+	if w := serveWith(nil, requireSession); w.Code != http.StatusNoContent {
+		t.Errorf("session: status %d, want %d", w.Code, http.StatusNoContent)
+	}
+	all := map[string]interface{}{scopesKey: apiTokenScopes}
+	if w := serveWith(all, requireSession); w.Code != http.StatusForbidden {
+		t.Errorf("token with every scope: status %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
+
+func TestValidScope(t *testing.T) {
+	for _, s := range apiTokenScopes {
+		if !validScope(s) {
+			t.Errorf("validScope(%q) = false", s)
+		}
+	}
+	for _, s := range []string{"", "write:everything", "READ:PORTFOLIO"} {
+		if validScope(s) {
+			t.Errorf("validScope(%q) = true", s)
+		}
+	}
+}
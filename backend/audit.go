@@ -0,0 +1,116 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Audited entities
+const (
+	AuditEntityOrder    = "order"
+	AuditEntityCapital  = "capital"
+	AuditEntityTransfer = "transfer"
+	AuditEntityBackup   = "backup" // resets and restores
+)
+
+// FieldChange is the old and new value of one edited field.
+type FieldChange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// AuditRecord is one recorded change to an order, capital entry or transfer,
+// or a reset or restore of a backup.
+type AuditRecord struct {
+	ID        int                    `json:"id"`
+	Entity    string                 `json:"entity"`
+	EntityID  int                    `json:"entity_id"`
+	Action    string                 `json:"action"`
+	Changes   map[string]FieldChange `json:"changes"`
+	Reason    string                 `json:"reason"`
+	UserID    *int                   `json:"user_id"` // nil for changes from before users were recorded
+	CreatedAt time.Time              `json:"created_at"`
+}
+
+// auditChanges collects the fields that differ between two versions.
+type auditChanges map[string]FieldChange
+
+func (a auditChanges) compare(field, from, to string) {
+	if from != to {
+		a[field] = FieldChange{From: from, To: to}
+	}
+}
+
+// recordAudit appends a change made by userID to the audit history.
+func recordAudit(tx *sql.Tx, userID int, entity string, entityID int, action string, changes auditChanges, reason string) error {
+	encoded, err := json.Marshal(changes)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO audit_history (entity, entity_id, action, changes, reason, user_id)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''), NULLIF($6, 0))
+	`, entity, entityID, action, string(encoded), reason, userID)
+	return err
+}
+
+// auditedTables selects the ids of each audited entity that belong to the
+// portfolio $3. A transfer belongs to both of its sides.
+var auditedTables = map[string]string{
+	AuditEntityOrder:    "SELECT id FROM orders WHERE portfolio_id = $3",
+	AuditEntityCapital:  "SELECT id FROM capitals WHERE portfolio_id = $3",
+	AuditEntityTransfer: "SELECT id FROM transfers WHERE $3 IN (from_portfolio_id, to_portfolio_id)",
+	AuditEntityBackup:   "SELECT id FROM backups WHERE portfolio_id = $3",
+}
+
+// getAuditHistory lists the recorded changes to one entity of the portfolio,
+// oldest first.
+func getAuditHistory(entity string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + entity + " id"})
+			return
+		}
+
+		rows, err := db.Query(`
+			SELECT id, entity, entity_id, action, changes, COALESCE(reason, ''), user_id, created_at
+			FROM audit_history
+			WHERE entity = $1 AND entity_id = $2
+				AND entity_id IN (`+auditedTables[entity]+`)
+			ORDER BY created_at, id
+		`, entity, id, portfolioID(c))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer rows.Close()
+
+		records := []AuditRecord{}
+		for rows.Next() {
+			var r AuditRecord
+			var changes string
+			var userID sql.NullInt64
+			if err := rows.Scan(&r.ID, &r.Entity, &r.EntityID, &r.Action, &changes, &r.Reason, &userID, &r.CreatedAt); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			if userID.Valid {
+				id := int(userID.Int64)
+				r.UserID = &id
+			}
+			if err := json.Unmarshal([]byte(changes), &r.Changes); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			records = append(records, r)
+		}
+
+		c.JSON(http.StatusOK, records)
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// userKey holds the signed-in user in the gin context.
+const userKey = "user_id"
+
+const (
+	defaultSessionTTL = 30 * 24 * time.Hour
+	minPasswordLength = 8
+)
+
+// sessionTTL is how long a login lasts, set at startup.
+var sessionTTL = defaultSessionTTL
+
+// claimToken, from CLAIM_TOKEN, lets an account take over the portfolios
+// recorded before accounts existed. Unset, they stay unowned.
+var claimToken = os.Getenv("CLAIM_TOKEN")
+
+// User is an account. Each user owns portfolios, and with them the capitals,
+// orders, holdings and watchlist kept in those.
+type User struct {
+	ID        int       `json:"id"`
+	Email     string    `json:"email"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// sessionTTLFromEnv reads SESSION_TTL.
+func sessionTTLFromEnv() (time.Duration, error) {
+	v := os.Getenv("SESSION_TTL")
+	if v == "" {
+		return defaultSessionTTL, nil
+	}
+	ttl, err := time.ParseDuration(v)
+	if err != nil || ttl <= 0 {
+		return 0, fmt.Errorf("invalid SESSION_TTL %q", v)
+	}
+	return ttl, nil
+}
+
+// newToken returns a random bearer token and the hash it is stored as.
+func newToken() (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	return token, hashToken(token), nil
+}
+
+// hashToken is how tokens are stored, so a leaked table grants nothing.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// bearerToken reads the token from "Authorization: Bearer <token>".
+func bearerToken(c *gin.Context) string {
+	header := c.GetHeader("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(header[7:])
+}
+
+// requireAuth lets a request through only with a valid session or API
+// token.
+func requireAuth(c *gin.Context) {
+	token := bearerToken(c)
+	if token == "" {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Sign in required"})
+		return
+	}
+	// A session token can start with the prefix too, so fall back to sessions
+	if strings.HasPrefix(token, apiTokenPrefix) {
+		ok, err := authenticateAPIToken(c, token)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if ok {
+			c.Next()
+			return
+		}
+	}
+	var userID int
+	err := db.QueryRow("SELECT user_id FROM sessions WHERE token_hash = $1 AND expires_at > CURRENT_TIMESTAMP", hashToken(token)).Scan(&userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Token expired, revoked or invalid; sign in again"})
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Set(userKey, userID)
+	c.Next()
+}
+
+// currentUser is the signed-in user of the request.
+func currentUser(c *gin.Context) int {
+	return c.GetInt(userKey)
+}
+
+const userColumns = "id, email, COALESCE(name, ''), created_at"
+
+func scanUser(row interface{ Scan(...interface{}) error }) (User, error) {
+	var u User
+	err := row.Scan(&u.ID, &u.Email, &u.Name, &u.CreatedAt)
+	return u, err
+}
+
+// credentials is the body of register and login requests.
+type credentials struct {
+	Email    string `json:"email" binding:"required"`
+	Password string `json:"password" binding:"required"`
+	Name     string `json:"name"`
+}
+
+// register creates an account with its own "Main" portfolio and signs it
+// in.
+func register(c *gin.Context) {
+	var input credentials
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	input.Email = strings.ToLower(strings.TrimSpace(input.Email))
+	if !strings.Contains(input.Email, "@") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid email"})
+		return
+	}
+	if len(input.Password) < minPasswordLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Password must be at least %d characters", minPasswordLength)})
+		return
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(input.Password), bcrypt.DefaultCost)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Start transaction
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	user, err := scanUser(tx.QueryRow(
+		"INSERT INTO users (email, name, password_hash) VALUES ($1, NULLIF($2, ''), $3) RETURNING "+userColumns,
+		input.Email, strings.TrimSpace(input.Name), string(hash),
+	))
+	if err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+			c.JSON(http.StatusConflict, gin.H{"error": "An account with this email already exists"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	_, err = tx.Exec("INSERT INTO portfolios (user_id, name) VALUES ($1, 'Main')", user.ID)
+	if err == nil {
+		_, err = tx.Exec(`
+			INSERT INTO portfolio_members (portfolio_id, user_id, role)
+			SELECT id, user_id, $2 FROM portfolios WHERE user_id = $1
+			ON CONFLICT DO NOTHING
+		`, user.ID, RoleOwner)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	token, expiresAt, err := createSession(tx, user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"token": token, "expires_at": expiresAt, "user": user})
+}
+
+// login exchanges an email and password for a session token.
+func login(c *gin.Context) {
+	var input credentials
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var user User
+	var hash string
+	err := db.QueryRow("SELECT "+userColumns+", password_hash FROM users WHERE email = $1", strings.ToLower(strings.TrimSpace(input.Email))).
+		Scan(&user.ID, &user.Email, &user.Name, &user.CreatedAt, &hash)
+	if err != nil && err != sql.ErrNoRows {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err == sql.ErrNoRows || bcrypt.CompareHashAndPassword([]byte(hash), []byte(input.Password)) != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid email or password"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	token, expiresAt, err := createSession(tx, user.ID)
+	if err == nil {
+		// Expired sessions are cleaned up as new ones are made
+		_, err = tx.Exec("DELETE FROM sessions WHERE user_id = $1 AND expires_at <= CURRENT_TIMESTAMP", user.ID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"token": token, "expires_at": expiresAt, "user": user})
+}
+
+// createSession signs a user in for sessionTTL.
+func createSession(tx *sql.Tx, userID int) (string, time.Time, error) {
+	token, hash, err := newToken()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	var expiresAt time.Time
+	err = tx.QueryRow(
+		"INSERT INTO sessions (user_id, token_hash, expires_at) VALUES ($1, $2, $3) RETURNING expires_at",
+		userID, hash, time.Now().Add(sessionTTL),
+	).Scan(&expiresAt)
+	return token, expiresAt, err
+}
+
+// claimPortfolios gives the signed-in user the portfolios recorded before
+// accounts existed, given CLAIM_TOKEN. Nobody gets them without it, so the
+// first to register on an exposed instance does not take over the books.
+func claimPortfolios(c *gin.Context) {
+	var input struct {
+		ClaimToken string `json:"claim_token" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if claimToken == "" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Claiming is disabled; set CLAIM_TOKEN on the server"})
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(input.ClaimToken), []byte(claimToken)) != 1 {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Invalid claim token"})
+		return
+	}
+
+	// Start transaction
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE portfolios SET user_id = $1 WHERE user_id IS NULL", currentUser(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	n, _ := result.RowsAffected()
+	if n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No unowned portfolios to claim"})
+		return
+	}
+	_, err = tx.Exec(`
+		INSERT INTO portfolio_members (portfolio_id, user_id, role)
+		SELECT id, user_id, $2 FROM portfolios WHERE user_id = $1
+		ON CONFLICT (portfolio_id, user_id) DO UPDATE SET role = EXCLUDED.role
+	`, currentUser(c), RoleOwner)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"claimed": n, "message": "Portfolios claimed successfully"})
+}
+
+// logout ends the session the request was made with.
+func logout(c *gin.Context) {
+	if _, err := db.Exec("DELETE FROM sessions WHERE token_hash = $1", hashToken(bearerToken(c))); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Signed out successfully"})
+}
+
+// getCurrentUser returns the signed-in account.
+func getCurrentUser(c *gin.Context) {
+	user, err := scanUser(db.QueryRow("SELECT "+userColumns+" FROM users WHERE id = $1", currentUser(c)))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, user)
+}
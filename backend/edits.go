@@ -0,0 +1,409 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shopspring/decimal"
+)
+
+// signedCapitalAmount stores withdrawals and realized losses as negative
+// amounts, like the endpoints that create them.
+func signedCapitalAmount(capitalType string, amount decimal.Decimal) decimal.Decimal {
+	if capitalType == "withdraw" || capitalType == "realized_loss" {
+		return amount.Neg()
+	}
+	return amount
+}
+
+// canonicalSelections re-encodes stored lot selections the way they are
+// written, since JSONB does not keep the original formatting.
+func canonicalSelections(stored sql.NullString) string {
+	var lots []LotSelection
+	if !stored.Valid || json.Unmarshal([]byte(stored.String), &lots) != nil {
+		return stored.String
+	}
+	encoded, _ := json.Marshal(lots)
+	return string(encoded)
+}
+
+// updateCapital corrects the amount, type, description or time of a capital
+// entry. Everything after it is recomputed by replaying history, and the
+// change is recorded in the audit history.
+func updateCapital(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid id"})
+		return
+	}
+
+	var input struct {
+		// Amount is always positive; withdrawals and losses are stored negative
+		Amount      string  `json:"amount"`
+		Type        string  `json:"type"`
+		Description *string `json:"description"`
+		ExecutedAt  string  `json:"executed_at"`
+		Reason      string  `json:"reason"`
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	executedAt, err := parseExecutedAt(input.ExecutedAt)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Start transaction
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	if err = lockLedger(tx); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	var oldAmountStr, oldType, oldDescription string
+	var oldCreatedAt time.Time
+	var voidedAt sql.NullTime
+	err = tx.QueryRow(
+		"SELECT amount, type, COALESCE(description, ''), created_at, voided_at FROM capitals WHERE id = $1 AND portfolio_id = $2 FOR UPDATE", id, portfolioID(c),
+	).Scan(&oldAmountStr, &oldType, &oldDescription, &oldCreatedAt, &voidedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Capital not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if voidedAt.Valid {
+		c.JSON(http.StatusConflict, gin.H{"error": "Voided capital entries cannot be edited"})
+		return
+	}
+	oldAmount, _ := decimal.NewFromString(oldAmountStr)
+
+	capitalType := oldType
+	if input.Type != "" {
+		capitalType = input.Type
+	}
+	amount := oldAmount.Abs()
+	if input.Amount != "" {
+		if amount, err = decimal.NewFromString(input.Amount); err != nil || !amount.IsPositive() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Amount must be positive"})
+			return
+		}
+	}
+	amount = signedCapitalAmount(capitalType, amount)
+	description := oldDescription
+	if input.Description != nil {
+		description = *input.Description
+	}
+	createdAt := oldCreatedAt
+	if executedAt.Valid {
+		createdAt = executedAt.Time
+	}
+
+	changes := auditChanges{}
+	changes.compare("amount", oldAmount.String(), amount.String())
+	changes.compare("type", oldType, capitalType)
+	changes.compare("description", oldDescription, description)
+	changes.compare("executed_at", oldCreatedAt.Format(time.RFC3339), createdAt.Format(time.RFC3339))
+	if len(changes) == 0 {
+		c.JSON(http.StatusOK, gin.H{"id": id, "changes": changes, "message": "Capital unchanged"})
+		return
+	}
+
+	// The replay below rewrites every later balance, so it must start from books that match
+	if err = checkBooksInSync(tx, portfolioID(c)); err != nil {
+		respondRebuildError(c, err, nil)
+		return
+	}
+
+	_, err = tx.Exec(
+		"UPDATE capitals SET amount = $1, type = $2, description = $3, created_at = $4 WHERE id = $5",
+		amount.String(), capitalType, description, createdAt, id,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if state, err := rebuildHoldings(tx, portfolioID(c)); err != nil {
+		respondRebuildError(c, err, state)
+		return
+	}
+
+	if err = recordAudit(tx, currentUser(c), AuditEntityCapital, id, "update", changes, input.Reason); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"id": id, "changes": changes, "message": "Capital updated successfully"})
+}
+
+// updateOrder corrects the asset, type, quote asset, amount, price, fee,
+// lots or time of a live order. Holdings, lots and realized PnL from that
+// point on are recomputed by replaying history, and the change is recorded
+// in the audit history.
+func updateOrder(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid id"})
+		return
+	}
+
+	var input struct {
+		Asset      string `json:"asset"`
+		Type       string `json:"type"`
+		QuoteAsset string `json:"quote_asset"`
+		QuoteRate  string `json:"quote_rate"`
+		// Amount or QuoteTotal sets the size; changing only the price keeps the amount
+		Amount     string         `json:"amount"`
+		QuoteTotal string         `json:"quote_total"`
+		TotalUSDT  string         `json:"total_usdt"`
+		Price      string         `json:"price"`
+		Fee        string         `json:"fee"`
+		FeeRate    string         `json:"fee_rate"`
+		FeeAsset   string         `json:"fee_asset"`
+		LotMethod  string         `json:"lot_method"`
+		Lots       []LotSelection `json:"lots"`
+		ExecutedAt string         `json:"executed_at"`
+		Reason     string         `json:"reason"`
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	executedAt, err := parseExecutedAt(input.ExecutedAt)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Start transaction
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	if err = lockLedger(tx); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	var oldLotMethod, priceSource, oldPriceStr string
+	var isCustomPrice bool
+	var oldSelections sql.NullString
+	var voidedAt sql.NullTime
+	old, err := scanTrade(tx.QueryRow(`
+		SELECT `+tradeColumns+`, COALESCE(quote_price, price), is_custom_price, COALESCE(price_source, ''),
+			COALESCE(lot_method, ''), lot_selections, voided_at
+		FROM orders
+		WHERE id = $1 AND portfolio_id = $2
+		FOR UPDATE
+	`, id, portfolioID(c)), &oldPriceStr, &isCustomPrice, &priceSource, &oldLotMethod, &oldSelections, &voidedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if voidedAt.Valid {
+		c.JSON(http.StatusConflict, gin.H{"error": "Voided orders cannot be edited"})
+		return
+	}
+	oldPrice, _ := decimal.NewFromString(oldPriceStr)
+
+	t := old
+	if input.Asset != "" {
+		t.asset = input.Asset
+	}
+	if input.Type != "" {
+		if input.Type != "buy" && input.Type != "sell" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "type must be buy or sell"})
+			return
+		}
+		t.orderType = input.Type
+	}
+	quote := input.QuoteAsset
+	if quote == "" {
+		quote = old.quote
+	}
+	if t.quote, err = parseQuoteAsset(quote, t.asset); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// A past rate cannot be looked up, so a new quote asset other than USDT or USD needs one
+	switch {
+	case input.QuoteRate != "":
+		if t.rate, err = decimal.NewFromString(input.QuoteRate); err != nil || !t.rate.IsPositive() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid quote_rate"})
+			return
+		}
+	case t.quote == old.quote:
+	case t.quote == "USDT" || t.quote == "USD":
+		t.rate = decimal.NewFromInt(1)
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "quote_rate is required when changing quote_asset"})
+		return
+	}
+
+	price := oldPrice
+	if input.Price != "" {
+		if price, err = decimal.NewFromString(input.Price); err != nil || !price.IsPositive() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid price"})
+			return
+		}
+	}
+	if !price.Equal(oldPrice) || !t.rate.Equal(old.rate) {
+		isCustomPrice = true
+		priceSource = PriceSourceManual
+	}
+
+	totalStr := input.QuoteTotal
+	if totalStr == "" && t.quote == "USDT" {
+		totalStr = input.TotalUSDT
+	}
+	switch {
+	case input.Amount != "" || totalStr != "":
+		if t.amount, t.quoteTotal, err = parseOrderSize(input.Amount, totalStr, price); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	case !price.Equal(oldPrice):
+		t.quoteTotal = t.amount.Mul(price)
+	}
+
+	// Keep the recorded fee unless a new one is given, revalidated against the new size
+	feeStr, feeAsset := input.Fee, input.FeeAsset
+	if feeStr == "" && input.FeeRate == "" {
+		feeStr = old.fee.Amount.String()
+	}
+	if feeAsset == "" && old.fee.base().IsPositive() {
+		feeAsset = "base"
+	}
+	if t.fee, err = parseTradeFee(feeStr, input.FeeRate, feeAsset, t.orderType, t.asset, t.quote, t.amount, t.quoteTotal); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Orders keep how they chose lots unless told otherwise or they now
+	// dispose of a different asset
+	oldOut, _ := old.disposed()
+	newOut, _ := t.disposed()
+	lotMethod, selections := oldLotMethod, oldSelections
+	switch {
+	case newOut == "USDT":
+		lotMethod, selections = "", sql.NullString{}
+	case input.LotMethod != "" || len(input.Lots) > 0:
+		if lotMethod, err = resolveLotMethod(input.LotMethod, input.Lots); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		selections = sql.NullString{}
+		if lotMethod == LotMethodSpecific {
+			if err = lotOrderIDs(tx, portfolioID(c), input.Lots); err != nil {
+				if errors.Is(err, errLotSelection) {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			encoded, _ := json.Marshal(input.Lots)
+			selections = sql.NullString{String: string(encoded), Valid: true}
+		}
+	case newOut != oldOut:
+		lotMethod, selections = defaultLotMethod(), sql.NullString{}
+	}
+
+	if executedAt.Valid {
+		t.at = executedAt.Time
+	}
+
+	changes := auditChanges{}
+	changes.compare("asset", old.asset, t.asset)
+	changes.compare("type", old.orderType, t.orderType)
+	changes.compare("quote_asset", old.quote, t.quote)
+	changes.compare("quote_rate", old.rate.String(), t.rate.String())
+	changes.compare("amount", old.amount.String(), t.amount.String())
+	changes.compare("price", oldPrice.String(), price.String())
+	changes.compare("quote_total", old.quoteTotal.String(), t.quoteTotal.String())
+	changes.compare("fee", old.fee.Amount.String(), t.fee.Amount.String())
+	changes.compare("fee_asset", old.fee.Asset, t.fee.Asset)
+	changes.compare("lot_method", oldLotMethod, lotMethod)
+	changes.compare("lots", canonicalSelections(oldSelections), selections.String)
+	changes.compare("executed_at", old.at.Format(time.RFC3339), t.at.Format(time.RFC3339))
+	if len(changes) == 0 {
+		c.JSON(http.StatusOK, gin.H{"id": id, "changes": changes, "message": "Order unchanged"})
+		return
+	}
+
+	// The replay below rewrites every later balance, so it must start from books that match
+	if err = checkBooksInSync(tx, portfolioID(c)); err != nil {
+		respondRebuildError(c, err, nil)
+		return
+	}
+
+	usdtPrice := price.Mul(t.rate)
+	_, err = tx.Exec(`
+		UPDATE orders SET asset = $1, type = $2, amount = $3, price = $4, total_usdt = $5, quote_asset = $6, quote_price = $7,
+			quote_total = $8, quote_rate = $9, is_custom_price = $10, price_source = $11, lot_method = NULLIF($12, ''),
+			lot_selections = $13, fee = $14, fee_asset = $15, fee_usdt = $16, created_at = $17
+		WHERE id = $18
+	`, t.asset, t.orderType, t.amount.String(), usdtPrice.String(), t.total().String(), t.quote, price.String(),
+		t.quoteTotal.String(), t.rate.String(), isCustomPrice, priceSource, lotMethod,
+		selections, t.fee.Amount.String(), t.fee.Asset, t.fee.valueAt(usdtPrice, t.rate).String(), t.at, id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	state, err := rebuildHoldings(tx, portfolioID(c))
+	if err != nil {
+		respondRebuildError(c, err, state)
+		return
+	}
+
+	if err = recordAudit(tx, currentUser(c), AuditEntityOrder, id, "update", changes, input.Reason); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"id":           id,
+		"changes":      changes,
+		"realized_pnl": state.realizedPnLFor(id),
+		"message":      "Order updated successfully",
+	})
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/shopspring/decimal"
+)
+
+// tradeFee is what an order paid the exchange, either in the quote asset
+// (USDT unless the order says otherwise) or in the traded asset (the base
+// asset).
+type tradeFee struct {
+	Amount decimal.Decimal
+	Asset  string
+	Quote  string // the order's quote asset
+}
+
+// quote is the part of the fee paid in the quote asset.
+func (f tradeFee) quote() decimal.Decimal {
+	if f.Asset == f.Quote {
+		return f.Amount
+	}
+	return decimal.Zero
+}
+
+// base is the part of the fee paid in the traded asset.
+func (f tradeFee) base() decimal.Decimal {
+	if f.Asset != f.Quote {
+		return f.Amount
+	}
+	return decimal.Zero
+}
+
+// valueAt is the fee in USDT, valuing quote fees at rate and base fees at
+// the execution price in USDT.
+func (f tradeFee) valueAt(price, rate decimal.Decimal) decimal.Decimal {
+	return f.quote().Mul(rate).Add(f.base().Mul(price))
+}
+
+// parseTradeFee reads the fee of an order from either an absolute amount or
+// a rate of the traded value. feeAsset is "quote" or the quote asset (the
+// default), or "base" or the traded asset itself. total is in the quote asset.
+func parseTradeFee(feeStr, rateStr, feeAsset, orderType, asset, quote string, amount, total decimal.Decimal) (tradeFee, error) {
+	fee := tradeFee{Asset: quote, Quote: quote}
+	switch strings.ToUpper(feeAsset) {
+	case "", "QUOTE", quote:
+	case "BASE", strings.ToUpper(asset):
+		fee.Asset = asset
+	default:
+		return fee, fmt.Errorf("fee_asset must be %s or %s", quote, asset)
+	}
+
+	switch {
+	case feeStr != "" && rateStr != "":
+		return fee, errors.New("give either fee or fee_rate, not both")
+	case feeStr != "":
+		var err error
+		if fee.Amount, err = decimal.NewFromString(feeStr); err != nil {
+			return fee, errors.New("invalid fee")
+		}
+	case rateStr != "":
+		rate, err := decimal.NewFromString(rateStr)
+		if err != nil || rate.IsNegative() || rate.GreaterThanOrEqual(decimal.NewFromInt(1)) {
+			return fee, errors.New("invalid fee_rate")
+		}
+		if fee.Asset == quote {
+			fee.Amount = total.Mul(rate)
+		} else {
+			fee.Amount = amount.Mul(rate)
+		}
+	}
+	fee.Amount = fee.Amount.Round(8)
+
+	if fee.Amount.IsNegative() {
+		return fee, errors.New("fee cannot be negative")
+	}
+	// A fee deducted from what the order delivers cannot consume all of it
+	if orderType == "buy" && fee.base().GreaterThanOrEqual(amount) {
+		return fee, fmt.Errorf("fee must be less than the %s bought", asset)
+	}
+	if orderType == "sell" && fee.quote().GreaterThanOrEqual(total) {
+		return fee, fmt.Errorf("fee must be less than the %s received", quote)
+	}
+	return fee, nil
+}
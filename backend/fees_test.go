@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestParseTradeFee(t *testing.T) {
+	d := decimal.RequireFromString
+	tests := []struct {
+		name                      string
+		fee, rate, feeAsset, side string
+		amount, total             string // in the asset and in the quote asset
+		wantAmount, wantAsset     string
+		wantErr                   string
+	}{
+		{name: "no fee", side: "buy", amount: "1", total: "100", wantAmount: "0", wantAsset: "USDT"},
+		{name: "absolute fee in the quote asset", fee: "0.1", side: "buy", amount: "1", total: "100", wantAmount: "0.1", wantAsset: "USDT"},
+		{name: "rate of the total", rate: "0.001", side: "sell", amount: "2", total: "200", wantAmount: "0.2", wantAsset: "USDT"},
+		{name: "rate of the amount in the base asset", rate: "0.001", feeAsset: "base", side: "buy", amount: "2", total: "200", wantAmount: "0.002", wantAsset: "BTC"},
+		{name: "fee asset named by symbol", fee: "0.0001", feeAsset: "btc", side: "buy", amount: "1", total: "100", wantAmount: "0.0001", wantAsset: "BTC"},
+		{name: "rounded to eight places", rate: "0.00075", side: "buy", amount: "0.000001", total: "0.0333333333", wantAmount: "0.000025", wantAsset: "USDT"},
+		{name: "both fee and rate", fee: "1", rate: "0.001", side: "buy", amount: "1", total: "100", wantErr: "give either fee or fee_rate, not both"},
+		{name: "unreadable fee", fee: "one", side: "buy", amount: "1", total: "100", wantErr: "invalid fee"},
+		{name: "rate of one", rate: "1", side: "buy", amount: "1", total: "100", wantErr: "invalid fee_rate"},
+		{name: "negative rate", rate: "-0.01", side: "buy", amount: "1", total: "100", wantErr: "invalid fee_rate"},
+		{name: "negative fee", fee: "-1", side: "buy", amount: "1", total: "100", wantErr: "fee cannot be negative"},
+		{name: "third asset", fee: "1", feeAsset: "BNB", side: "buy", amount: "1", total: "100", wantErr: "fee_asset must be USDT or BTC"},
+		{name: "buy fee eats what is bought", fee: "1", feeAsset: "base", side: "buy", amount: "1", total: "100", wantErr: "fee must be less than the BTC bought"},
+		{name: "sell fee eats the proceeds", fee: "100", side: "sell", amount: "1", total: "100", wantErr: "fee must be less than the USDT received"},
+		{name: "buy fee in the quote asset may exceed the total", fee: "150", side: "buy", amount: "1", total: "100", wantAmount: "150", wantAsset: "USDT"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fee, err := parseTradeFee(tt.fee, tt.rate, tt.feeAsset, tt.side, "BTC", "USDT", d(tt.amount), d(tt.total))
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !fee.Amount.Equal(d(tt.wantAmount)) || fee.Asset != tt.wantAsset || fee.Quote != "USDT" {
+				t.Errorf("fee = %s %s (quote %s), want %s %s", fee.Amount, fee.Asset, fee.Quote, tt.wantAmount, tt.wantAsset)
+			}
+		})
+	}
+}
+
+func TestTradeFeeParts(t *testing.T) {
+	d := decimal.RequireFromString
+	quoteFee := tradeFee{Amount: d("2"), Asset: "USDC", Quote: "USDC"}
+	baseFee := tradeFee{Amount: d("0.01"), Asset: "ETH", Quote: "USDC"}
+
+	if !quoteFee.quote().Equal(d("2")) || !quoteFee.base().IsZero() {
+		t.Errorf("quote fee split into %s and %s", quoteFee.quote(), quoteFee.base())
+	}
+	if !baseFee.base().Equal(d("0.01")) || !baseFee.quote().IsZero() {
+		t.Errorf("base fee split into %s and %s", baseFee.quote(), baseFee.base())
+	}
+	// USDC at 0.99 USDT, ETH at 3000 USDT
+	if got := quoteFee.valueAt(d("3000"), d("0.99")); !got.Equal(d("1.98")) {
+		t.Errorf("quote fee value = %s, want 1.98", got)
+	}
+	if got := baseFee.valueAt(d("3000"), d("0.99")); !got.Equal(d("30")) {
+		t.Errorf("base fee value = %s, want 30", got)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shopspring/decimal"
+)
+
+// FXRateSource supplies exchange rates for reporting values in currencies
+// other than USD. Portfolio values are kept in USDT, which is reported as USD.
+type FXRateSource interface {
+	// Name identifies the source in logs.
+	Name() string
+	// Rate returns how many units of currency one US dollar buys.
+	Rate(currency string) (decimal.Decimal, error)
+}
+
+// errUnknownCurrency marks currencies the FX source has no rate for.
+var errUnknownCurrency = errors.New("unsupported currency")
+
+var (
+	fxSource          FXRateSource
+	reportingCurrency = "USD"
+)
+
+// newFXRateSource builds the source selected by FX_PROVIDER ("mock" or
+// "file"). The file source reads FX_RATES_FILE, a JSON object of rates per
+// US dollar such as {"EUR": "0.92", "VND": "25400"}. Unset, there is no
+// source and values are only reported in USD; made-up mock rates have to be
+// asked for.
+func newFXRateSource() (FXRateSource, error) {
+	switch name := strings.ToLower(os.Getenv("FX_PROVIDER")); name {
+	case "":
+		return noFXSource{}, nil
+	case "mock":
+		return mockFXSource{}, nil
+	case "file":
+		path := os.Getenv("FX_RATES_FILE")
+		if path == "" {
+			return nil, errors.New("FX_PROVIDER=file needs FX_RATES_FILE")
+		}
+		source := fileFXSource{path: path}
+		if _, err := source.rates(); err != nil {
+			return nil, err
+		}
+		return source, nil
+	default:
+		return nil, fmt.Errorf("unknown FX_PROVIDER %q", name)
+	}
+}
+
+// defaultReportingCurrency reads REPORTING_CURRENCY, USD when unset.
+func defaultReportingCurrency(source FXRateSource) (string, error) {
+	currency := strings.ToUpper(os.Getenv("REPORTING_CURRENCY"))
+	if currency == "" {
+		return "USD", nil
+	}
+	if _, err := fxRate(source, currency); err != nil {
+		return "", err
+	}
+	return currency, nil
+}
+
+// fxRate is the rate from USD into currency. USD and USDT need no source.
+func fxRate(source FXRateSource, currency string) (decimal.Decimal, error) {
+	if currency == "USD" || currency == "USDT" {
+		return decimal.NewFromInt(1), nil
+	}
+	rate, err := source.Rate(currency)
+	if err != nil {
+		return decimal.Zero, err
+	}
+	if !rate.IsPositive() {
+		return decimal.Zero, fmt.Errorf("%w: no valid rate for %s", errUnknownCurrency, currency)
+	}
+	return rate, nil
+}
+
+// noFXSource has no rates, for when no FX_PROVIDER is configured.
+type noFXSource struct{}
+
+func (noFXSource) Name() string { return "no" }
+
+func (noFXSource) Rate(currency string) (decimal.Decimal, error) {
+	return decimal.Zero, fmt.Errorf("%w: %s needs an FX source; set FX_PROVIDER", errUnknownCurrency, currency)
+}
+
+// mockFXSource serves fixed rates so reporting works offline.
+type mockFXSource struct{}
+
+var mockFXRates = map[string]string{
+	"EUR": "0.92",
+	"GBP": "0.79",
+	"VND": "25400",
+	"JPY": "150",
+	"AUD": "1.52",
+	"CAD": "1.36",
+	"CHF": "0.88",
+	"SGD": "1.34",
+}
+
+func (mockFXSource) Name() string { return "mock" }
+
+func (mockFXSource) Rate(currency string) (decimal.Decimal, error) {
+	rate, ok := mockFXRates[currency]
+	if !ok {
+		return decimal.Zero, fmt.Errorf("%w: %s", errUnknownCurrency, currency)
+	}
+	return decimal.RequireFromString(rate), nil
+}
+
+// fileFXSource reads rates from a JSON file on every lookup, so the file can
+// be updated without a restart.
+type fileFXSource struct {
+	path string
+}
+
+func (s fileFXSource) Name() string { return "file" }
+
+func (s fileFXSource) rates() (map[string]decimal.Decimal, error) {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+	var rates map[string]decimal.Decimal
+	if err := json.Unmarshal(data, &rates); err != nil {
+		return nil, fmt.Errorf("invalid FX rates file %s: %w", s.path, err)
+	}
+	return rates, nil
+}
+
+func (s fileFXSource) Rate(currency string) (decimal.Decimal, error) {
+	rates, err := s.rates()
+	if err != nil {
+		return decimal.Zero, err
+	}
+	for code, rate := range rates {
+		if strings.EqualFold(code, currency) {
+			return rate, nil
+		}
+	}
+	return decimal.Zero, fmt.Errorf("%w: %s", errUnknownCurrency, currency)
+}
+
+// requestCurrency resolves ?currency= against the reporting currency and
+// returns it with its rate from USD. It responds itself when that fails.
+func requestCurrency(c *gin.Context) (string, decimal.Decimal, bool) {
+	currency := strings.ToUpper(c.DefaultQuery("currency", reportingCurrency))
+	rate, err := fxRate(fxSource, currency)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errUnknownCurrency) {
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return "", decimal.Zero, false
+	}
+	return currency, rate, true
+}
+
+// requireUSD refuses ?currency= on routes reporting past values: FX rates
+// are current, so converting with them would misstate those values. It
+// responds itself when refusing.
+func requireUSD(c *gin.Context) bool {
+	if currency := strings.ToUpper(c.Query("currency")); currency != "" && currency != "USD" && currency != "USDT" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "These figures are only reported in USD; there are no past FX rates to convert them to " + currency})
+		return false
+	}
+	return true
+}
+
+// inCurrency converts the monetary fields of a quote; percentages stay as they
+// are.
+func (p PriceData) inCurrency(currency string, rate decimal.Decimal) PriceData {
+	p.Price = p.Price.Mul(rate)
+	p.Change1h = p.Change1h.Mul(rate)
+	p.Change24h = p.Change24h.Mul(rate)
+	p.Change7d = p.Change7d.Mul(rate)
+	p.Change30d = p.Change30d.Mul(rate)
+	p.Currency = currency
+	return p
+}
+
+func (h HoldingDetail) inCurrency(rate decimal.Decimal) HoldingDetail {
+	h.AveragePrice = h.AveragePrice.Mul(rate)
+	h.CurrentPrice = h.CurrentPrice.Mul(rate)
+	h.TotalCost = h.TotalCost.Mul(rate)
+	h.CurrentValue = h.CurrentValue.Mul(rate)
+	h.PnL = h.PnL.Mul(rate)
+	return h
+}
+
+func (o PortfolioOverview) inCurrency(currency string, rate decimal.Decimal) PortfolioOverview {
+	o.TotalCapital = o.TotalCapital.Mul(rate)
+	o.AvailableUSDT = o.AvailableUSDT.Mul(rate)
+	o.TotalInvested = o.TotalInvested.Mul(rate)
+	o.CurrentValue = o.CurrentValue.Mul(rate)
+	o.UnrealizedPnL = o.UnrealizedPnL.Mul(rate)
+	o.RealizedLoss = o.RealizedLoss.Mul(rate)
+	o.RealizedGains = o.RealizedGains.Mul(rate)
+	o.RealizedLosses = o.RealizedLosses.Mul(rate)
+	o.RealizedPnL = o.RealizedPnL.Mul(rate)
+	o.TotalFees = o.TotalFees.Mul(rate)
+	o.NetTransfers = o.NetTransfers.Mul(rate)
+	o.TotalPnL = o.TotalPnL.Mul(rate)
+	holdings := make([]HoldingDetail, len(o.Holdings))
+	for i, h := range o.Holdings {
+		holdings[i] = h.inCurrency(rate)
+	}
+	o.Holdings = holdings
+	o.Currency = currency
+	return o
+}
+
+// pricesInCurrency converts a list of quotes.
+func pricesInCurrency(prices []PriceData, currency string, rate decimal.Decimal) []PriceData {
+	converted := make([]PriceData, len(prices))
+	for i, p := range prices {
+		converted[i] = p.inCurrency(currency, rate)
+	}
+	return converted
+}
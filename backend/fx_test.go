@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shopspring/decimal"
+)
+
+func TestFXRate(t *testing.T) {
+	tests := []struct {
+		source   FXRateSource
+		currency string
+		want     string
+		wantErr  bool
+	}{
+		{noFXSource{}, "USD", "1", false},
+		{noFXSource{}, "USDT", "1", false},
+		{noFXSource{}, "EUR", "", true},
+		{mockFXSource{}, "EUR", "0.92", false},
+		{mockFXSource{}, "XYZ", "", true},
+	}
+	for _, tt := range tests {
+		rate, err := fxRate(tt.source, tt.currency)
+		if tt.wantErr {
+			if !errors.Is(err, errUnknownCurrency) {
+				t.Errorf("%s rate for %s: error = %v, want errUnknownCurrency", tt.source.Name(), tt.currency, err)
+			}
+			continue
+		}
+		if err != nil || !rate.Equal(decimal.RequireFromString(tt.want)) {
+			t.Errorf("%s rate for %s = %s, %v, want %s", tt.source.Name(), tt.currency, rate, err, tt.want)
+		}
+	}
+}
+
+// TestOverviewInCurrency converts every money field of an overview and
+// leaves percentages alone.
+func TestOverviewInCurrency(t *testing.T) {
+	var o PortfolioOverview
+	v := reflect.ValueOf(&o).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if f, ok := v.Field(i).Addr().Interface().(*decimal.Decimal); ok {
+			*f = decimal.NewFromInt(int64(100 + i))
+		}
+	}
+	o.Holdings = []HoldingDetail{{Asset: "BTC", Amount: decimal.NewFromInt(2), TotalCost: decimal.NewFromInt(100), PnLPercent: decimal.NewFromInt(5)}}
+
+	rate := decimal.RequireFromString("0.5")
+	got := o.inCurrency("EUR", rate)
+	if got.Currency != "EUR" {
+		t.Errorf("currency = %q, want EUR", got.Currency)
+	}
+	gv := reflect.ValueOf(got)
+	for i := 0; i < v.NumField(); i++ {
+		before, ok := v.Field(i).Interface().(decimal.Decimal)
+		if !ok {
+			continue
+		}
+		name := v.Type().Field(i).Name
+		want := before.Mul(rate)
+		if strings.HasSuffix(name, "Percent") {
+			want = before
+		}
+		if after := gv.Field(i).Interface().(decimal.Decimal); !after.Equal(want) {
+			t.Errorf("%s = %s, want %s", name, after, want)
+		}
+	}
+
+	h := got.Holdings[0]
+	if !h.Amount.Equal(decimal.NewFromInt(2)) || !h.TotalCost.Equal(decimal.NewFromInt(50)) || !h.PnLPercent.Equal(decimal.NewFromInt(5)) {
+		t.Errorf("holding = %+v, want the amount and percentage kept and the cost halved", h)
+	}
+	if !o.Holdings[0].TotalCost.Equal(decimal.NewFromInt(100)) {
+		t.Error("converting should not change the original holdings")
+	}
+}
+
+func TestRequireUSD(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{"", http.StatusNoContent},
+		{"?currency=usd", http.StatusNoContent},
+		{"?currency=USDT", http.StatusNoContent},
+		{"?currency=EUR", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		r := gin.New()
+		r.GET("/", func(c *gin.Context) {
+			if requireUSD(c) {
+				c.Status(http.StatusNoContent)
+			}
+		})
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/"+tt.query, nil))
+		if w.Code != tt.want {
+			t.Errorf("%q: status %d, want %d", tt.query, w.Code, tt.want)
+		}
+	}
+}
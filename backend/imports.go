@@ -0,0 +1,686 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shopspring/decimal"
+)
+
+// maxImportSize caps uploaded trade exports.
+const maxImportSize = 10 << 20
+
+// errNotATrade marks export rows that are not fills, such as deposits in a
+// Coinbase transaction history. They are skipped, not reported as errors.
+var errNotATrade = errors.New("not a trade")
+
+// importedTrade is one fill read from an exchange export.
+type importedTrade struct {
+	Row        int             `json:"row"` // line in the file
+	TradeID    string          `json:"trade_id"`
+	ExecutedAt time.Time       `json:"executed_at"`
+	Type       string          `json:"type"`
+	Asset      string          `json:"asset"`
+	QuoteAsset string          `json:"quote_asset"`
+	Amount     decimal.Decimal `json:"amount"`
+	QuotePrice decimal.Decimal `json:"quote_price"`
+	QuoteTotal decimal.Decimal `json:"quote_total"`
+	Fee        decimal.Decimal `json:"fee"`
+	FeeAsset   string          `json:"fee_asset"`
+	OrderID    int             `json:"order_id,omitempty"` // once imported
+}
+
+// ImportProblem is a row that was not imported, and why.
+type ImportProblem struct {
+	Row     int    `json:"row"`
+	TradeID string `json:"trade_id,omitempty"`
+	Reason  string `json:"reason"`
+}
+
+// csvRow is a record of an export, read by header name.
+type csvRow struct {
+	columns map[string]int
+	record  []string
+}
+
+// get returns the first of the named columns the export has, trimmed.
+func (r csvRow) get(names ...string) string {
+	for _, name := range names {
+		if i, ok := r.columns[name]; ok && i < len(r.record) {
+			return strings.TrimSpace(r.record[i])
+		}
+	}
+	return ""
+}
+
+// decimal reads a number, ignoring thousands separators, currency signs and
+// sign; exports disagree on whether fees and buys are negative.
+func (r csvRow) decimal(names ...string) (decimal.Decimal, error) {
+	v := strings.NewReplacer(",", "", "$", "", "€", "", "£", "").Replace(r.get(names...))
+	if v == "" {
+		return decimal.Zero, nil
+	}
+	d, err := decimal.NewFromString(v)
+	if err != nil {
+		return d, fmt.Errorf("invalid number %q in %s", v, names[0])
+	}
+	return d.Abs(), nil
+}
+
+// exchangeFormat is one layout of an exchange's trade export, recognized by
+// its header.
+type exchangeFormat struct {
+	name     string
+	required []string // lowercase header names that identify it
+	parse    func(r csvRow) (importedTrade, error)
+}
+
+// exchangeFormats are the exports understood per exchange, tried in order.
+var exchangeFormats = map[string][]exchangeFormat{
+	"binance": {
+		{"trade history", []string{"date(utc)", "pair", "side", "price", "executed", "amount", "fee"}, parseBinanceTradeHistory},
+		{"order history", []string{"date(utc)", "market", "type", "price", "amount", "total", "fee", "fee coin"}, parseBinanceOrderHistory},
+	},
+	"coinbase": {
+		{"fills", []string{"trade id", "product", "side", "created at", "size", "price", "fee"}, parseCoinbaseFills},
+		{"transaction history", []string{"timestamp", "transaction type", "asset", "quantity transacted", "price at transaction"}, parseCoinbaseTransactions},
+	},
+	"kraken": {
+		{"trades", []string{"txid", "pair", "time", "type", "price", "cost", "fee", "vol"}, parseKrakenTrades},
+	},
+	"okx": {
+		{"trade history", []string{"trade id", "instrument", "side", "price", "size", "fee"}, parseOKXTrades},
+	},
+}
+
+func supportedExchanges() string {
+	names := make([]string, 0, len(exchangeFormats))
+	for name := range exchangeFormats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// parseTradeExport reads the fills of an export. Lines before the header,
+// such as Coinbase's preamble, are skipped. Rows that cannot be read are
+// returned as problems.
+func parseTradeExport(exchange string, file io.Reader) ([]importedTrade, []ImportProblem, []ImportProblem, error) {
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("unreadable CSV: %w", err)
+	}
+
+	var format *exchangeFormat
+	var columns map[string]int
+	start := 0
+	for i, record := range records {
+		columns = make(map[string]int, len(record))
+		for j, name := range record {
+			columns[strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))] = j
+		}
+		for k, f := range exchangeFormats[exchange] {
+			if hasColumns(columns, f.required) {
+				format = &exchangeFormats[exchange][k]
+				break
+			}
+		}
+		if format != nil {
+			start = i + 1
+			break
+		}
+	}
+	if format == nil {
+		return nil, nil, nil, fmt.Errorf("no %s trade export header found", exchange)
+	}
+
+	var trades []importedTrade
+	var errs, skipped []ImportProblem
+	occurrences := make(map[string]int)
+	for i, record := range records[start:] {
+		line := start + i + 1
+		if blankRecord(record) {
+			continue
+		}
+		t, err := format.parse(csvRow{columns: columns, record: record})
+		if errors.Is(err, errNotATrade) {
+			skipped = append(skipped, ImportProblem{Row: line, TradeID: t.TradeID, Reason: err.Error()})
+			continue
+		}
+		if err != nil {
+			errs = append(errs, ImportProblem{Row: line, TradeID: t.TradeID, Reason: err.Error()})
+			continue
+		}
+		// Exports without trade ids are keyed by the row itself, counting
+		// repeats, so importing the same file again finds the same keys
+		if t.TradeID == "" {
+			sum := sha256.Sum256([]byte(strings.Join(record, "\x1f")))
+			key := hex.EncodeToString(sum[:12])
+			occurrences[key]++
+			t.TradeID = fmt.Sprintf("row-%s-%d", key, occurrences[key])
+		}
+		t.Row = line
+		trades = append(trades, t)
+	}
+	return trades, errs, skipped, nil
+}
+
+func hasColumns(columns map[string]int, required []string) bool {
+	for _, name := range required {
+		if _, ok := columns[name]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func blankRecord(record []string) bool {
+	for _, v := range record {
+		if strings.TrimSpace(v) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// parseExportTime reads the timestamps of exports, which are UTC unless they
+// say otherwise. Numbers are Unix milliseconds.
+func parseExportTime(v string) (time.Time, error) {
+	if ms, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.UnixMilli(ms), nil
+	}
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02 15:04:05.999999999 MST", "2006-01-02 15:04:05.999999999", "2006-01-02T15:04:05.999999999", "2006-01-02 15:04"} {
+		if t, err := time.ParseInLocation(layout, v, time.UTC); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q", v)
+}
+
+// parseSide reads buy or sell.
+func parseSide(v string) (string, error) {
+	switch side := strings.ToLower(v); side {
+	case "buy", "sell":
+		return side, nil
+	}
+	return "", fmt.Errorf("invalid side %q", v)
+}
+
+// splitPair splits a pair such as BTCUSDT, BTC-USDT or BTC/USDT into the
+// asset and the quote asset. Concatenated pairs are split at a known quote.
+func splitPair(pair string) (string, string, error) {
+	pair = strings.ToUpper(pair)
+	for _, sep := range []string{"-", "/", "_"} {
+		if parts := strings.Split(pair, sep); len(parts) == 2 && parts[0] != "" && parts[1] != "" {
+			return parts[0], parts[1], nil
+		}
+	}
+	for _, quote := range []string{"USDT", "USDC", "USD", "BTC", "ETH"} {
+		if strings.HasSuffix(pair, quote) && len(pair) > len(quote) {
+			return strings.TrimSuffix(pair, quote), quote, nil
+		}
+	}
+	return "", "", fmt.Errorf("cannot split pair %q", pair)
+}
+
+// splitAmountUnit splits Binance amounts such as 0.01000000BTC.
+func splitAmountUnit(v string) (string, string) {
+	v = strings.ReplaceAll(strings.TrimSpace(v), ",", "")
+	i := strings.IndexFunc(v, func(r rune) bool { return (r < '0' || r > '9') && r != '.' && r != '-' })
+	if i < 0 {
+		return v, ""
+	}
+	return v[:i], strings.ToUpper(v[i:])
+}
+
+// completeTrade fills in the quote total or price from the other and checks
+// the amounts.
+func completeTrade(t importedTrade) (importedTrade, error) {
+	if !t.Amount.IsPositive() {
+		return t, errors.New("amount must be positive")
+	}
+	if t.QuoteTotal.IsZero() {
+		t.QuoteTotal = t.Amount.Mul(t.QuotePrice)
+	}
+	if t.QuotePrice.IsZero() {
+		t.QuotePrice = t.QuoteTotal.Div(t.Amount)
+	}
+	if !t.QuotePrice.IsPositive() {
+		return t, errors.New("price must be positive")
+	}
+	if t.FeeAsset == "" {
+		t.FeeAsset = t.QuoteAsset
+	}
+	return t, nil
+}
+
+// parseBinanceTradeHistory reads Binance's spot trade history, whose amounts
+// carry their asset: Executed in the asset, Amount in the quote asset.
+func parseBinanceTradeHistory(r csvRow) (importedTrade, error) {
+	var t importedTrade
+	var err error
+	if t.ExecutedAt, err = parseExportTime(r.get("date(utc)")); err != nil {
+		return t, err
+	}
+	if t.Type, err = parseSide(r.get("side")); err != nil {
+		return t, err
+	}
+	amount, asset := splitAmountUnit(r.get("executed"))
+	total, quote := splitAmountUnit(r.get("amount"))
+	fee, feeAsset := splitAmountUnit(r.get("fee"))
+	if asset == "" || quote == "" {
+		if asset, quote, err = splitPair(r.get("pair")); err != nil {
+			return t, err
+		}
+	}
+	t.Asset, t.QuoteAsset, t.FeeAsset = asset, quote, feeAsset
+	for _, f := range []struct {
+		value string
+		into  *decimal.Decimal
+	}{{amount, &t.Amount}, {total, &t.QuoteTotal}, {fee, &t.Fee}, {r.get("price"), &t.QuotePrice}} {
+		if f.value == "" {
+			continue
+		}
+		if *f.into, err = decimal.NewFromString(strings.ReplaceAll(f.value, ",", "")); err != nil {
+			return t, fmt.Errorf("invalid number %q", f.value)
+		}
+	}
+	return completeTrade(t)
+}
+
+// parseBinanceOrderHistory reads Binance's older trade export with a market
+// column and plain numbers.
+func parseBinanceOrderHistory(r csvRow) (importedTrade, error) {
+	var t importedTrade
+	var err error
+	if t.ExecutedAt, err = parseExportTime(r.get("date(utc)")); err != nil {
+		return t, err
+	}
+	if t.Type, err = parseSide(r.get("type")); err != nil {
+		return t, err
+	}
+	if t.Asset, t.QuoteAsset, err = splitPair(r.get("market")); err != nil {
+		return t, err
+	}
+	if t.QuotePrice, err = r.decimal("price"); err != nil {
+		return t, err
+	}
+	if t.Amount, err = r.decimal("amount"); err != nil {
+		return t, err
+	}
+	if t.QuoteTotal, err = r.decimal("total"); err != nil {
+		return t, err
+	}
+	if t.Fee, err = r.decimal("fee"); err != nil {
+		return t, err
+	}
+	t.FeeAsset = strings.ToUpper(r.get("fee coin"))
+	return completeTrade(t)
+}
+
+// parseCoinbaseFills reads Coinbase Advanced fills. The fee is in the quote
+// asset, and total includes it, so the total is taken from size and price.
+func parseCoinbaseFills(r csvRow) (importedTrade, error) {
+	t := importedTrade{TradeID: r.get("trade id")}
+	var err error
+	if t.ExecutedAt, err = parseExportTime(r.get("created at")); err != nil {
+		return t, err
+	}
+	if t.Type, err = parseSide(r.get("side")); err != nil {
+		return t, err
+	}
+	if t.Asset, t.QuoteAsset, err = splitPair(r.get("product")); err != nil {
+		return t, err
+	}
+	if t.Amount, err = r.decimal("size"); err != nil {
+		return t, err
+	}
+	if t.QuotePrice, err = r.decimal("price"); err != nil {
+		return t, err
+	}
+	if t.Fee, err = r.decimal("fee"); err != nil {
+		return t, err
+	}
+	return completeTrade(t)
+}
+
+// parseCoinbaseTransactions reads the buys and sells of a Coinbase
+// transaction history, priced in its price currency. The subtotal excludes
+// fees and spread.
+func parseCoinbaseTransactions(r csvRow) (importedTrade, error) {
+	t := importedTrade{TradeID: r.get("id")}
+	kind := strings.ToLower(r.get("transaction type"))
+	switch {
+	case strings.HasSuffix(kind, "buy"):
+		t.Type = "buy"
+	case strings.HasSuffix(kind, "sell"):
+		t.Type = "sell"
+	default:
+		return t, fmt.Errorf("%w: %s", errNotATrade, r.get("transaction type"))
+	}
+	var err error
+	if t.ExecutedAt, err = parseExportTime(r.get("timestamp")); err != nil {
+		return t, err
+	}
+	t.Asset = strings.ToUpper(r.get("asset"))
+	t.QuoteAsset = strings.ToUpper(r.get("price currency", "spot price currency"))
+	if t.Amount, err = r.decimal("quantity transacted"); err != nil {
+		return t, err
+	}
+	if t.QuotePrice, err = r.decimal("price at transaction", "spot price at transaction"); err != nil {
+		return t, err
+	}
+	if t.QuoteTotal, err = r.decimal("subtotal"); err != nil {
+		return t, err
+	}
+	if t.Fee, err = r.decimal("fees and/or spread", "fees"); err != nil {
+		return t, err
+	}
+	return completeTrade(t)
+}
+
+// krakenAssets maps Kraken's asset codes to common symbols.
+var krakenAssets = map[string]string{"XBT": "BTC", "XXBT": "BTC", "XETH": "ETH", "XDG": "DOGE", "XXDG": "DOGE", "ZUSD": "USD"}
+
+// parseKrakenTrades reads Kraken's trades export. Pairs use Kraken codes
+// such as XXBTZUSD; cost and fee are in the quote asset.
+func parseKrakenTrades(r csvRow) (importedTrade, error) {
+	t := importedTrade{TradeID: r.get("txid")}
+	var err error
+	if t.ExecutedAt, err = parseExportTime(r.get("time")); err != nil {
+		return t, err
+	}
+	if t.Type, err = parseSide(r.get("type")); err != nil {
+		return t, err
+	}
+	if t.Asset, t.QuoteAsset, err = splitKrakenPair(r.get("pair")); err != nil {
+		return t, err
+	}
+	if t.QuotePrice, err = r.decimal("price"); err != nil {
+		return t, err
+	}
+	if t.QuoteTotal, err = r.decimal("cost"); err != nil {
+		return t, err
+	}
+	if t.Fee, err = r.decimal("fee"); err != nil {
+		return t, err
+	}
+	if t.Amount, err = r.decimal("vol"); err != nil {
+		return t, err
+	}
+	return completeTrade(t)
+}
+
+func splitKrakenPair(pair string) (string, string, error) {
+	pair = strings.ToUpper(strings.ReplaceAll(pair, "/", ""))
+	for _, quote := range []string{"ZUSD", "USDT", "USDC", "XXBT", "XBT", "XETH", "ETH", "USD"} {
+		if strings.HasSuffix(pair, quote) && len(pair) > len(quote) {
+			return krakenAsset(strings.TrimSuffix(pair, quote)), krakenAsset(quote), nil
+		}
+	}
+	return "", "", fmt.Errorf("cannot split pair %q", pair)
+}
+
+func krakenAsset(code string) string {
+	if symbol, ok := krakenAssets[code]; ok {
+		return symbol
+	}
+	return code
+}
+
+// parseOKXTrades reads OKX's spot trade history. Fees are negative, in the
+// fee currency.
+func parseOKXTrades(r csvRow) (importedTrade, error) {
+	t := importedTrade{TradeID: r.get("trade id")}
+	var err error
+	if t.ExecutedAt, err = parseExportTime(r.get("trade time", "time")); err != nil {
+		return t, err
+	}
+	if t.Type, err = parseSide(r.get("side")); err != nil {
+		return t, err
+	}
+	if t.Asset, t.QuoteAsset, err = splitPair(r.get("instrument")); err != nil {
+		return t, err
+	}
+	if t.QuotePrice, err = r.decimal("price"); err != nil {
+		return t, err
+	}
+	if t.Amount, err = r.decimal("size"); err != nil {
+		return t, err
+	}
+	if t.Fee, err = r.decimal("fee"); err != nil {
+		return t, err
+	}
+	t.FeeAsset = strings.ToUpper(r.get("fee currency", "fee unit"))
+	return completeTrade(t)
+}
+
+// quoteRateAt is the USDT value of a quote asset when a trade happened,
+// from the live price closest to it recorded within a day.
+func quoteRateAt(tx *sql.Tx, quote string, at time.Time) (decimal.Decimal, error) {
+	if quote == "USDT" || quote == "USD" {
+		return decimal.NewFromInt(1), nil
+	}
+	var price string
+	err := tx.QueryRow(`
+		SELECT price FROM price_history
+		WHERE symbol = $1 AND source = 'live' AND recorded_at BETWEEN $2::timestamp - INTERVAL '1 day' AND $2::timestamp + INTERVAL '1 day'
+		ORDER BY ABS(EXTRACT(EPOCH FROM recorded_at - $2::timestamp))
+		LIMIT 1
+	`, quote, at).Scan(&price)
+	if err == sql.ErrNoRows {
+		return decimal.Zero, fmt.Errorf("no %s price recorded within a day of the trade to value it in USDT", quote)
+	}
+	if err != nil {
+		return decimal.Zero, err
+	}
+	return decimal.NewFromString(price)
+}
+
+// importTrades records the fills of an exchange export as orders. Fills
+// already imported into the portfolio, known by exchange and trade id, are
+// skipped. The orders are backdated to their fills and history is replayed
+// once; with dry_run the result is reported and nothing is kept.
+func importTrades(c *gin.Context) {
+	exchange := strings.ToLower(c.PostForm("exchange"))
+	if _, ok := exchangeFormats[exchange]; !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "exchange must be one of " + supportedExchanges()})
+		return
+	}
+	dryRun := c.PostForm("dry_run") == "true"
+	skipInvalid := c.PostForm("skip_invalid") == "true"
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxImportSize)
+	header, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "file is required: " + err.Error()})
+		return
+	}
+	file, err := header.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	defer file.Close()
+
+	trades, errs, skipped, err := parseTradeExport(exchange, file)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Sells, and buys paid with anything but USDT, dispose of lots
+	lotMethod, err := resolveLotMethod(c.PostForm("lot_method"), nil)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Start transaction
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	if err = lockLedger(tx); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	// Replaying would silently overwrite books that drifted from history
+	if err = checkBooksInSync(tx, portfolioID(c)); err != nil {
+		respondRebuildError(c, err, nil)
+		return
+	}
+
+	known, err := importedTradeIDs(tx, portfolioID(c), exchange)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	imported := []importedTrade{}
+	for _, t := range trades {
+		if known[t.TradeID] {
+			skipped = append(skipped, ImportProblem{Row: t.Row, TradeID: t.TradeID, Reason: "already imported"})
+			continue
+		}
+		known[t.TradeID] = true
+
+		if t.OrderID, err = insertImportedOrder(tx, portfolioID(c), exchange, t, lotMethod); err != nil {
+			var rowErr importRowError
+			if errors.As(err, &rowErr) {
+				errs = append(errs, ImportProblem{Row: t.Row, TradeID: t.TradeID, Reason: rowErr.Error()})
+				continue
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		imported = append(imported, t)
+	}
+	if errs == nil {
+		errs = []ImportProblem{}
+	}
+	if skipped == nil {
+		skipped = []ImportProblem{}
+	}
+
+	result := gin.H{
+		"exchange": exchange,
+		"dry_run":  dryRun,
+		"trades":   imported,
+		"skipped":  skipped,
+		"errors":   errs,
+	}
+	if len(errs) > 0 && !skipInvalid && !dryRun {
+		result["error"] = "Some rows cannot be imported; fix them or set skip_invalid"
+		c.JSON(http.StatusBadRequest, result)
+		return
+	}
+
+	// Balances, lots and realized PnL follow from replaying with the fills in place
+	state, err := rebuildHoldings(tx, portfolioID(c))
+	if err != nil && !errors.Is(err, errReplayIssues) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	issues := []ReplayIssue{}
+	if err != nil {
+		issues = state.issues
+	}
+	result["issues"] = issues
+
+	if dryRun {
+		result["message"] = fmt.Sprintf("%d trades would be imported", len(imported))
+		c.JSON(http.StatusOK, result)
+		return
+	}
+	if len(issues) > 0 {
+		result["error"] = "The imported trades cannot be replayed, e.g. a buy without enough balance; record the capital or earlier trades first"
+		c.JSON(http.StatusBadRequest, result)
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	result["message"] = fmt.Sprintf("%d trades imported", len(imported))
+	c.JSON(http.StatusOK, result)
+}
+
+// importRowError is a fill that cannot become an order.
+type importRowError struct{ error }
+
+// importedTradeIDs returns the trade ids already imported from an exchange
+// into a portfolio, voided orders included.
+func importedTradeIDs(tx *sql.Tx, portfolioID int, exchange string) (map[string]bool, error) {
+	rows, err := tx.Query("SELECT exchange_trade_id FROM orders WHERE portfolio_id = $1 AND exchange = $2 AND exchange_trade_id IS NOT NULL", portfolioID, exchange)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	known := make(map[string]bool)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		known[id] = true
+	}
+	return known, rows.Err()
+}
+
+// insertImportedOrder records a fill as an order at its execution time,
+// leaving the ledger to the replay that follows.
+func insertImportedOrder(tx *sql.Tx, portfolioID int, exchange string, t importedTrade, lotMethod string) (int, error) {
+	quote, err := parseQuoteAsset(t.QuoteAsset, t.Asset)
+	if err != nil {
+		return 0, importRowError{err}
+	}
+	if t.ExecutedAt.After(time.Now()) {
+		return 0, importRowError{errors.New("executed in the future")}
+	}
+	rate, err := quoteRateAt(tx, quote, t.ExecutedAt)
+	if err != nil {
+		return 0, importRowError{err}
+	}
+	fee, err := parseTradeFee(t.Fee.String(), "", t.FeeAsset, t.Type, t.Asset, quote, t.Amount, t.QuoteTotal)
+	if err != nil {
+		return 0, importRowError{err}
+	}
+	if t.Type == "buy" && quote == "USDT" {
+		lotMethod = ""
+	}
+
+	tr := trade{portfolioID: portfolioID, orderType: t.Type, asset: t.Asset, quote: quote, amount: t.Amount, quoteTotal: t.QuoteTotal, rate: rate, fee: fee}
+	price := t.QuotePrice.Mul(rate)
+
+	var id int
+	err = tx.QueryRow(`
+		INSERT INTO orders (asset, type, amount, price, total_usdt, quote_asset, quote_price, quote_total, quote_rate, is_custom_price, price_source,
+			lot_method, fee, fee_asset, fee_usdt, created_at, portfolio_id, exchange, exchange_trade_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, TRUE, $10, NULLIF($11, ''), $12, $13, $14, $15, $16, $17, $18)
+		RETURNING id
+	`, t.Asset, t.Type, t.Amount.String(), price.String(), tr.total().String(), quote, t.QuotePrice.String(), t.QuoteTotal.String(), rate.String(),
+		PriceSourceManual, lotMethod, fee.Amount.String(), fee.Asset, fee.valueAt(price, rate).String(), t.ExecutedAt.Local(), portfolioID, exchange, t.TradeID,
+	).Scan(&id)
+	return id, err
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestSplitPair(t *testing.T) {
+	tests := []struct {
+		pair, asset, quote string
+		wantErr            bool
+	}{
+		{pair: "BTC-USDT", asset: "BTC", quote: "USDT"},
+		{pair: "eth/btc", asset: "ETH", quote: "BTC"},
+		{pair: "SOL_USDC", asset: "SOL", quote: "USDC"},
+		{pair: "BTCUSDT", asset: "BTC", quote: "USDT"},
+		{pair: "ETHUSD", asset: "ETH", quote: "USD"},
+		{pair: "LINKETH", asset: "LINK", quote: "ETH"},
+		{pair: "USDT", wantErr: true},
+		{pair: "BTCEUR", wantErr: true},
+	}
+	for _, tt := range tests {
+		asset, quote, err := splitPair(tt.pair)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("splitPair(%q) error = %v, want error %v", tt.pair, err, tt.wantErr)
+			continue
+		}
+		if asset != tt.asset || quote != tt.quote {
+			t.Errorf("splitPair(%q) = %q, %q, want %q, %q", tt.pair, asset, quote, tt.asset, tt.quote)
+		}
+	}
+}
+
+func TestSplitKrakenPair(t *testing.T) {
+	tests := []struct {
+		pair, asset, quote string
+	}{
+		{"XXBTZUSD", "BTC", "USD"},
+		{"XETHXXBT", "ETH", "BTC"},
+		{"SOLUSDT", "SOL", "USDT"},
+		{"DOT/USD", "DOT", "USD"},
+		{"XXDGZUSD", "DOGE", "USD"},
+	}
+	for _, tt := range tests {
+		asset, quote, err := splitKrakenPair(tt.pair)
+		if err != nil || asset != tt.asset || quote != tt.quote {
+			t.Errorf("splitKrakenPair(%q) = %q, %q, %v, want %q, %q", tt.pair, asset, quote, err, tt.asset, tt.quote)
+		}
+	}
+}
+
+func TestCompleteTrade(t *testing.T) {
+	d := decimal.RequireFromString
+	tests := []struct {
+		name         string
+		in           importedTrade
+		price, total string
+		feeAsset     string
+		wantErr      string
+	}{
+		{
+			name:  "total from price",
+			in:    importedTrade{Amount: d("2"), QuotePrice: d("100"), QuoteAsset: "USDT"},
+			price: "100", total: "200", feeAsset: "USDT",
+		},
+		{
+			name:  "price from total",
+			in:    importedTrade{Amount: d("4"), QuoteTotal: d("10"), QuoteAsset: "USDC", FeeAsset: "SOL"},
+			price: "2.5", total: "10", feeAsset: "SOL",
+		},
+		{
+			name:    "no amount",
+			in:      importedTrade{QuotePrice: d("100")},
+			wantErr: "amount must be positive",
+		},
+		{
+			name:    "no price or total",
+			in:      importedTrade{Amount: d("1")},
+			wantErr: "price must be positive",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := completeTrade(tt.in)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.QuotePrice.Equal(d(tt.price)) || !got.QuoteTotal.Equal(d(tt.total)) || got.FeeAsset != tt.feeAsset {
+				t.Errorf("got price %s, total %s, fee asset %s, want %s, %s, %s", got.QuotePrice, got.QuoteTotal, got.FeeAsset, tt.price, tt.total, tt.feeAsset)
+			}
+		})
+	}
+}
+
+func TestParseKrakenTrades(t *testing.T) {
+	header := "txid,ordertxid,pair,time,type,ordertype,price,cost,fee,vol,margin,misc,ledgers\n"
+	tests := []struct {
+		name    string
+		row     string
+		want    importedTrade
+		wantErr bool
+	}{
+		{
+			name: "buy",
+			row:  `"TX1","O1","XXBTZUSD","2024-03-01 12:30:00.1234","buy","limit",60000.0,600.0,1.2,0.01,0.0,"",""`,
+			want: importedTrade{TradeID: "TX1", Type: "buy", Asset: "BTC", QuoteAsset: "USD", Amount: decimal.RequireFromString("0.01"),
+				QuotePrice: decimal.RequireFromString("60000"), QuoteTotal: decimal.RequireFromString("600"), Fee: decimal.RequireFromString("1.2"), FeeAsset: "USD"},
+		},
+		{
+			name: "sell against bitcoin",
+			row:  `"TX2","O2","XETHXXBT","2024-03-02 08:00:00","sell","market",0.05,0.1,0.0002,2,0.0,"",""`,
+			want: importedTrade{TradeID: "TX2", Type: "sell", Asset: "ETH", QuoteAsset: "BTC", Amount: decimal.RequireFromString("2"),
+				QuotePrice: decimal.RequireFromString("0.05"), QuoteTotal: decimal.RequireFromString("0.1"), Fee: decimal.RequireFromString("0.0002"), FeeAsset: "BTC"},
+		},
+		{
+			name:    "unknown side",
+			row:     `"TX3","O3","XXBTZUSD","2024-03-02 08:00:00","margin","market",1,1,0,1,0.0,"",""`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trades, errs, _, err := parseTradeExport("kraken", strings.NewReader(header+tt.row+"\n"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantErr {
+				if len(errs) != 1 || len(trades) != 0 {
+					t.Fatalf("got %d trades and errors %v, want one error", len(trades), errs)
+				}
+				return
+			}
+			if len(errs) != 0 || len(trades) != 1 {
+				t.Fatalf("got %d trades and errors %v, want one trade", len(trades), errs)
+			}
+			got := trades[0]
+			if got.TradeID != tt.want.TradeID || got.Type != tt.want.Type || got.Asset != tt.want.Asset || got.QuoteAsset != tt.want.QuoteAsset ||
+				!got.Amount.Equal(tt.want.Amount) || !got.QuotePrice.Equal(tt.want.QuotePrice) || !got.QuoteTotal.Equal(tt.want.QuoteTotal) ||
+				!got.Fee.Equal(tt.want.Fee) || got.FeeAsset != tt.want.FeeAsset {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+			if got.Row != 2 {
+				t.Errorf("row = %d, want 2", got.Row)
+			}
+		})
+	}
+}
+
+func TestParseTradeExport(t *testing.T) {
+	tests := []struct {
+		name, exchange, csv string
+		trades, errs, skip  int
+		first               string // asset/quote of the first trade
+		wantErr             bool
+	}{
+		{
+			name:     "binance trade history with units in amounts",
+			exchange: "binance",
+			csv: "\ufeffDate(UTC),Pair,Side,Price,Executed,Amount,Fee\n" +
+				"2024-01-02 03:04:05,BTCUSDT,BUY,42000,0.01000000BTC,420.00000000USDT,0.00001000BTC\n" +
+				"2024-01-03 03:04:05,BTCUSDT,SELL,43000,0.01000000BTC,430.00000000USDT,0.43USDT\n",
+			trades: 2, first: "BTC/USDT",
+		},
+		{
+			name:     "binance order history",
+			exchange: "binance",
+			csv: "Date(UTC),Market,Type,Price,Amount,Total,Fee,Fee Coin\n" +
+				"2024-01-02 03:04:05,ETHBTC,BUY,0.05,1,0.05,0.001,ETH\n",
+			trades: 1, first: "ETH/BTC",
+		},
+		{
+			name:     "coinbase transactions skip non-trades after a preamble",
+			exchange: "coinbase",
+			csv: "You can use this transaction report to inform your likely tax obligations.\n\n" +
+				"ID,Timestamp,Transaction Type,Asset,Quantity Transacted,Price Currency,Price at Transaction,Subtotal,Total (inclusive of fees and/or spread),Fees and/or Spread,Notes\n" +
+				"a1,2024-01-02 03:04:05 UTC,Buy,ETH,0.5,USD,$2000.00,$1000.00,$1010.00,$10.00,\n" +
+				"a2,2024-01-05 03:04:05 UTC,Receive,ETH,1,USD,$2000.00,,,,\n",
+			trades: 1, skip: 1, first: "ETH/USD",
+		},
+		{
+			name:     "okx rows with errors are reported",
+			exchange: "okx",
+			csv: "Trade ID,Trade Time,Instrument,Side,Price,Size,Fee,Fee Currency\n" +
+				"7,2024-01-02 03:04:05,SOL-USDT,buy,100,2,-0.002,SOL\n" +
+				"8,2024-01-02 03:04:05,SOL-USDT,hold,100,2,-0.002,SOL\n" +
+				",,,,,,,\n",
+			trades: 1, errs: 1, first: "SOL/USDT",
+		},
+		{
+			name:     "header of another exchange",
+			exchange: "kraken",
+			csv:      "Trade ID,Trade Time,Instrument,Side,Price,Size,Fee\n",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trades, errs, skipped, err := parseTradeExport(tt.exchange, strings.NewReader(tt.csv))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(trades) != tt.trades || len(errs) != tt.errs || len(skipped) != tt.skip {
+				t.Fatalf("got %d trades, errors %v, skipped %v; want %d, %d, %d", len(trades), errs, skipped, tt.trades, tt.errs, tt.skip)
+			}
+			if got := trades[0].Asset + "/" + trades[0].QuoteAsset; got != tt.first {
+				t.Errorf("first trade is %s, want %s", got, tt.first)
+			}
+		})
+	}
+}
+
+func TestParseTradeExportKeysRowsWithoutIDs(t *testing.T) {
+	row := "2024-01-02 03:04:05,BTCUSDT,BUY,42000,0.01BTC,420USDT,0.42USDT\n"
+	csv := "Date(UTC),Pair,Side,Price,Executed,Amount,Fee\n" + row + row
+	trades, _, _, err := parseTradeExport("binance", strings.NewReader(csv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _, _, err := parseTradeExport("binance", strings.NewReader(csv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trades) != 2 || trades[0].TradeID == trades[1].TradeID {
+		t.Fatalf("identical rows should get distinct ids, got %+v", trades)
+	}
+	if trades[0].TradeID != again[0].TradeID || trades[1].TradeID != again[1].TradeID {
+		t.Error("importing the same file again should give the same ids")
+	}
+}
+
+func TestParseExportTime(t *testing.T) {
+	want := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, v := range []string{"2024-01-02 03:04:05", "2024-01-02T03:04:05Z", "2024-01-02 03:04:05 UTC", "1704164645000"} {
+		got, err := parseExportTime(v)
+		if err != nil || !got.Equal(want) {
+			t.Errorf("parseExportTime(%q) = %v, %v, want %v", v, got, err, want)
+		}
+	}
+	if _, err := parseExportTime("yesterday"); err == nil {
+		t.Error("expected an error for an unreadable time")
+	}
+}
+
+func TestParseCoinbaseTransactionsSkipsTransfers(t *testing.T) {
+	r := csvRow{columns: map[string]int{"transaction type": 0}, record: []string{"Send"}}
+	if _, err := parseCoinbaseTransactions(r); !errors.Is(err, errNotATrade) {
+		t.Errorf("error = %v, want errNotATrade", err)
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"github.com/shopspring/decimal"
+)
+
+// Journal entry kinds
+const (
+	EntryDeposit    = "deposit"
+	EntryWithdrawal = "withdrawal"
+	EntryBuy        = "buy"
+	EntrySell       = "sell"
+	EntryAdjustment = "adjustment"
+	EntryTransfer   = "transfer"
+)
+
+// Accounts that are not tied to an asset. Holdings live in "cash:<asset>"
+// and "asset:<asset>" accounts. Trade fees are capitalized rather than
+// expensed: they add to the cost of what a buy acquires and come out of what
+// a sell realizes, as lots carry them. AccountFees holds only the network
+// fees of transfers, which no lot carries on.
+const (
+	AccountCapital     = "equity:capital"
+	AccountAdjustments = "equity:adjustments"
+	AccountTransfers   = "equity:transfers"
+	AccountRealizedPnL = "income:realized_pnl"
+	AccountFees        = "expense:fees"
+)
+
+// Posting moves quantity and value in or out of one account. Values are in
+// USDT with debits positive and credits negative, so every entry sums to zero.
+type Posting struct {
+	Account  string          `json:"account"`
+	Asset    string          `json:"asset,omitempty"`
+	Quantity decimal.Decimal `json:"quantity"`
+	Value    decimal.Decimal `json:"value"`
+}
+
+// JournalEntry is one balanced movement, tied to the capital entry, order or
+// transfer that caused it.
+type JournalEntry struct {
+	ID          int       `json:"id"`
+	PortfolioID int       `json:"portfolio_id"`
+	Kind        string    `json:"kind"`
+	CapitalID   *int      `json:"capital_id"`
+	OrderID     *int      `json:"order_id"`
+	TransferID  *int      `json:"transfer_id"`
+	Description string    `json:"description"`
+	OccurredAt  time.Time `json:"occurred_at"`
+	Postings    []Posting `json:"postings"`
+}
+
+// AccountBalance is the running total of one account.
+type AccountBalance struct {
+	Account  string          `json:"account"`
+	Asset    string          `json:"asset,omitempty"`
+	Quantity decimal.Decimal `json:"quantity"`
+	Value    decimal.Decimal `json:"value"`
+}
+
+// holdingAccount names the account that holds an asset. USDT is cash.
+func holdingAccount(asset string) string {
+	if asset == "USDT" {
+		return "cash:" + asset
+	}
+	return "asset:" + asset
+}
+
+// capitalEntry moves USDT in (deposit) or out (withdrawal) against equity.
+func capitalEntry(portfolioID, capitalID int, amount decimal.Decimal, at time.Time) JournalEntry {
+	kind := EntryDeposit
+	if amount.IsNegative() {
+		kind = EntryWithdrawal
+	}
+	return JournalEntry{
+		PortfolioID: portfolioID,
+		Kind:        kind,
+		CapitalID:   &capitalID,
+		OccurredAt:  at,
+		Postings: []Posting{
+			{Account: holdingAccount("USDT"), Asset: "USDT", Quantity: amount, Value: amount},
+			{Account: AccountCapital, Value: amount.Neg()},
+		},
+	}
+}
+
+// buyEntry swaps the quote asset for an asset carried at cost: what the
+// quote asset was worth, fee included. The quote asset leaves at quoteCost,
+// its own cost basis; for USDT that is what was spent, otherwise any
+// difference is realized PnL on the quote asset. The fee is its own posting
+// on the account that paid it: paid in the quote asset it takes its share of
+// quoteCost, paid in the asset it reduces the quantity.
+func buyEntry(t trade, quoteCost decimal.Decimal) JournalEntry {
+	quoteCost = quoteCost.Round(8)
+	feeCost := decimal.Zero
+	if _, spent := t.disposed(); spent.IsPositive() {
+		feeCost = quoteCost.Mul(t.fee.quote()).Div(spent).Round(8)
+	}
+	postings := []Posting{
+		{Account: holdingAccount(t.asset), Asset: t.asset, Quantity: t.amount, Value: t.worth()},
+		{Account: holdingAccount(t.quote), Asset: t.quote, Quantity: t.quoteTotal.Neg(), Value: quoteCost.Sub(feeCost).Neg()},
+	}
+	if t.fee.Amount.IsPositive() {
+		postings = append(postings, Posting{Account: holdingAccount(t.fee.Asset), Asset: t.fee.Asset, Quantity: t.fee.Amount.Neg(), Value: feeCost.Neg()})
+	}
+	if pnl := t.worth().Sub(quoteCost); !pnl.IsZero() {
+		postings = append(postings, Posting{Account: AccountRealizedPnL, Value: pnl.Neg()})
+	}
+	return JournalEntry{PortfolioID: t.portfolioID, Kind: EntryBuy, OrderID: &t.orderID, OccurredAt: t.at, Postings: postings}
+}
+
+// sellEntry swaps an asset for the quote asset, carried at its USDT value.
+// What leaves the asset account, fee included, goes at costBasis; proceeds
+// net of the fee less that cost is realized PnL.
+func sellEntry(t trade, costBasis decimal.Decimal) JournalEntry {
+	costBasis = costBasis.Round(8)
+	feeValue := t.fee.quote().Mul(t.rate).Round(8)
+	postings := []Posting{
+		{Account: holdingAccount(t.quote), Asset: t.quote, Quantity: t.quoteTotal, Value: t.worth().Add(feeValue)},
+		{Account: holdingAccount(t.asset), Asset: t.asset, Quantity: t.amount.Neg(), Value: costBasis.Neg()},
+	}
+	if t.fee.Amount.IsPositive() {
+		postings = append(postings, Posting{Account: holdingAccount(t.fee.Asset), Asset: t.fee.Asset, Quantity: t.fee.Amount.Neg(), Value: feeValue.Neg()})
+	}
+	if pnl := t.worth().Sub(costBasis); !pnl.IsZero() {
+		postings = append(postings, Posting{Account: AccountRealizedPnL, Value: pnl.Neg()})
+	}
+	return JournalEntry{PortfolioID: t.portfolioID, Kind: EntrySell, OrderID: &t.orderID, OccurredAt: t.at, Postings: postings}
+}
+
+// transferEntries moves an asset between portfolios at cost, one entry on
+// each side balanced against the transfers account so neither capital nor
+// realized PnL changes. cost is the cost basis of everything sent; the
+// network fee's share of it is expensed by the sender.
+func transferEntries(t transfer, cost decimal.Decimal) (JournalEntry, JournalEntry) {
+	cost = cost.Round(8)
+	feeCost := t.feeCost(cost)
+	moved := cost.Sub(feeCost)
+
+	out := []Posting{
+		{Account: holdingAccount(t.asset), Asset: t.asset, Quantity: t.sent().Neg(), Value: cost.Neg()},
+		{Account: AccountTransfers, Value: moved},
+	}
+	if t.fee.IsPositive() {
+		out = append(out, Posting{Account: AccountFees, Value: feeCost})
+	}
+	in := []Posting{
+		{Account: holdingAccount(t.asset), Asset: t.asset, Quantity: t.amount, Value: moved},
+		{Account: AccountTransfers, Value: moved.Neg()},
+	}
+	return JournalEntry{PortfolioID: t.fromPortfolioID, Kind: EntryTransfer, TransferID: &t.id, OccurredAt: t.at, Postings: out},
+		JournalEntry{PortfolioID: t.toPortfolioID, Kind: EntryTransfer, TransferID: &t.id, OccurredAt: t.at, Postings: in}
+}
+
+// reversal undoes an entry with an adjustment that mirrors its postings.
+func (e JournalEntry) reversal(description string, at time.Time) JournalEntry {
+	postings := make([]Posting, len(e.Postings))
+	for i, p := range e.Postings {
+		postings[i] = Posting{Account: p.Account, Asset: p.Asset, Quantity: p.Quantity.Neg(), Value: p.Value.Neg()}
+	}
+	return JournalEntry{
+		PortfolioID: e.PortfolioID,
+		Kind:        EntryAdjustment,
+		CapitalID:   e.CapitalID,
+		OrderID:     e.OrderID,
+		TransferID:  e.TransferID,
+		Description: description,
+		OccurredAt:  at,
+		Postings:    postings,
+	}
+}
+
+// lockLedger serializes writers that check balances before posting. Reads
+// are not blocked.
+func lockLedger(tx *sql.Tx) error {
+	_, err := tx.Exec("LOCK TABLE postings IN SHARE ROW EXCLUSIVE MODE")
+	return err
+}
+
+// postEntry records a journal entry, refusing it unless it balances.
+func postEntry(tx *sql.Tx, e JournalEntry) (int, error) {
+	sum := decimal.Zero
+	for i := range e.Postings {
+		e.Postings[i].Quantity = e.Postings[i].Quantity.Round(8)
+		e.Postings[i].Value = e.Postings[i].Value.Round(8)
+		sum = sum.Add(e.Postings[i].Value)
+	}
+	if !sum.IsZero() {
+		return 0, fmt.Errorf("unbalanced %s entry: postings sum to %s", e.Kind, sum)
+	}
+
+	var entryID int
+	err := tx.QueryRow(`
+		INSERT INTO journal_entries (portfolio_id, kind, capital_id, order_id, transfer_id, description, occurred_at)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), $7)
+		RETURNING id
+	`, e.PortfolioID, e.Kind, e.CapitalID, e.OrderID, e.TransferID, e.Description, e.OccurredAt).Scan(&entryID)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, p := range e.Postings {
+		_, err = tx.Exec(`
+			INSERT INTO postings (entry_id, account, asset, quantity, value)
+			VALUES ($1, $2, NULLIF($3, ''), $4, $5)
+		`, entryID, p.Account, p.Asset, p.Quantity.String(), p.Value.String())
+		if err != nil {
+			return 0, err
+		}
+	}
+	return entryID, nil
+}
+
+// getJournal lists journal entries with their postings, newest first,
+// optionally only those touching an account, order, capital entry or transfer.
+func getJournal(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+		return
+	}
+
+	conditions := []string{"e.portfolio_id = $1"}
+	args := []interface{}{portfolioID(c)}
+	if account := c.Query("account"); account != "" {
+		args = append(args, account)
+		conditions = append(conditions, fmt.Sprintf("EXISTS (SELECT 1 FROM postings p WHERE p.entry_id = e.id AND p.account = $%d)", len(args)))
+	}
+	if orderID := c.Query("order_id"); orderID != "" {
+		args = append(args, orderID)
+		conditions = append(conditions, fmt.Sprintf("e.order_id = $%d", len(args)))
+	}
+	if capitalID := c.Query("capital_id"); capitalID != "" {
+		args = append(args, capitalID)
+		conditions = append(conditions, fmt.Sprintf("e.capital_id = $%d", len(args)))
+	}
+	if transferID := c.Query("transfer_id"); transferID != "" {
+		args = append(args, transferID)
+		conditions = append(conditions, fmt.Sprintf("e.transfer_id = $%d", len(args)))
+	}
+
+	query := "SELECT e.id, e.portfolio_id, e.kind, e.capital_id, e.order_id, e.transfer_id, COALESCE(e.description, ''), e.occurred_at FROM journal_entries e"
+	query += " WHERE " + strings.Join(conditions, " AND ")
+	args = append(args, limit)
+	query += fmt.Sprintf(" ORDER BY e.occurred_at DESC, e.id DESC LIMIT $%d", len(args))
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	entries := []JournalEntry{}
+	index := make(map[int]int)
+	var ids []int64
+	for rows.Next() {
+		var e JournalEntry
+		var capitalID, orderID, transferID sql.NullInt64
+		if err := rows.Scan(&e.ID, &e.PortfolioID, &e.Kind, &capitalID, &orderID, &transferID, &e.Description, &e.OccurredAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if capitalID.Valid {
+			id := int(capitalID.Int64)
+			e.CapitalID = &id
+		}
+		if orderID.Valid {
+			id := int(orderID.Int64)
+			e.OrderID = &id
+		}
+		if transferID.Valid {
+			id := int(transferID.Int64)
+			e.TransferID = &id
+		}
+		e.Postings = []Posting{}
+		index[e.ID] = len(entries)
+		ids = append(ids, int64(e.ID))
+		entries = append(entries, e)
+	}
+	if len(entries) == 0 {
+		c.JSON(http.StatusOK, entries)
+		return
+	}
+
+	postingRows, err := db.Query(`
+		SELECT entry_id, account, COALESCE(asset, ''), quantity, value
+		FROM postings
+		WHERE entry_id = ANY($1)
+		ORDER BY id
+	`, pq.Array(ids))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer postingRows.Close()
+
+	for postingRows.Next() {
+		var entryID int
+		var p Posting
+		var quantity, value string
+		if err := postingRows.Scan(&entryID, &p.Account, &p.Asset, &quantity, &value); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		p.Quantity, _ = decimal.NewFromString(quantity)
+		p.Value, _ = decimal.NewFromString(value)
+		e := &entries[index[entryID]]
+		e.Postings = append(e.Postings, p)
+	}
+
+	c.JSON(http.StatusOK, entries)
+}
+
+// getTrialBalance sums every account of the portfolio. The values always
+// net to zero.
+func getTrialBalance(c *gin.Context) {
+	rows, err := db.Query(`
+		SELECT p.account, COALESCE(p.asset, ''), SUM(p.quantity), SUM(p.value)
+		FROM postings p
+		JOIN journal_entries e ON e.id = p.entry_id
+		WHERE e.portfolio_id = $1
+		GROUP BY p.account, p.asset
+		ORDER BY p.account
+	`, portfolioID(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	balances := []AccountBalance{}
+	total := decimal.Zero
+	for rows.Next() {
+		var b AccountBalance
+		var quantity, value string
+		if err := rows.Scan(&b.Account, &b.Asset, &quantity, &value); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		b.Quantity, _ = decimal.NewFromString(quantity)
+		b.Value, _ = decimal.NewFromString(value)
+		total = total.Add(b.Value)
+		balances = append(balances, b)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"accounts": balances,
+		"total":    total,
+		"balanced": total.IsZero(),
+	})
+}
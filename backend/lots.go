@@ -0,0 +1,302 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shopspring/decimal"
+)
+
+// Lot matching methods applied on sells
+const (
+	LotMethodFIFO     = "fifo"
+	LotMethodLIFO     = "lifo"
+	LotMethodHIFO     = "hifo"
+	LotMethodSpecific = "specific"
+)
+
+// errLotSelection marks invalid lot choices supplied by the caller.
+var errLotSelection = errors.New("invalid lot selection")
+
+// TaxLot is a quantity of an asset acquired in one buy, with its cost basis.
+// Lots moved by a transfer keep the buy's acquisition date and cost.
+type TaxLot struct {
+	ID         int             `json:"id"`
+	OrderID    *int            `json:"order_id"`    // nil for opening lots created from pre-existing holdings
+	TransferID *int            `json:"transfer_id"` // the transfer that brought the lot into this portfolio
+	Asset      string          `json:"asset"`
+	Amount     decimal.Decimal `json:"amount"`
+	Remaining  decimal.Decimal `json:"remaining"`
+	CostBasis  decimal.Decimal `json:"cost_basis"` // for the full original amount
+	UnitCost   decimal.Decimal `json:"unit_cost"`
+	AcquiredAt time.Time       `json:"acquired_at"`
+}
+
+// LotSelection picks an amount from a specific lot when selling.
+type LotSelection struct {
+	LotID      int             `json:"lot_id"`
+	OrderID    *int            `json:"order_id,omitempty"`
+	TransferID *int            `json:"transfer_id,omitempty"`
+	Amount     decimal.Decimal `json:"amount"`
+}
+
+// lotDisposal is the part of a lot consumed by a sell or transfer.
+type lotDisposal struct {
+	lotID      int
+	orderID    sql.NullInt64 // of the lot
+	acquiredAt time.Time     // of the lot
+	amount     decimal.Decimal
+	costBasis  decimal.Decimal
+}
+
+// defaultLotMethod reads LOT_METHOD, falling back to FIFO.
+func defaultLotMethod() string {
+	switch method := strings.ToLower(os.Getenv("LOT_METHOD")); method {
+	case LotMethodFIFO, LotMethodLIFO, LotMethodHIFO:
+		return method
+	default:
+		return LotMethodFIFO
+	}
+}
+
+// resolveLotMethod validates the method requested for a sell. Supplying lots
+// implies specific identification.
+func resolveLotMethod(method string, selections []LotSelection) (string, error) {
+	method = strings.ToLower(method)
+	if len(selections) > 0 {
+		if method != "" && method != LotMethodSpecific {
+			return "", fmt.Errorf("%w: lots can only be chosen with the specific method", errLotSelection)
+		}
+		return LotMethodSpecific, nil
+	}
+	switch method {
+	case "":
+		return defaultLotMethod(), nil
+	case LotMethodFIFO, LotMethodLIFO, LotMethodHIFO:
+		return method, nil
+	case LotMethodSpecific:
+		return "", fmt.Errorf("%w: the specific method needs lots", errLotSelection)
+	default:
+		return "", fmt.Errorf("%w: unknown lot method %q", errLotSelection, method)
+	}
+}
+
+// createLot opens a lot for a buy.
+func createLot(tx *sql.Tx, portfolioID, orderID int, asset string, amount, costBasis decimal.Decimal, acquiredAt time.Time) error {
+	_, err := tx.Exec(`
+		INSERT INTO tax_lots (order_id, portfolio_id, asset, amount, remaining, cost_basis, acquired_at)
+		VALUES ($1, $2, $3, $4, $4, $5, $6)
+	`, orderID, portfolioID, asset, amount.String(), costBasis.String(), acquiredAt)
+	return err
+}
+
+// allocateLots decides which lots a sell of amount consumes and what cost
+// basis leaves with it. Lots are locked but not modified; recordDisposals
+// applies the result once the order exists. If the lots cover less than the
+// holding (history from before lots were tracked), the uncovered part is
+// costed at the holding's average cost.
+func allocateLots(tx *sql.Tx, portfolioID int, asset string, amount decimal.Decimal, method string, selections []LotSelection, holdingAmount, holdingCost decimal.Decimal) ([]lotDisposal, decimal.Decimal, error) {
+	order := "acquired_at ASC, id ASC"
+	switch method {
+	case LotMethodLIFO:
+		order = "acquired_at DESC, id DESC"
+	case LotMethodHIFO:
+		order = "cost_basis / amount DESC, acquired_at ASC, id ASC"
+	}
+
+	rows, err := tx.Query(`
+		SELECT id, order_id, acquired_at, remaining, amount, cost_basis FROM tax_lots
+		WHERE asset = $1 AND portfolio_id = $2 AND remaining > 0
+		ORDER BY `+order+`
+		FOR UPDATE
+	`, asset, portfolioID)
+	if err != nil {
+		return nil, decimal.Zero, err
+	}
+
+	type openLot struct {
+		id                      int
+		orderID                 sql.NullInt64
+		acquiredAt              time.Time
+		remaining, amount, cost decimal.Decimal
+	}
+	var lots []openLot
+	lotCost := decimal.Zero
+	lotRemaining := decimal.Zero
+	for rows.Next() {
+		var l openLot
+		var remaining, lotAmount, cost string
+		if err := rows.Scan(&l.id, &l.orderID, &l.acquiredAt, &remaining, &lotAmount, &cost); err != nil {
+			rows.Close()
+			return nil, decimal.Zero, err
+		}
+		l.remaining, _ = decimal.NewFromString(remaining)
+		l.amount, _ = decimal.NewFromString(lotAmount)
+		l.cost, _ = decimal.NewFromString(cost)
+		lots = append(lots, l)
+		lotRemaining = lotRemaining.Add(l.remaining)
+		lotCost = lotCost.Add(l.cost.Mul(l.remaining).Div(l.amount))
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, decimal.Zero, err
+	}
+
+	take := func(l openLot, qty decimal.Decimal) lotDisposal {
+		return lotDisposal{lotID: l.id, orderID: l.orderID, acquiredAt: l.acquiredAt, amount: qty, costBasis: l.cost.Mul(qty).Div(l.amount)}
+	}
+
+	var disposals []lotDisposal
+	totalCost := decimal.Zero
+
+	if method == LotMethodSpecific {
+		byID := make(map[int]openLot, len(lots))
+		for _, l := range lots {
+			byID[l.id] = l
+		}
+		selected := decimal.Zero
+		for _, sel := range selections {
+			l, ok := byID[sel.LotID]
+			if !ok {
+				return nil, decimal.Zero, fmt.Errorf("%w: lot %d is not an open %s lot", errLotSelection, sel.LotID, asset)
+			}
+			if !sel.Amount.IsPositive() || sel.Amount.GreaterThan(l.remaining) {
+				return nil, decimal.Zero, fmt.Errorf("%w: lot %d has %s remaining", errLotSelection, sel.LotID, l.remaining)
+			}
+			d := take(l, sel.Amount)
+			disposals = append(disposals, d)
+			totalCost = totalCost.Add(d.costBasis)
+			selected = selected.Add(sel.Amount)
+			l.remaining = l.remaining.Sub(sel.Amount)
+			byID[sel.LotID] = l
+		}
+		if !selected.Equal(amount) {
+			return nil, decimal.Zero, fmt.Errorf("%w: selected lots total %s but the order sells %s", errLotSelection, selected, amount)
+		}
+		return disposals, totalCost, nil
+	}
+
+	left := amount
+	for _, l := range lots {
+		if !left.IsPositive() {
+			break
+		}
+		qty := decimal.Min(left, l.remaining)
+		d := take(l, qty)
+		disposals = append(disposals, d)
+		totalCost = totalCost.Add(d.costBasis)
+		left = left.Sub(qty)
+	}
+
+	if left.IsPositive() {
+		untrackedAmount := holdingAmount.Sub(lotRemaining)
+		untrackedCost := holdingCost.Sub(lotCost)
+		log.Printf("Tax lots for %s cover %s of %s sold; costing the rest at average", asset, amount.Sub(left), amount)
+		if untrackedAmount.IsPositive() {
+			totalCost = totalCost.Add(untrackedCost.Mul(left).Div(untrackedAmount))
+		}
+	}
+
+	return disposals, totalCost, nil
+}
+
+// recordDisposals consumes the allocated lots for a sell order. Each
+// disposal is credited unitProceeds, the net proceeds per unit sold.
+func recordDisposals(tx *sql.Tx, orderID int, disposals []lotDisposal, unitProceeds decimal.Decimal, disposedAt time.Time) error {
+	for _, d := range disposals {
+		if _, err := tx.Exec("UPDATE tax_lots SET remaining = remaining - $1 WHERE id = $2", d.amount.String(), d.lotID); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`
+			INSERT INTO lot_disposals (lot_id, order_id, amount, cost_basis, proceeds, disposed_at)
+			VALUES ($1, $2, $3, $4, $5, $6)
+		`, d.lotID, orderID, d.amount.String(), d.costBasis.String(), d.amount.Mul(unitProceeds).String(), disposedAt)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lotOrderIDs fills in the buy order, and any transfer, behind each selected
+// lot so the choice survives lots being rebuilt. Opening lots have no buy
+// behind them and a replay splits them into the buys they came from, so
+// they cannot be chosen until holdings are rebuilt.
+func lotOrderIDs(tx *sql.Tx, portfolioID int, selections []LotSelection) error {
+	for i := range selections {
+		var orderID, transferID sql.NullInt64
+		err := tx.QueryRow("SELECT order_id, transfer_id FROM tax_lots WHERE id = $1 AND portfolio_id = $2", selections[i].LotID, portfolioID).Scan(&orderID, &transferID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return fmt.Errorf("%w: lot %d does not exist", errLotSelection, selections[i].LotID)
+			}
+			return err
+		}
+		if !orderID.Valid {
+			return fmt.Errorf("%w: lot %d is an opening lot from before lots were tracked; rebuild holdings to split it into the buys behind it, then choose from those", errLotSelection, selections[i].LotID)
+		}
+		id := int(orderID.Int64)
+		selections[i].OrderID = &id
+		if transferID.Valid {
+			id := int(transferID.Int64)
+			selections[i].TransferID = &id
+		}
+	}
+	return nil
+}
+
+// getAssetLots lists the lots of an asset, open ones only unless all=true.
+func getAssetLots(c *gin.Context) {
+	symbol := c.Param("symbol")
+
+	query := `
+		SELECT id, order_id, transfer_id, asset, amount, remaining, cost_basis, acquired_at
+		FROM tax_lots
+		WHERE asset = $1 AND portfolio_id = $2`
+	if c.Query("all") != "true" {
+		query += " AND remaining > 0"
+	}
+	query += " ORDER BY acquired_at, id"
+
+	rows, err := db.Query(query, symbol, portfolioID(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	lots := []TaxLot{}
+	for rows.Next() {
+		var lot TaxLot
+		var orderID, transferID sql.NullInt64
+		var amount, remaining, costBasis string
+		if err := rows.Scan(&lot.ID, &orderID, &transferID, &lot.Asset, &amount, &remaining, &costBasis, &lot.AcquiredAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if orderID.Valid {
+			id := int(orderID.Int64)
+			lot.OrderID = &id
+		}
+		if transferID.Valid {
+			id := int(transferID.Int64)
+			lot.TransferID = &id
+		}
+		lot.Amount, _ = decimal.NewFromString(amount)
+		lot.Remaining, _ = decimal.NewFromString(remaining)
+		lot.CostBasis, _ = decimal.NewFromString(costBasis)
+		if !lot.Amount.IsZero() {
+			lot.UnitCost = lot.CostBasis.Div(lot.Amount)
+		}
+		lots = append(lots, lot)
+	}
+
+	c.JSON(http.StatusOK, lots)
+}
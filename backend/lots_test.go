@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+var replayStart = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// depositEvent is a USDT deposit into a portfolio, days after replayStart.
+func depositEvent(id, portfolioID int, amount string, days int) replayEvent {
+	return replayEvent{kind: "capital", id: id, at: replayStart.AddDate(0, 0, days), portfolioID: portfolioID,
+		capitalType: "dca", amount: decimal.RequireFromString(amount)}
+}
+
+// orderEvent is a USDT order without fees, days after replayStart.
+func orderEvent(id, portfolioID int, orderType, asset, amount, total string, days int) replayEvent {
+	at := replayStart.AddDate(0, 0, days)
+	return replayEvent{kind: "order", id: id, at: at, trade: trade{
+		orderID: id, portfolioID: portfolioID, orderType: orderType, asset: asset, quote: "USDT",
+		amount: decimal.RequireFromString(amount), quoteTotal: decimal.RequireFromString(total),
+		rate: decimal.NewFromInt(1), fee: tradeFee{Asset: "USDT", Quote: "USDT"}, at: at,
+	}}
+}
+
+func TestResolveLotMethod(t *testing.T) {
+	t.Setenv("LOT_METHOD", "hifo")
+	lots := []LotSelection{{LotID: 1, Amount: decimal.NewFromInt(1)}}
+	tests := []struct {
+		method string
+		lots   []LotSelection
+		want   string
+		err    bool
+	}{
+		{method: "", want: LotMethodHIFO},
+		{method: "LIFO", want: LotMethodLIFO},
+		{method: "fifo", want: LotMethodFIFO},
+		{method: "", lots: lots, want: LotMethodSpecific},
+		{method: "specific", lots: lots, want: LotMethodSpecific},
+		{method: "fifo", lots: lots, err: true},
+		{method: "specific", err: true},
+		{method: "average", err: true},
+	}
+	for _, tt := range tests {
+		got, err := resolveLotMethod(tt.method, tt.lots)
+		if tt.err {
+			if !errors.Is(err, errLotSelection) {
+				t.Errorf("resolveLotMethod(%q, %d lots) error = %v, want errLotSelection", tt.method, len(tt.lots), err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("resolveLotMethod(%q, %d lots) = %q, %v, want %q", tt.method, len(tt.lots), got, err, tt.want)
+		}
+	}
+}
+
+func TestDefaultLotMethod(t *testing.T) {
+	for env, want := range map[string]string{"": LotMethodFIFO, "LIFO": LotMethodLIFO, "hifo": LotMethodHIFO, "specific": LotMethodFIFO} {
+		t.Setenv("LOT_METHOD", env)
+		if got := defaultLotMethod(); got != want {
+			t.Errorf("LOT_METHOD=%q gives %q, want %q", env, got, want)
+		}
+	}
+}
+
+// TestLotSelection sells one of three BTC bought at 100, 300 and 200 and
+// checks which lots each method consumes.
+func TestLotSelection(t *testing.T) {
+	t.Setenv("LOT_METHOD", "")
+	orderID := func(id int) *int { return &id }
+	tests := []struct {
+		name      string
+		method    string
+		lots      []LotSelection
+		amount    string
+		cost      string
+		remaining map[int]string // by the order that opened the lot
+		issues    int
+	}{
+		{name: "fifo", method: LotMethodFIFO, amount: "1", cost: "100", remaining: map[int]string{2: "0", 3: "1", 4: "1"}},
+		{name: "lifo", method: LotMethodLIFO, amount: "1", cost: "200", remaining: map[int]string{2: "1", 3: "1", 4: "0"}},
+		{name: "hifo", method: LotMethodHIFO, amount: "1", cost: "300", remaining: map[int]string{2: "1", 3: "0", 4: "1"}},
+		{name: "fifo across lots", method: LotMethodFIFO, amount: "1.5", cost: "250", remaining: map[int]string{2: "0", 3: "0.5", 4: "1"}},
+		{
+			name: "specific", method: LotMethodSpecific, amount: "1",
+			lots:      []LotSelection{{LotID: 7, OrderID: orderID(4), Amount: decimal.RequireFromString("0.25")}, {LotID: 8, OrderID: orderID(2), Amount: decimal.RequireFromString("0.75")}},
+			cost:      "125",
+			remaining: map[int]string{2: "0.25", 3: "1", 4: "0.75"},
+		},
+		{
+			name: "specific lot no longer open falls back", method: LotMethodSpecific, amount: "1",
+			lots:      []LotSelection{{LotID: 9, OrderID: orderID(99), Amount: decimal.NewFromInt(1)}},
+			cost:      "100",
+			remaining: map[int]string{2: "0", 3: "1", 4: "1"},
+			issues:    1,
+		},
+		{
+			name: "specific lots not adding up fall back", method: LotMethodSpecific, amount: "1",
+			lots:      []LotSelection{{LotID: 7, OrderID: orderID(4), Amount: decimal.RequireFromString("0.5")}},
+			cost:      "100",
+			remaining: map[int]string{2: "0", 3: "1", 4: "1"},
+			issues:    1,
+		},
+		{
+			name: "specific lot without its buy falls back", method: LotMethodSpecific, amount: "1",
+			lots:      []LotSelection{{LotID: 7, Amount: decimal.NewFromInt(1)}},
+			cost:      "100",
+			remaining: map[int]string{2: "0", 3: "1", 4: "1"},
+			issues:    1,
+		},
+		{
+			// Sells from before lot tracking took an equal share of every lot
+			name: "no method", method: "", amount: "1.5", cost: "300",
+			remaining: map[int]string{2: "0.5", 3: "0.5", 4: "0.5"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sell := orderEvent(5, 1, "sell", "BTC", tt.amount, "375", 4)
+			sell.lotMethod, sell.lots = tt.method, tt.lots
+			s := replay([]int{1}, []replayEvent{
+				depositEvent(1, 1, "600", 0),
+				orderEvent(2, 1, "buy", "BTC", "1", "100", 1),
+				orderEvent(3, 1, "buy", "BTC", "1", "300", 2),
+				orderEvent(4, 1, "buy", "BTC", "1", "200", 3),
+				sell,
+			})
+			if len(s.issues) != tt.issues {
+				t.Fatalf("issues = %+v, want %d", s.issues, tt.issues)
+			}
+			pnl := s.realizedPnLFor(5)
+			if pnl == nil {
+				t.Fatal("no realized PnL for the sell")
+			}
+			wantCost := decimal.RequireFromString(tt.cost)
+			if got := decimal.NewFromInt(375).Sub(*pnl); !got.Equal(wantCost) {
+				t.Errorf("cost basis = %s, want %s", got, wantCost)
+			}
+			for _, l := range s.lots {
+				if want := decimal.RequireFromString(tt.remaining[l.orderID]); !l.remaining.Equal(want) {
+					t.Errorf("lot of order %d has %s remaining, want %s", l.orderID, l.remaining, want)
+				}
+			}
+			btc := s.holding(1, "BTC")
+			if want := decimal.NewFromInt(600).Sub(wantCost); !btc.TotalCost.Equal(want) {
+				t.Errorf("BTC total cost = %s, want %s", btc.TotalCost, want)
+			}
+		})
+	}
+}
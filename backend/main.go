@@ -3,18 +3,20 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/shopspring/decimal"
 )
 
@@ -27,17 +29,64 @@ type Capital struct {
 	Type        string          `json:"type"` // "initial", "dca", "withdraw", or "realized_loss"
 	Description string          `json:"description"`
 	CreatedAt   time.Time       `json:"created_at"`
+	VoidedAt    *time.Time      `json:"voided_at"`
 }
 
 type Order struct {
-	ID            int             `json:"id"`
-	Asset         string          `json:"asset"`
-	Type          string          `json:"type"` // "buy" or "sell"
-	Amount        decimal.Decimal `json:"amount"`
-	Price         decimal.Decimal `json:"price"`
-	TotalUSDT     decimal.Decimal `json:"total_usdt"`
-	IsCustomPrice bool            `json:"is_custom_price"`
-	CreatedAt     time.Time       `json:"created_at"`
+	ID            int              `json:"id"`
+	Asset         string           `json:"asset"`
+	Type          string           `json:"type"` // "buy" or "sell"
+	Amount        decimal.Decimal  `json:"amount"`
+	Price         decimal.Decimal  `json:"price"`      // in USDT
+	TotalUSDT     decimal.Decimal  `json:"total_usdt"` // value in USDT
+	QuoteAsset    string           `json:"quote_asset"`
+	QuotePrice    decimal.Decimal  `json:"quote_price"` // in the quote asset
+	QuoteTotal    decimal.Decimal  `json:"quote_total"`
+	QuoteRate     decimal.Decimal  `json:"quote_rate"` // USDT per unit of the quote asset
+	IsCustomPrice bool             `json:"is_custom_price"`
+	PriceSource   string           `json:"price_source"`
+	Fee           decimal.Decimal  `json:"fee"`
+	FeeAsset      string           `json:"fee_asset"` // the quote asset or the traded asset
+	FeeUSDT       decimal.Decimal  `json:"fee_usdt"`
+	RealizedPnL   *decimal.Decimal `json:"realized_pnl"` // on what the order disposed of, unless USDT
+	CreatedAt     time.Time        `json:"created_at"`
+	VoidedAt      *time.Time       `json:"voided_at"`
+	Exchange      string           `json:"exchange,omitempty"`          // set on imported orders
+	TradeID       string           `json:"exchange_trade_id,omitempty"` // the exchange's id of the fill
+}
+
+// orderColumns is the select list understood by scanOrder.
+const orderColumns = `id, asset, type, amount, price, total_usdt, COALESCE(quote_asset, 'USDT'), COALESCE(quote_price, price),
+	COALESCE(quote_total, total_usdt), COALESCE(quote_rate, 1), is_custom_price, COALESCE(price_source, ''), fee, COALESCE(fee_asset, 'USDT'), fee_usdt, created_at,
+	(SELECT pnl FROM realized_pnl WHERE realized_pnl.order_id = orders.id), voided_at,
+	COALESCE(exchange, ''), COALESCE(exchange_trade_id, '')`
+
+func scanOrder(rows *sql.Rows) (Order, error) {
+	var order Order
+	var amount, price, totalUSDT, quotePrice, quoteTotal, quoteRate, fee, feeUSDT string
+	var realizedPnL sql.NullString
+	var voidedAt sql.NullTime
+	if err := rows.Scan(&order.ID, &order.Asset, &order.Type, &amount, &price, &totalUSDT, &order.QuoteAsset, &quotePrice, &quoteTotal, &quoteRate,
+		&order.IsCustomPrice, &order.PriceSource, &fee, &order.FeeAsset, &feeUSDT, &order.CreatedAt, &realizedPnL, &voidedAt,
+		&order.Exchange, &order.TradeID); err != nil {
+		return Order{}, err
+	}
+	if voidedAt.Valid {
+		order.VoidedAt = &voidedAt.Time
+	}
+	order.Amount, _ = decimal.NewFromString(amount)
+	order.Price, _ = decimal.NewFromString(price)
+	order.TotalUSDT, _ = decimal.NewFromString(totalUSDT)
+	order.QuotePrice, _ = decimal.NewFromString(quotePrice)
+	order.QuoteTotal, _ = decimal.NewFromString(quoteTotal)
+	order.QuoteRate, _ = decimal.NewFromString(quoteRate)
+	order.Fee, _ = decimal.NewFromString(fee)
+	order.FeeUSDT, _ = decimal.NewFromString(feeUSDT)
+	if realizedPnL.Valid {
+		pnl, _ := decimal.NewFromString(realizedPnL.String)
+		order.RealizedPnL = &pnl
+	}
+	return order, nil
 }
 
 type Holding struct {
@@ -58,18 +107,39 @@ type PriceData struct {
 	PercentChange7d  decimal.Decimal `json:"percent_change_7d"`
 	Change30d        decimal.Decimal `json:"change_30d"`
 	PercentChange30d decimal.Decimal `json:"percent_change_30d"`
+	Source           string          `json:"source"` // "live", "cached", "mock" or "manual"
+	AsOf             time.Time       `json:"as_of"`
+	Currency         string          `json:"currency,omitempty"` // set when converted for reporting
 }
 
+// Price sources. "cached" is a last-known quote served because the provider
+// failed; quotes reused within the cache TTL stay "live". "cost" is no quote
+// at all: a holding valued at its average cost.
+const (
+	PriceSourceLive   = "live"
+	PriceSourceCached = "cached"
+	PriceSourceMock   = "mock"
+	PriceSourceManual = "manual"
+	PriceSourceCost   = "cost"
+)
+
 type PortfolioOverview struct {
 	TotalCapital    decimal.Decimal `json:"total_capital"`
 	AvailableUSDT   decimal.Decimal `json:"available_usdt"`
 	TotalInvested   decimal.Decimal `json:"total_invested"`
 	CurrentValue    decimal.Decimal `json:"current_value"`
 	UnrealizedPnL   decimal.Decimal `json:"unrealized_pnl"`
-	RealizedLoss    decimal.Decimal `json:"realized_loss"`
+	RealizedLoss    decimal.Decimal `json:"realized_loss"`   // manually recorded losses
+	RealizedGains   decimal.Decimal `json:"realized_gains"`  // from sell orders
+	RealizedLosses  decimal.Decimal `json:"realized_losses"` // from sell orders, positive
+	RealizedPnL     decimal.Decimal `json:"realized_pnl"`    // gains - losses
+	TotalFees       decimal.Decimal `json:"total_fees"`      // trading and network fees in USDT, already in cost basis and proceeds
+	NetTransfers    decimal.Decimal `json:"net_transfers"`   // cost basis transferred in less transferred out
 	TotalPnL        decimal.Decimal `json:"total_pnl"`
 	TotalPnLPercent decimal.Decimal `json:"total_pnl_percent"`
 	Holdings        []HoldingDetail `json:"holdings"`
+	NonLiveAssets   []string        `json:"non_live_assets"` // holdings valued without a live quote
+	Currency        string          `json:"currency"`        // reporting currency of the values above
 }
 
 type HoldingDetail struct {
@@ -82,40 +152,7 @@ type HoldingDetail struct {
 	PnL              decimal.Decimal `json:"pnl"`
 	PnLPercent       decimal.Decimal `json:"pnl_percent"`
 	PercentOfCapital decimal.Decimal `json:"percent_of_capital"`
-}
-
-// CMC API Response structures
-type CMCQuoteResponse struct {
-	Data map[string]CMCAsset `json:"data"`
-}
-
-type CMCAsset struct {
-	Symbol string   `json:"symbol"`
-	Quote  CMCQuote `json:"quote"`
-}
-
-type CMCQuote struct {
-	USD CMCPrice `json:"USD"`
-}
-
-type CMCPrice struct {
-	Price            float64 `json:"price"`
-	PercentChange1h  float64 `json:"percent_change_1h"`
-	PercentChange24h float64 `json:"percent_change_24h"`
-	PercentChange7d  float64 `json:"percent_change_7d"`
-	PercentChange30d float64 `json:"percent_change_30d"`
-}
-
-// CMC Listings response
-type CMCListingsResponse struct {
-	Data []CMCCoinData `json:"data"`
-}
-
-type CMCCoinData struct {
-	ID     int      `json:"id"`
-	Symbol string   `json:"symbol"`
-	Name   string   `json:"name"`
-	Quote  CMCQuote `json:"quote"`
+	PriceSource      string          `json:"price_source"`
 }
 
 // Watchlist item
@@ -159,6 +196,55 @@ func main() {
 	// Initialize database schema
 	initDB()
 
+	// Market data provider, shared behind a quote cache
+	upstream, err := newPriceProvider()
+	if err != nil {
+		log.Fatal("Failed to configure price provider:", err)
+	}
+	cacheTTL, err := priceCacheTTL()
+	if err != nil {
+		log.Fatal("Failed to configure price cache:", err)
+	}
+	priceProvider = newCachedProvider(upstream, cacheTTL)
+	log.Printf("Using %s price provider (cache TTL %s)", priceProvider.Name(), cacheTTL)
+
+	// Exchange rates for reporting in other currencies
+	fxSource, err = newFXRateSource()
+	if err != nil {
+		log.Fatal("Failed to configure FX rates:", err)
+	}
+	reportingCurrency, err = defaultReportingCurrency(fxSource)
+	if err != nil {
+		log.Fatal("Failed to configure reporting currency:", err)
+	}
+	log.Printf("Reporting in %s (%s FX rates)", reportingCurrency, fxSource.Name())
+
+	// Background price history ingestion
+	historyInterval, err := priceHistoryInterval()
+	if err != nil {
+		log.Fatal("Failed to configure price history:", err)
+	}
+	if historyInterval > 0 {
+		go runPriceIngester(historyInterval)
+		log.Printf("Recording price history every %s", historyInterval)
+	}
+
+	// Scheduled portfolio value snapshots
+	snapshotInterval, err := portfolioSnapshotInterval()
+	if err != nil {
+		log.Fatal("Failed to configure portfolio snapshots:", err)
+	}
+	if snapshotInterval > 0 {
+		go runPortfolioSnapshotter(snapshotInterval)
+		log.Printf("Snapshotting portfolio every %s", snapshotInterval)
+	}
+
+	// Sessions
+	sessionTTL, err = sessionTTLFromEnv()
+	if err != nil {
+		log.Fatal("Failed to configure sessions:", err)
+	}
+
 	// Setup Gin router
 	r := gin.Default()
 
@@ -175,43 +261,45 @@ func main() {
 	// API routes
 	api := r.Group("/api")
 	{
-		// Capital management
-		api.GET("/capitals", getCapitals)
-		api.POST("/capitals", addCapital)
-		api.DELETE("/capitals/:id", deleteCapital)
-		api.POST("/withdraw", withdrawCapital)
-		api.POST("/realized-loss", addRealizedLoss)
-
-		// Orders
-		api.GET("/orders", getOrders)
-		api.POST("/orders", createOrder)
-		api.DELETE("/orders/:id", deleteOrder)
-
-		// Holdings
-		api.GET("/holdings", getHoldings)
-
-		// Portfolio overview
-		api.GET("/portfolio", getPortfolioOverview)
+		// Accounts
+		api.POST("/auth/register", register)
+		api.POST("/auth/login", login)
+
+		// Everything else needs a session or an API token
+		authed := api.Group("", requireAuth)
+		read := authed.Group("", requireScope(ScopeReadPortfolio))
+		authed.POST("/auth/logout", logout)
+		authed.POST("/auth/claim", requireSession, claimPortfolios)
+		read.GET("/auth/me", getCurrentUser)
+
+		// API tokens, managed with a session only
+		tokens := authed.Group("/tokens", requireSession)
+		tokens.GET("", getAPITokens)
+		tokens.POST("", createAPIToken)
+		tokens.DELETE("/:id", revokeAPIToken)
+
+		// Portfolios
+		read.GET("/portfolios", getPortfolios)
+		authed.POST("/portfolios", requireScope(ScopeWritePortfolio), createPortfolio)
+		read.GET("/portfolios/overview", getAggregateOverview)
+
+		// Everything kept per portfolio, under /api/portfolios/:id and, for
+		// the default portfolio, directly under /api
+		portfolio := authed.Group("/portfolios/:"+portfolioKey, withPortfolio)
+		portfolio.GET("", requireScope(ScopeReadPortfolio), getPortfolio)
+		portfolio.PUT("", requireRole(RoleOwner), requireScope(ScopeWritePortfolio), updatePortfolio)
+		portfolio.DELETE("", requireRole(RoleOwner), requireScope(ScopeWritePortfolio), deletePortfolio)
+		registerPortfolioRoutes(portfolio)
+		registerPortfolioRoutes(authed.Group("", withDefaultPortfolio))
 
 		// Prices
-		api.GET("/prices", getPrices)
-		api.GET("/prices/:symbol", getPrice)
+		read.GET("/prices", getPrices)
+		read.GET("/prices/:symbol", getPrice)
+		read.GET("/prices/:symbol/history", getPriceHistory)
 
-		// Asset detail
-		api.GET("/assets/:symbol", getAssetDetail)
-
-		// Top coins from CMC
-		api.GET("/coins/top", getTopCoins)
-		api.GET("/coins/top20", getTop20Coins)
-
-		// Watchlist
-		api.GET("/watchlist", getWatchlist)
-		api.POST("/watchlist", addToWatchlist)
-		api.DELETE("/watchlist/:symbol", removeFromWatchlist)
-		api.GET("/watchlist/prices", getWatchlistPrices)
-
-		// Reset all data
-		api.POST("/reset", resetAllData)
+		// Top coins by market cap
+		read.GET("/coins/top", getTopCoins)
+		read.GET("/coins/top20", getTop20Coins)
 	}
 
 	port := os.Getenv("PORT")
@@ -223,8 +311,94 @@ func main() {
 	r.Run(":" + port)
 }
 
+// registerPortfolioRoutes adds the routes that work on one portfolio.
+func registerPortfolioRoutes(api *gin.RouterGroup) {
+	// Viewers read, traders also record, owners also manage; API tokens
+	// also need the scope of each route
+	read := api.Group("", requireScope(ScopeReadPortfolio))
+	trade := api.Group("", requireRole(RoleTrader))
+	own := api.Group("", requireRole(RoleOwner), requireScope(ScopeWritePortfolio))
+	writeCapitals := requireScope(ScopeWriteCapitals)
+	writeOrders := requireScope(ScopeWriteOrders)
+	writeTransfers := requireScope(ScopeWriteTransfers)
+	writeWatchlist := requireScope(ScopeWriteWatchlist)
+
+	// Capital management
+	read.GET("/capitals", getCapitals)
+	trade.POST("/capitals", writeCapitals, addCapital)
+	trade.PUT("/capitals/:id", writeCapitals, updateCapital)
+	trade.DELETE("/capitals/:id", writeCapitals, deleteCapital)
+	read.GET("/capitals/:id/history", getAuditHistory(AuditEntityCapital))
+	trade.POST("/withdraw", writeCapitals, withdrawCapital)
+	trade.POST("/realized-loss", writeCapitals, addRealizedLoss)
+
+	// Orders
+	read.GET("/orders", getOrders)
+	trade.POST("/orders", writeOrders, createOrder)
+	trade.PUT("/orders/:id", writeOrders, updateOrder)
+	trade.DELETE("/orders/:id", writeOrders, deleteOrder)
+	trade.POST("/import/trades", writeOrders, importTrades)
+	read.GET("/orders/:id/history", getAuditHistory(AuditEntityOrder))
+
+	// Transfers
+	read.GET("/transfers", getTransfers)
+	trade.POST("/transfers", writeTransfers, createTransfer)
+	trade.DELETE("/transfers/:id", writeTransfers, deleteTransfer)
+	read.GET("/transfers/:id/history", getAuditHistory(AuditEntityTransfer))
+
+	// Holdings
+	read.GET("/holdings", getHoldings)
+	read.GET("/holdings/verify", verifyHoldings)
+	own.POST("/holdings/rebuild", repairHoldings)
+	read.GET("/ledger/entries", getJournal)
+	read.GET("/ledger/balances", getTrialBalance)
+
+	// Portfolio overview
+	read.GET("/portfolio", getPortfolioOverview)
+	read.GET("/portfolio/history", getPortfolioHistory)
+	read.GET("/portfolio/performance", getPortfolioPerformance)
+
+	// Asset detail
+	read.GET("/assets/:symbol", getAssetDetail)
+	read.GET("/assets/:symbol/lots", getAssetLots)
+
+	// Watchlist
+	read.GET("/watchlist", getWatchlist)
+	trade.POST("/watchlist", writeWatchlist, addToWatchlist)
+	trade.DELETE("/watchlist/:symbol", writeWatchlist, removeFromWatchlist)
+	read.GET("/watchlist/prices", getWatchlistPrices)
+
+	// Reports
+	read.GET("/reports/capital-gains", getCapitalGainsReport)
+
+	// Members and their roles
+	read.GET("/members", getMembers)
+	own.POST("/members", assignMember)
+	own.DELETE("/members/:user_id", removeMember)
+
+	// Backups, and resets confirmed with a token from the preview after one
+	// is written
+	own.GET("/backups", getBackups)
+	own.GET("/backups/:id", getBackup)
+	own.GET("/backups/:id/history", getAuditHistory(AuditEntityBackup))
+	own.POST("/backups", createBackup)
+	own.POST("/backups/:id/restore", restoreBackup)
+	own.POST("/reset/preview", previewReset)
+	own.POST("/reset", resetAllData)
+}
+
 func initDB() {
 	schema := `
+	CREATE TABLE IF NOT EXISTS portfolios (
+		id SERIAL PRIMARY KEY,
+		name VARCHAR(100) NOT NULL UNIQUE,
+		description TEXT,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	-- Everything recorded before portfolios belongs to the default one
+	INSERT INTO portfolios (name) SELECT 'Main' WHERE NOT EXISTS (SELECT 1 FROM portfolios);
+
 	CREATE TABLE IF NOT EXISTS capitals (
 		id SERIAL PRIMARY KEY,
 		amount DECIMAL(20, 8) NOT NULL,
@@ -241,26 +415,325 @@ func initDB() {
 		price DECIMAL(20, 8) NOT NULL,
 		total_usdt DECIMAL(20, 8) NOT NULL,
 		is_custom_price BOOLEAN DEFAULT FALSE,
+		price_source VARCHAR(10),
 		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 	);
 
-	CREATE TABLE IF NOT EXISTS holdings (
-		asset VARCHAR(10) PRIMARY KEY,
-		amount DECIMAL(20, 8) NOT NULL DEFAULT 0,
-		average_price DECIMAL(20, 8) NOT NULL DEFAULT 0,
-		total_cost DECIMAL(20, 8) NOT NULL DEFAULT 0
-	);
-
 	CREATE TABLE IF NOT EXISTS watchlist (
 		symbol VARCHAR(20) PRIMARY KEY,
 		name VARCHAR(100),
 		added_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 	);
 
-	-- Initialize USDT holding if not exists
-	INSERT INTO holdings (asset, amount, average_price, total_cost)
-	VALUES ('USDT', 0, 1, 0)
-	ON CONFLICT (asset) DO NOTHING;
+	CREATE TABLE IF NOT EXISTS price_history (
+		id BIGSERIAL PRIMARY KEY,
+		symbol VARCHAR(20) NOT NULL,
+		price DECIMAL(20, 8) NOT NULL,
+		source VARCHAR(10) NOT NULL,
+		recorded_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_price_history_symbol_recorded_at ON price_history(symbol, recorded_at);
+
+	CREATE TABLE IF NOT EXISTS portfolio_snapshots (
+		id BIGSERIAL PRIMARY KEY,
+		total_value DECIMAL(20, 8) NOT NULL,
+		total_capital DECIMAL(20, 8) NOT NULL,
+		available_usdt DECIMAL(20, 8) NOT NULL,
+		total_invested DECIMAL(20, 8) NOT NULL,
+		current_value DECIMAL(20, 8) NOT NULL,
+		unrealized_pnl DECIMAL(20, 8) NOT NULL,
+		total_pnl DECIMAL(20, 8) NOT NULL,
+		total_pnl_percent DECIMAL(20, 8) NOT NULL,
+		holdings JSONB NOT NULL DEFAULT '[]',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_portfolio_snapshots_created_at ON portfolio_snapshots(created_at);
+
+	CREATE TABLE IF NOT EXISTS realized_pnl (
+		id SERIAL PRIMARY KEY,
+		order_id INTEGER NOT NULL UNIQUE REFERENCES orders(id) ON DELETE CASCADE,
+		asset VARCHAR(10) NOT NULL,
+		amount DECIMAL(20, 8) NOT NULL,
+		proceeds DECIMAL(20, 8) NOT NULL,
+		cost_basis DECIMAL(20, 8) NOT NULL,
+		pnl DECIMAL(20, 8) NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	ALTER TABLE orders ADD COLUMN IF NOT EXISTS price_source VARCHAR(10);
+	ALTER TABLE orders ADD COLUMN IF NOT EXISTS lot_method VARCHAR(10);
+	ALTER TABLE orders ADD COLUMN IF NOT EXISTS lot_selections JSONB;
+	ALTER TABLE orders ADD COLUMN IF NOT EXISTS voided_at TIMESTAMP;
+	ALTER TABLE capitals ADD COLUMN IF NOT EXISTS voided_at TIMESTAMP;
+	ALTER TABLE orders ADD COLUMN IF NOT EXISTS fee DECIMAL(20, 8) NOT NULL DEFAULT 0;
+	ALTER TABLE orders ADD COLUMN IF NOT EXISTS fee_asset VARCHAR(10);
+	ALTER TABLE orders ADD COLUMN IF NOT EXISTS fee_usdt DECIMAL(20, 8) NOT NULL DEFAULT 0;
+	ALTER TABLE orders ADD COLUMN IF NOT EXISTS quote_asset VARCHAR(10) NOT NULL DEFAULT 'USDT';
+	ALTER TABLE orders ADD COLUMN IF NOT EXISTS quote_price DECIMAL(30, 18);
+	ALTER TABLE orders ADD COLUMN IF NOT EXISTS quote_total DECIMAL(20, 8);
+	ALTER TABLE orders ADD COLUMN IF NOT EXISTS quote_rate DECIMAL(20, 8) NOT NULL DEFAULT 1;
+	UPDATE orders SET quote_price = price, quote_total = total_usdt WHERE quote_total IS NULL;
+
+	ALTER TABLE capitals ADD COLUMN IF NOT EXISTS portfolio_id INTEGER NOT NULL DEFAULT 1 REFERENCES portfolios(id);
+	ALTER TABLE orders ADD COLUMN IF NOT EXISTS portfolio_id INTEGER NOT NULL DEFAULT 1 REFERENCES portfolios(id);
+	ALTER TABLE portfolio_snapshots ADD COLUMN IF NOT EXISTS portfolio_id INTEGER NOT NULL DEFAULT 1 REFERENCES portfolios(id) ON DELETE CASCADE;
+	CREATE INDEX IF NOT EXISTS idx_capitals_portfolio_id ON capitals(portfolio_id);
+	CREATE INDEX IF NOT EXISTS idx_orders_portfolio_id ON orders(portfolio_id);
+	CREATE INDEX IF NOT EXISTS idx_portfolio_snapshots_portfolio_id ON portfolio_snapshots(portfolio_id, created_at);
+
+	-- Orders imported from exchange exports keep the fill they came from
+	ALTER TABLE orders ADD COLUMN IF NOT EXISTS exchange VARCHAR(20);
+	ALTER TABLE orders ADD COLUMN IF NOT EXISTS exchange_trade_id VARCHAR(100);
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_orders_exchange_trade ON orders(portfolio_id, exchange, exchange_trade_id) WHERE exchange_trade_id IS NOT NULL;
+
+	-- The watchlist is kept per portfolio
+	DO $$
+	BEGIN
+		IF NOT EXISTS (SELECT 1 FROM information_schema.columns
+			WHERE table_schema = current_schema() AND table_name = 'watchlist' AND column_name = 'portfolio_id') THEN
+			ALTER TABLE watchlist ADD COLUMN portfolio_id INTEGER NOT NULL DEFAULT 1 REFERENCES portfolios(id) ON DELETE CASCADE;
+			ALTER TABLE watchlist DROP CONSTRAINT watchlist_pkey;
+			ALTER TABLE watchlist ADD PRIMARY KEY (portfolio_id, symbol);
+		END IF;
+	END $$;
+
+	CREATE TABLE IF NOT EXISTS journal_entries (
+		id SERIAL PRIMARY KEY,
+		kind VARCHAR(20) NOT NULL,
+		capital_id INTEGER REFERENCES capitals(id) ON DELETE CASCADE,
+		order_id INTEGER REFERENCES orders(id) ON DELETE CASCADE,
+		description TEXT,
+		occurred_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS postings (
+		id BIGSERIAL PRIMARY KEY,
+		entry_id INTEGER NOT NULL REFERENCES journal_entries(id) ON DELETE CASCADE,
+		account VARCHAR(40) NOT NULL,
+		asset VARCHAR(10),
+		quantity DECIMAL(20, 8) NOT NULL DEFAULT 0,
+		value DECIMAL(20, 8) NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_postings_entry_id ON postings(entry_id);
+	CREATE INDEX IF NOT EXISTS idx_postings_account ON postings(account);
+	CREATE INDEX IF NOT EXISTS idx_journal_entries_order_id ON journal_entries(order_id);
+	CREATE INDEX IF NOT EXISTS idx_journal_entries_capital_id ON journal_entries(capital_id);
+
+	ALTER TABLE journal_entries ADD COLUMN IF NOT EXISTS portfolio_id INTEGER NOT NULL DEFAULT 1 REFERENCES portfolios(id);
+	CREATE INDEX IF NOT EXISTS idx_journal_entries_portfolio_id ON journal_entries(portfolio_id);
+
+	-- Holdings used to be a table updated in place; carry its balances over
+	-- as an opening entry before replacing it with a view
+	DO $$
+	DECLARE
+		opening_id INTEGER;
+	BEGIN
+		IF EXISTS (SELECT 1 FROM information_schema.tables
+			WHERE table_schema = current_schema() AND table_name = 'holdings' AND table_type = 'BASE TABLE') THEN
+			IF EXISTS (SELECT 1 FROM holdings WHERE amount <> 0 OR total_cost <> 0) THEN
+				INSERT INTO journal_entries (kind, description)
+				VALUES ('adjustment', 'Opening balances carried over from the holdings table')
+				RETURNING id INTO opening_id;
+
+				INSERT INTO postings (entry_id, account, asset, quantity, value)
+				SELECT opening_id, CASE WHEN asset = 'USDT' THEN 'cash:' ELSE 'asset:' END || asset, asset, amount, total_cost
+				FROM holdings
+				WHERE amount <> 0 OR total_cost <> 0;
+
+				INSERT INTO postings (entry_id, account, quantity, value)
+				SELECT opening_id, 'equity:adjustments', 0, -SUM(total_cost) FROM holdings;
+			END IF;
+			DROP TABLE holdings;
+		END IF;
+	END $$;
+
+	-- Holdings are the balances of the cash and asset accounts of each portfolio
+	CREATE OR REPLACE VIEW holdings AS
+	SELECT asset,
+		SUM(quantity) AS amount,
+		CASE
+			WHEN asset = 'USDT' THEN 1
+			WHEN SUM(quantity) > 0 THEN ROUND(SUM(value) / SUM(quantity), 8)
+			ELSE 0
+		END AS average_price,
+		SUM(value) AS total_cost,
+		portfolio_id
+	FROM (
+		SELECT e.portfolio_id, p.asset, p.quantity, p.value
+		FROM postings p
+		JOIN journal_entries e ON e.id = p.entry_id
+		WHERE p.account LIKE 'cash:%' OR p.account LIKE 'asset:%'
+		UNION ALL
+		SELECT id, 'USDT', 0, 0 FROM portfolios
+	) balances
+	GROUP BY portfolio_id, asset;
+
+	CREATE TABLE IF NOT EXISTS tax_lots (
+		id SERIAL PRIMARY KEY,
+		order_id INTEGER REFERENCES orders(id) ON DELETE CASCADE,
+		asset VARCHAR(10) NOT NULL,
+		amount DECIMAL(20, 8) NOT NULL,
+		remaining DECIMAL(20, 8) NOT NULL,
+		cost_basis DECIMAL(20, 8) NOT NULL,
+		acquired_at TIMESTAMP NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS lot_disposals (
+		id SERIAL PRIMARY KEY,
+		lot_id INTEGER NOT NULL REFERENCES tax_lots(id) ON DELETE CASCADE,
+		order_id INTEGER NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+		amount DECIMAL(20, 8) NOT NULL,
+		cost_basis DECIMAL(20, 8) NOT NULL,
+		proceeds DECIMAL(20, 8) NOT NULL,
+		disposed_at TIMESTAMP NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_tax_lots_asset ON tax_lots(asset);
+	CREATE INDEX IF NOT EXISTS idx_lot_disposals_order_id ON lot_disposals(order_id);
+
+	ALTER TABLE tax_lots ADD COLUMN IF NOT EXISTS portfolio_id INTEGER NOT NULL DEFAULT 1 REFERENCES portfolios(id);
+
+	-- Open one lot per existing holding that predates lot tracking
+	INSERT INTO tax_lots (order_id, portfolio_id, asset, amount, remaining, cost_basis, acquired_at)
+	SELECT NULL, h.portfolio_id, h.asset, h.amount, h.amount, h.total_cost,
+		COALESCE((SELECT MIN(o.created_at) FROM orders o WHERE o.asset = h.asset AND o.portfolio_id = h.portfolio_id), CURRENT_TIMESTAMP)
+	FROM holdings h
+	WHERE h.asset != 'USDT' AND h.amount > 0
+		AND NOT EXISTS (SELECT 1 FROM tax_lots l WHERE l.asset = h.asset AND l.portfolio_id = h.portfolio_id);
+
+	CREATE TABLE IF NOT EXISTS audit_history (
+		id SERIAL PRIMARY KEY,
+		entity VARCHAR(20) NOT NULL,
+		entity_id INTEGER NOT NULL,
+		action VARCHAR(20) NOT NULL,
+		changes JSONB NOT NULL,
+		reason TEXT,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_audit_history_entity ON audit_history(entity, entity_id);
+
+	-- Transfers move an asset at cost between portfolios or wallets
+	CREATE TABLE IF NOT EXISTS transfers (
+		id SERIAL PRIMARY KEY,
+		from_portfolio_id INTEGER NOT NULL REFERENCES portfolios(id),
+		to_portfolio_id INTEGER NOT NULL REFERENCES portfolios(id),
+		from_wallet VARCHAR(100),
+		to_wallet VARCHAR(100),
+		asset VARCHAR(10) NOT NULL,
+		amount DECIMAL(20, 8) NOT NULL,
+		fee DECIMAL(20, 8) NOT NULL DEFAULT 0,
+		lot_method VARCHAR(10) NOT NULL,
+		cost_basis DECIMAL(20, 8) NOT NULL DEFAULT 0,
+		fee_cost DECIMAL(20, 8) NOT NULL DEFAULT 0,
+		market_value DECIMAL(20, 8) NOT NULL,
+		description TEXT,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_transfers_from_portfolio_id ON transfers(from_portfolio_id);
+	CREATE INDEX IF NOT EXISTS idx_transfers_to_portfolio_id ON transfers(to_portfolio_id);
+
+	ALTER TABLE journal_entries ADD COLUMN IF NOT EXISTS transfer_id INTEGER REFERENCES transfers(id) ON DELETE CASCADE;
+	ALTER TABLE tax_lots ADD COLUMN IF NOT EXISTS transfer_id INTEGER REFERENCES transfers(id) ON DELETE CASCADE;
+	CREATE INDEX IF NOT EXISTS idx_journal_entries_transfer_id ON journal_entries(transfer_id);
+
+	-- Users sign in with sessions and own portfolios; the first to register
+	-- takes over the portfolios recorded before accounts existed
+	CREATE TABLE IF NOT EXISTS users (
+		id SERIAL PRIMARY KEY,
+		email VARCHAR(255) NOT NULL UNIQUE,
+		name VARCHAR(100),
+		password_hash VARCHAR(100) NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS sessions (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		token_hash VARCHAR(64) NOT NULL UNIQUE,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		expires_at TIMESTAMP NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions(user_id);
+
+	ALTER TABLE portfolios ADD COLUMN IF NOT EXISTS user_id INTEGER REFERENCES users(id);
+	ALTER TABLE portfolios DROP CONSTRAINT IF EXISTS portfolios_name_key;
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_portfolios_user_id_name ON portfolios(user_id, name);
+
+	-- Roles of users on portfolios; creators are owners of their own
+	CREATE TABLE IF NOT EXISTS portfolio_members (
+		portfolio_id INTEGER NOT NULL REFERENCES portfolios(id) ON DELETE CASCADE,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		role VARCHAR(10) NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (portfolio_id, user_id)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_portfolio_members_user_id ON portfolio_members(user_id);
+
+	-- Long-lived, scoped tokens for scripts, stored hashed
+	CREATE TABLE IF NOT EXISTS api_tokens (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		name VARCHAR(100) NOT NULL,
+		token_hash VARCHAR(64) NOT NULL UNIQUE,
+		prefix VARCHAR(20) NOT NULL,
+		scopes TEXT[] NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		last_used_at TIMESTAMP,
+		expires_at TIMESTAMP,
+		revoked_at TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_api_tokens_user_id ON api_tokens(user_id);
+
+	-- Full exports of a portfolio, written before every reset
+	CREATE TABLE IF NOT EXISTS backups (
+		id SERIAL PRIMARY KEY,
+		portfolio_id INTEGER NOT NULL REFERENCES portfolios(id) ON DELETE CASCADE,
+		user_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+		reason VARCHAR(20) NOT NULL,
+		data JSONB NOT NULL,
+		capitals INTEGER NOT NULL DEFAULT 0,
+		orders INTEGER NOT NULL DEFAULT 0,
+		transfers INTEGER NOT NULL DEFAULT 0,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		restored_at TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_backups_portfolio_id ON backups(portfolio_id, created_at);
+
+	-- Tokens from reset previews, each confirming one reset
+	CREATE TABLE IF NOT EXISTS reset_confirmations (
+		token_hash VARCHAR(64) PRIMARY KEY,
+		portfolio_id INTEGER NOT NULL REFERENCES portfolios(id) ON DELETE CASCADE,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		options JSONB NOT NULL,
+		expires_at TIMESTAMP NOT NULL
+	);
+
+	-- Resets void rows rather than deleting them, marked with the backup
+	-- written before the reset so that restoring it puts them back
+	ALTER TABLE transfers ADD COLUMN IF NOT EXISTS voided_at TIMESTAMP;
+	ALTER TABLE capitals ADD COLUMN IF NOT EXISTS reset_backup_id INTEGER REFERENCES backups(id) ON DELETE SET NULL;
+	ALTER TABLE orders ADD COLUMN IF NOT EXISTS reset_backup_id INTEGER REFERENCES backups(id) ON DELETE SET NULL;
+	ALTER TABLE transfers ADD COLUMN IF NOT EXISTS reset_backup_id INTEGER REFERENCES backups(id) ON DELETE SET NULL;
+
+	-- Holdings a snapshot valued without a live quote
+	ALTER TABLE portfolio_snapshots ADD COLUMN IF NOT EXISTS non_live_assets JSONB NOT NULL DEFAULT '[]';
+
+	-- Who made each recorded change
+	ALTER TABLE audit_history ADD COLUMN IF NOT EXISTS user_id INTEGER REFERENCES users(id) ON DELETE SET NULL;
+
+	INSERT INTO portfolio_members (portfolio_id, user_id, role)
+	SELECT id, user_id, 'owner' FROM portfolios WHERE user_id IS NOT NULL
+	ON CONFLICT DO NOTHING;
 	`
 
 	_, err := db.Exec(schema)
@@ -272,7 +745,13 @@ func initDB() {
 
 // Capital handlers
 func getCapitals(c *gin.Context) {
-	rows, err := db.Query("SELECT id, amount, type, COALESCE(description, ''), created_at FROM capitals ORDER BY created_at DESC")
+	// Voided entries are kept for audit and only listed on request
+	voided := " AND voided_at IS NULL"
+	if c.Query("include_voided") == "true" {
+		voided = ""
+	}
+
+	rows, err := db.Query("SELECT id, amount, type, COALESCE(description, ''), created_at, voided_at FROM capitals WHERE portfolio_id = $1"+voided+" ORDER BY created_at DESC", portfolioID(c))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -283,11 +762,13 @@ func getCapitals(c *gin.Context) {
 	for rows.Next() {
 		var cap Capital
 		var amount string
-		if err := rows.Scan(&cap.ID, &amount, &cap.Type, &cap.Description, &cap.CreatedAt); err != nil {
+		var voidedAt sql.NullTime
+		if err := rows.Scan(&cap.ID, &amount, &cap.Type, &cap.Description, &cap.CreatedAt, &voidedAt); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
 		cap.Amount, _ = decimal.NewFromString(amount)
+		cap.VoidedAt = nullTimePtr(voidedAt)
 		capitals = append(capitals, cap)
 	}
 
@@ -303,6 +784,8 @@ func addCapital(c *gin.Context) {
 		Amount      string `json:"amount" binding:"required"`
 		Type        string `json:"type" binding:"required"`
 		Description string `json:"description"`
+		// ExecutedAt backdates the entry (RFC 3339 or YYYY-MM-DD)
+		ExecutedAt string `json:"executed_at"`
 	}
 
 	if err := c.ShouldBindJSON(&input); err != nil {
@@ -316,6 +799,12 @@ func addCapital(c *gin.Context) {
 		return
 	}
 
+	executedAt, err := parseExecutedAt(input.ExecutedAt)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	// Start transaction
 	tx, err := db.Begin()
 	if err != nil {
@@ -324,26 +813,36 @@ func addCapital(c *gin.Context) {
 	}
 	defer tx.Rollback()
 
+	if err = lockLedger(tx); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	isBackdated, err := backdated(tx, portfolioID(c), executedAt)
+	if err != nil {
+		respondRebuildError(c, err, nil)
+		return
+	}
+
 	// Insert capital record
 	var capitalID int
+	var createdAt time.Time
 	err = tx.QueryRow(
-		"INSERT INTO capitals (amount, type, description) VALUES ($1, $2, $3) RETURNING id",
-		amount.String(), input.Type, input.Description,
-	).Scan(&capitalID)
+		"INSERT INTO capitals (portfolio_id, amount, type, description, created_at) VALUES ($1, $2, $3, $4, COALESCE($5, CURRENT_TIMESTAMP)) RETURNING id, created_at",
+		portfolioID(c), amount.String(), input.Type, input.Description, executedAt,
+	).Scan(&capitalID, &createdAt)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	// Update USDT holding
-	_, err = tx.Exec(`
-		INSERT INTO holdings (asset, amount, average_price, total_cost)
-		VALUES ('USDT', $1, 1, $1)
-		ON CONFLICT (asset) DO UPDATE SET
-			amount = holdings.amount + $1,
-			total_cost = holdings.total_cost + $1
-	`, amount.String())
-	if err != nil {
+	if isBackdated {
+		// Replay history so later entries see the deposit
+		if state, err := rebuildHoldings(tx, portfolioID(c)); err != nil {
+			respondRebuildError(c, err, state)
+			return
+		}
+	} else if _, err = postEntry(tx, capitalEntry(portfolioID(c), capitalID, amount, createdAt)); err != nil {
+		// Post the deposit to the USDT cash account
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -356,18 +855,13 @@ func addCapital(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"id": capitalID, "message": "Capital added successfully"})
 }
 
+// deleteCapital voids a capital entry: a reversal is posted, or history is
+// replayed without it when later entries exist, and the row is kept for
+// audit. It is refused if what it deposited has been spent since.
 func deleteCapital(c *gin.Context) {
-	id := c.Param("id")
-
-	// Get the capital amount first
-	var amount string
-	err := db.QueryRow("SELECT amount FROM capitals WHERE id = $1", id).Scan(&amount)
+	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
-		if err == sql.ErrNoRows {
-			c.JSON(http.StatusNotFound, gin.H{"error": "Capital not found"})
-			return
-		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid capital id"})
 		return
 	}
 
@@ -379,37 +873,87 @@ func deleteCapital(c *gin.Context) {
 	}
 	defer tx.Rollback()
 
-	// Delete capital record
-	_, err = tx.Exec("DELETE FROM capitals WHERE id = $1", id)
+	if err = lockLedger(tx); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	var amountStr, capitalType string
+	var createdAt time.Time
+	var voidedAt sql.NullTime
+	err = tx.QueryRow(
+		"SELECT amount, type, created_at, voided_at FROM capitals WHERE id = $1 AND portfolio_id = $2 FOR UPDATE", id, portfolioID(c),
+	).Scan(&amountStr, &capitalType, &createdAt, &voidedAt)
 	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Capital not found"})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	if voidedAt.Valid {
+		c.JSON(http.StatusConflict, gin.H{"error": "Capital entry is already voided"})
+		return
+	}
+	amount, _ := decimal.NewFromString(amountStr)
 
-	// Update USDT holding
-	_, err = tx.Exec(`
-		UPDATE holdings SET
-			amount = amount - $1,
-			total_cost = total_cost - $1
-		WHERE asset = 'USDT'
-	`, amount)
+	// Later entries may have relied on it, so they are replayed without it
+	isBackdated, err := backdated(tx, portfolioID(c), sql.NullTime{Time: createdAt, Valid: true})
 	if err != nil {
+		respondRebuildError(c, err, nil)
+		return
+	}
+
+	if _, err = tx.Exec("UPDATE capitals SET voided_at = CURRENT_TIMESTAMP WHERE id = $1", id); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	if err = recordAudit(tx, currentUser(c), AuditEntityCapital, id, "void", auditChanges{}, ""); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if isBackdated {
+		if state, err := rebuildHoldings(tx, portfolioID(c)); err != nil {
+			respondRebuildError(c, err, state)
+			return
+		}
+	} else if capitalType != "realized_loss" {
+		// A deposit has to still be there to take back
+		var balanceStr string
+		err = tx.QueryRow("SELECT amount FROM holdings WHERE asset = 'USDT' AND portfolio_id = $1", portfolioID(c)).Scan(&balanceStr)
+		if err != nil && err != sql.ErrNoRows {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if balance, _ := decimal.NewFromString(balanceStr); balance.LessThan(amount) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Voiding would leave a negative USDT balance"})
+			return
+		}
+
+		// Post the mirror image of the movement so the books show both
+		reversal := capitalEntry(portfolioID(c), id, amount, createdAt).reversal(fmt.Sprintf("Void capital %d", id), time.Now())
+		if _, err = postEntry(tx, reversal); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
 
 	if err = tx.Commit(); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Capital deleted successfully"})
+	c.JSON(http.StatusOK, gin.H{"message": "Capital voided successfully"})
 }
 
 func withdrawCapital(c *gin.Context) {
 	var input struct {
 		Amount      string `json:"amount" binding:"required"`
 		Description string `json:"description"`
+		// ExecutedAt backdates the withdrawal (RFC 3339 or YYYY-MM-DD)
+		ExecutedAt string `json:"executed_at"`
 	}
 
 	if err := c.ShouldBindJSON(&input); err != nil {
@@ -428,6 +972,12 @@ func withdrawCapital(c *gin.Context) {
 		return
 	}
 
+	executedAt, err := parseExecutedAt(input.ExecutedAt)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	// Start transaction
 	tx, err := db.Begin()
 	if err != nil {
@@ -436,38 +986,53 @@ func withdrawCapital(c *gin.Context) {
 	}
 	defer tx.Rollback()
 
-	// Check USDT balance
-	var usdtBalance string
-	err = tx.QueryRow("SELECT amount FROM holdings WHERE asset = 'USDT'").Scan(&usdtBalance)
-	if err != nil {
+	if err = lockLedger(tx); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	balance, _ := decimal.NewFromString(usdtBalance)
-	if balance.LessThan(amount) {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Insufficient USDT balance"})
+
+	// A backdated withdrawal is checked against the balance of its time by the replay
+	isBackdated, err := backdated(tx, portfolioID(c), executedAt)
+	if err != nil {
+		respondRebuildError(c, err, nil)
 		return
 	}
 
+	if !isBackdated {
+		// Check USDT balance
+		var usdtBalance string
+		err = tx.QueryRow("SELECT amount FROM holdings WHERE asset = 'USDT' AND portfolio_id = $1", portfolioID(c)).Scan(&usdtBalance)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		balance, _ := decimal.NewFromString(usdtBalance)
+		if balance.LessThan(amount) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Insufficient USDT balance"})
+			return
+		}
+	}
+
 	// Insert withdrawal record (negative amount to indicate withdrawal)
 	var capitalID int
+	var createdAt time.Time
 	err = tx.QueryRow(
-		"INSERT INTO capitals (amount, type, description) VALUES ($1, $2, $3) RETURNING id",
-		amount.Neg().String(), "withdraw", input.Description,
-	).Scan(&capitalID)
+		"INSERT INTO capitals (portfolio_id, amount, type, description, created_at) VALUES ($1, $2, $3, $4, COALESCE($5, CURRENT_TIMESTAMP)) RETURNING id, created_at",
+		portfolioID(c), amount.Neg().String(), "withdraw", input.Description, executedAt,
+	).Scan(&capitalID, &createdAt)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	// Update USDT holding
-	_, err = tx.Exec(`
-		UPDATE holdings SET
-			amount = amount - $1,
-			total_cost = total_cost - $1
-		WHERE asset = 'USDT'
-	`, amount.String())
-	if err != nil {
+	if isBackdated {
+		// Replay history; fails if the withdrawal overdraws USDT at any later point
+		if state, err := rebuildHoldings(tx, portfolioID(c)); err != nil {
+			respondRebuildError(c, err, state)
+			return
+		}
+	} else if _, err = postEntry(tx, capitalEntry(portfolioID(c), capitalID, amount.Neg(), createdAt)); err != nil {
+		// Post the withdrawal from the USDT cash account
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -505,8 +1070,8 @@ func addRealizedLoss(c *gin.Context) {
 	// Insert realized loss record (stored as negative to represent loss)
 	var capitalID int
 	err = db.QueryRow(
-		"INSERT INTO capitals (amount, type, description) VALUES ($1, $2, $3) RETURNING id",
-		amount.Neg().String(), "realized_loss", input.Description,
+		"INSERT INTO capitals (portfolio_id, amount, type, description) VALUES ($1, $2, $3, $4) RETURNING id",
+		portfolioID(c), amount.Neg().String(), "realized_loss", input.Description,
 	).Scan(&capitalID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -520,22 +1085,29 @@ func addRealizedLoss(c *gin.Context) {
 func getOrders(c *gin.Context) {
 	asset := c.Query("asset")
 
+	// Voided orders are kept for audit and only listed on request
+	voided := " AND voided_at IS NULL"
+	if c.Query("include_voided") == "true" {
+		voided = ""
+	}
+
 	var rows *sql.Rows
 	var err error
 
 	if asset != "" {
 		rows, err = db.Query(`
-			SELECT id, asset, type, amount, price, total_usdt, is_custom_price, created_at 
+			SELECT `+orderColumns+`
 			FROM orders 
-			WHERE asset = $1
+			WHERE portfolio_id = $1 AND asset = $2`+voided+`
 			ORDER BY created_at DESC
-		`, asset)
+		`, portfolioID(c), asset)
 	} else {
 		rows, err = db.Query(`
-			SELECT id, asset, type, amount, price, total_usdt, is_custom_price, created_at 
+			SELECT `+orderColumns+`
 			FROM orders 
+			WHERE portfolio_id = $1`+voided+`
 			ORDER BY created_at DESC
-		`)
+		`, portfolioID(c))
 	}
 
 	if err != nil {
@@ -546,15 +1118,11 @@ func getOrders(c *gin.Context) {
 
 	var orders []Order
 	for rows.Next() {
-		var order Order
-		var amount, price, totalUSDT string
-		if err := rows.Scan(&order.ID, &order.Asset, &order.Type, &amount, &price, &totalUSDT, &order.IsCustomPrice, &order.CreatedAt); err != nil {
+		order, err := scanOrder(rows)
+		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
-		order.Amount, _ = decimal.NewFromString(amount)
-		order.Price, _ = decimal.NewFromString(price)
-		order.TotalUSDT, _ = decimal.NewFromString(totalUSDT)
 		orders = append(orders, order)
 	}
 
@@ -573,6 +1141,24 @@ func createOrder(c *gin.Context) {
 		TotalUSDT     string `json:"total_usdt"`
 		Price         string `json:"price"`
 		IsCustomPrice bool   `json:"is_custom_price"`
+		// AllowNonLivePrice accepts a cached or mock quote when no live one is available
+		AllowNonLivePrice bool `json:"allow_non_live_price"`
+		// QuoteAsset is what the order is priced and settled in (USDT by default);
+		// Price and QuoteTotal are in it, and QuoteRate is its value in USDT,
+		// fetched when not given
+		QuoteAsset string `json:"quote_asset"`
+		QuoteTotal string `json:"quote_total"`
+		QuoteRate  string `json:"quote_rate"`
+		// LotMethod overrides LOT_METHOD for what the order disposes of; Lots picks specific lots
+		LotMethod string         `json:"lot_method"`
+		Lots      []LotSelection `json:"lots"`
+		// Fee is an absolute amount, FeeRate a fraction of the traded value;
+		// FeeAsset says what it was paid in (the quote asset by default, or the asset)
+		Fee      string `json:"fee"`
+		FeeRate  string `json:"fee_rate"`
+		FeeAsset string `json:"fee_asset"`
+		// ExecutedAt backdates the order (RFC 3339 or YYYY-MM-DD)
+		ExecutedAt string `json:"executed_at"`
 	}
 
 	if err := c.ShouldBindJSON(&input); err != nil {
@@ -580,37 +1166,117 @@ func createOrder(c *gin.Context) {
 		return
 	}
 
-	// Get price (either custom or from API)
-	var price decimal.Decimal
-	var err error
-	if input.Price != "" {
-		price, err = decimal.NewFromString(input.Price)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid price"})
+	if input.Type != "buy" && input.Type != "sell" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "type must be buy or sell"})
+		return
+	}
+
+	quote, err := parseQuoteAsset(input.QuoteAsset, input.Asset)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	executedAt, err := parseExecutedAt(input.ExecutedAt)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// Today's quotes say nothing about a past fill
+	if executedAt.Valid && input.Price == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "price is required with executed_at"})
+		return
+	}
+	if executedAt.Valid && input.QuoteRate == "" && quote != "USDT" && quote != "USD" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "quote_rate is required with executed_at"})
+		return
+	}
+
+	// Orders dispose of lots of what they sell or pay with, unless that is USDT
+	var lotMethod string
+	if input.Type == "sell" || quote != "USDT" {
+		if lotMethod, err = resolveLotMethod(input.LotMethod, input.Lots); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
-	} else {
-		// Fetch price from CMC API
-		priceData, err := fetchPrice(input.Asset)
+	}
+
+	// marketPrice fetches a quote, refusing to execute at a fake or stale
+	// price unless the caller asked for it
+	marketPrice := func(symbol string) (PriceData, bool) {
+		priceData, err := fetchPrice(symbol)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch price: " + err.Error()})
+			return priceData, false
+		}
+		if priceData.Source != PriceSourceLive && !input.AllowNonLivePrice && !nonLivePricesAllowed() {
+			c.JSON(http.StatusConflict, gin.H{
+				"error": fmt.Sprintf("No live price for %s (only a %s price from %s); enter a custom price or set allow_non_live_price",
+					symbol, priceData.Source, priceData.AsOf.Format(time.RFC3339)),
+			})
+			return priceData, false
+		}
+		return priceData, true
+	}
+
+	// Get the USDT value of the quote asset
+	rate := decimal.NewFromInt(1)
+	rateSource := PriceSourceLive
+	if input.QuoteRate != "" {
+		if rate, err = decimal.NewFromString(input.QuoteRate); err != nil || !rate.IsPositive() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid quote_rate"})
 			return
 		}
-		price = priceData.Price
+		rateSource = PriceSourceManual
+	} else if quote != "USDT" {
+		rateData, ok := marketPrice(quote)
+		if !ok {
+			return
+		}
+		rate, rateSource = rateData.Price, rateData.Source
 	}
 
-	// Calculate amount and total
-	var amount, totalUSDT decimal.Decimal
-	if input.Amount != "" {
-		amount, _ = decimal.NewFromString(input.Amount)
-		totalUSDT = amount.Mul(price)
-	} else if input.TotalUSDT != "" {
-		totalUSDT, _ = decimal.NewFromString(input.TotalUSDT)
-		amount = totalUSDT.Div(price)
+	// Get price in the quote asset (either custom or from the price provider)
+	var quotePrice decimal.Decimal
+	priceSource := PriceSourceManual
+	if input.Price != "" {
+		quotePrice, err = decimal.NewFromString(input.Price)
+		if err != nil || !quotePrice.IsPositive() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid price"})
+			return
+		}
 	} else {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Either amount or total_usdt is required"})
+		priceData, ok := marketPrice(input.Asset)
+		if !ok {
+			return
+		}
+		quotePrice = priceData.Price.Div(rate)
+		priceSource = priceData.Source
+		if priceSource == PriceSourceLive {
+			priceSource = rateSource
+		}
+	}
+
+	// Calculate amount and total in the quote asset
+	totalStr := input.QuoteTotal
+	if totalStr == "" && quote == "USDT" {
+		totalStr = input.TotalUSDT
+	}
+	amount, quoteTotal, err := parseOrderSize(input.Amount, totalStr, quotePrice)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	fee, err := parseTradeFee(input.Fee, input.FeeRate, input.FeeAsset, input.Type, input.Asset, quote, amount, quoteTotal)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	t := trade{portfolioID: portfolioID(c), orderType: input.Type, asset: input.Asset, quote: quote, amount: amount, quoteTotal: quoteTotal, rate: rate, fee: fee}
+	// What the order pays or sells, fees included
+	outAsset, outQty := t.disposed()
+	price := quotePrice.Mul(rate)
 
 	// Start transaction
 	tx, err := db.Begin()
@@ -620,144 +1286,292 @@ func createOrder(c *gin.Context) {
 	}
 	defer tx.Rollback()
 
-	if input.Type == "buy" {
-		// Check USDT balance
-		var usdtBalance string
-		err = tx.QueryRow("SELECT amount FROM holdings WHERE asset = 'USDT'").Scan(&usdtBalance)
+	if err = lockLedger(tx); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// An order placed before later entries is checked by replaying history
+	isBackdated, err := backdated(tx, portfolioID(c), executedAt)
+	if err != nil {
+		respondRebuildError(c, err, nil)
+		return
+	}
+
+	// Cost basis of what the order disposes of, and the lots it came from
+	var cost decimal.Decimal
+	var disposals []lotDisposal
+
+	if !isBackdated {
+		// Check the balance of what the order pays or sells
+		var balanceStr, totalCostStr string
+		err = tx.QueryRow("SELECT amount, total_cost FROM holdings WHERE asset = $1 AND portfolio_id = $2", outAsset, t.portfolioID).Scan(&balanceStr, &totalCostStr)
 		if err != nil {
+			if err == sql.ErrNoRows {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "No holdings for this asset"})
+				return
+			}
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
-		balance, _ := decimal.NewFromString(usdtBalance)
-		if balance.LessThan(totalUSDT) {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Insufficient USDT balance"})
+		balance, _ := decimal.NewFromString(balanceStr)
+		if balance.LessThan(outQty) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Insufficient %s balance", outAsset)})
 			return
 		}
 
-		// Deduct USDT
-		_, err = tx.Exec(`
-			UPDATE holdings SET
-				amount = amount - $1,
-				total_cost = total_cost - $1
-			WHERE asset = 'USDT'
-		`, totalUSDT.String())
-		if err != nil {
+		cost = outQty
+		if outAsset != "USDT" {
+			// Match the disposed amount against tax lots to find its cost
+			currentTotalCost, _ := decimal.NewFromString(totalCostStr)
+			disposals, cost, err = allocateLots(tx, t.portfolioID, outAsset, outQty, lotMethod, input.Lots, balance, currentTotalCost)
+			if err != nil {
+				if errors.Is(err, errLotSelection) {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			cost = cost.Round(8)
+		}
+	}
+
+	// Remember which lots were chosen so the choice can be replayed
+	var lotSelections sql.NullString
+	if lotMethod == LotMethodSpecific {
+		if err = lotOrderIDs(tx, t.portfolioID, input.Lots); err != nil {
+			if errors.Is(err, errLotSelection) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
+		selections, _ := json.Marshal(input.Lots)
+		lotSelections = sql.NullString{String: string(selections), Valid: true}
+	}
 
-		// Update or insert holding for the asset
-		_, err = tx.Exec(`
-			INSERT INTO holdings (asset, amount, average_price, total_cost)
-			VALUES ($1, $2, $3, $4)
-			ON CONFLICT (asset) DO UPDATE SET
-				average_price = (holdings.total_cost + $4) / (holdings.amount + $2),
-				amount = holdings.amount + $2,
-				total_cost = holdings.total_cost + $4
-		`, input.Asset, amount.String(), price.String(), totalUSDT.String())
+	// Insert order record
+	err = tx.QueryRow(`
+		INSERT INTO orders (asset, type, amount, price, total_usdt, quote_asset, quote_price, quote_total, quote_rate, is_custom_price, price_source,
+			lot_method, lot_selections, fee, fee_asset, fee_usdt, created_at, portfolio_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, NULLIF($12, ''), $13, $14, $15, $16, COALESCE($17, CURRENT_TIMESTAMP), $18)
+		RETURNING id, created_at
+	`, input.Asset, input.Type, amount.String(), price.String(), t.total().String(), quote, quotePrice.String(), quoteTotal.String(), rate.String(),
+		input.IsCustomPrice, priceSource, lotMethod, lotSelections, fee.Amount.String(), fee.Asset, fee.valueAt(price, rate).String(), executedAt, t.portfolioID,
+	).Scan(&t.orderID, &t.at)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	var realizedPnL *decimal.Decimal
+	if isBackdated {
+		// Replay history so this order and every later one see the balances and lots of their time
+		state, err := rebuildHoldings(tx, t.portfolioID)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			respondRebuildError(c, err, state)
 			return
 		}
-	} else if input.Type == "sell" {
-		// Check asset balance
-		var assetBalance string
-		err = tx.QueryRow("SELECT amount FROM holdings WHERE asset = $1", input.Asset).Scan(&assetBalance)
+		realizedPnL = state.realizedPnLFor(t.orderID)
+	} else {
+		// Post the trade; what arrives opens a lot and what leaves consumes the
+		// allocated ones, except for USDT
+		entry := sellEntry(t, cost)
+		if t.orderType == "buy" {
+			entry = buyEntry(t, cost)
+		}
+		_, err = postEntry(tx, entry)
+		if inAsset, inQty := t.acquired(); err == nil && inAsset != "USDT" {
+			err = createLot(tx, t.portfolioID, t.orderID, inAsset, inQty, t.worth(), t.at)
+		}
+		if err == nil && outAsset != "USDT" {
+			err = recordDisposals(tx, t.orderID, disposals, t.worth().Div(outQty), t.at)
+		}
 		if err != nil {
-			if err == sql.ErrNoRows {
-				c.JSON(http.StatusBadRequest, gin.H{"error": "No holdings for this asset"})
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		// Realized PnL = what the disposed asset fetched net of fees - its allocated cost basis
+		if outAsset != "USDT" {
+			pnl := t.worth().Sub(cost)
+			realizedPnL = &pnl
+			_, err = tx.Exec(`
+				INSERT INTO realized_pnl (order_id, asset, amount, proceeds, cost_basis, pnl)
+				VALUES ($1, $2, $3, $4, $5, $6)
+			`, t.orderID, outAsset, outQty.String(), t.worth().String(), cost.String(), pnl.String())
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 				return
 			}
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"id":           t.orderID,
+		"asset":        input.Asset,
+		"type":         input.Type,
+		"amount":       amount.String(),
+		"price":        price.String(),
+		"total":        t.total().String(),
+		"quote_asset":  quote,
+		"quote_price":  quotePrice.String(),
+		"quote_total":  quoteTotal.String(),
+		"quote_rate":   rate.String(),
+		"fee":          fee.Amount.String(),
+		"fee_asset":    fee.Asset,
+		"fee_usdt":     fee.valueAt(price, rate).String(),
+		"source":       priceSource,
+		"realized_pnl": realizedPnL,
+		"lot_method":   lotMethod,
+		"message":      "Order executed successfully",
+	})
+}
+
+// deleteOrder voids an order: its effect on balances, cost basis, lots and
+// realized PnL is reversed atomically, and the row is kept for audit.
+func deleteOrder(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid order id"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	if err = lockLedger(tx); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	var voidedAt sql.NullTime
+	t, err := scanTrade(tx.QueryRow("SELECT "+tradeColumns+", voided_at FROM orders WHERE id = $1 AND portfolio_id = $2 FOR UPDATE", id, portfolioID(c)), &voidedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if voidedAt.Valid {
+		c.JSON(http.StatusConflict, gin.H{"error": "Order is already voided"})
+		return
+	}
+	orderID := t.orderID
+	outAsset, outQty := t.disposed()
+	inAsset, inQty := t.acquired()
+
+	// What the order acquired has to still be there to give back
+	var inBalance string
+	err = tx.QueryRow("SELECT amount FROM holdings WHERE asset = $1 AND portfolio_id = $2", inAsset, t.portfolioID).Scan(&inBalance)
+	if err != nil && err != sql.ErrNoRows {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if balance, _ := decimal.NewFromString(inBalance); balance.LessThan(inQty) {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Voiding would leave a negative %s balance", inAsset)})
+		return
+	}
+
+	if inAsset != "USDT" {
+		// The acquired lot must be untouched; later orders and transfers depend on it otherwise.
+		// Lots transferred elsewhere keep the order id, so only the original counts
+		var lotAmount, lotRemaining sql.NullString
+		err = tx.QueryRow("SELECT amount, remaining FROM tax_lots WHERE order_id = $1 AND asset = $2 AND portfolio_id = $3 AND transfer_id IS NULL FOR UPDATE", id, inAsset, t.portfolioID).Scan(&lotAmount, &lotRemaining)
+		if err != nil && err != sql.ErrNoRows {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
-		balance, _ := decimal.NewFromString(assetBalance)
-		if balance.LessThan(amount) {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Insufficient asset balance"})
+		if lotAmount.Valid && lotAmount.String != lotRemaining.String {
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Part of the %s this order acquired has already been disposed of or transferred; void those orders or delete those transfers first", inAsset)})
 			return
 		}
-
-		// Get current average price and total cost
-		var avgPriceStr, totalCostStr string
-		err = tx.QueryRow("SELECT average_price, total_cost FROM holdings WHERE asset = $1", input.Asset).Scan(&avgPriceStr, &totalCostStr)
-		if err != nil {
+		if _, err = tx.Exec("DELETE FROM tax_lots WHERE order_id = $1 AND asset = $2 AND portfolio_id = $3 AND transfer_id IS NULL", id, inAsset, t.portfolioID); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
-		currentTotalCost, _ := decimal.NewFromString(totalCostStr)
-		currentBalance, _ := decimal.NewFromString(assetBalance)
-
-		// Calculate cost to deduct proportionally
-		costToDeduct := currentTotalCost.Mul(amount).Div(currentBalance)
+	}
 
-		// Deduct from asset holding
-		_, err = tx.Exec(`
-			UPDATE holdings SET
-				amount = amount - $1,
-				total_cost = total_cost - $2
-			WHERE asset = $3
-		`, amount.String(), costToDeduct.String(), input.Asset)
+	// Put the cost basis of what the order disposed of back
+	cost := outQty
+	if outAsset != "USDT" {
+		// Sells from before realized PnL tracking use the average
+		var costBasisStr string
+		err = tx.QueryRow("SELECT cost_basis FROM realized_pnl WHERE order_id = $1", id).Scan(&costBasisStr)
+		if err == sql.ErrNoRows {
+			err = tx.QueryRow("SELECT average_price * $1 FROM holdings WHERE asset = $2 AND portfolio_id = $3", outQty.String(), outAsset, t.portfolioID).Scan(&costBasisStr)
+		}
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
+		cost, _ = decimal.NewFromString(costBasisStr)
 
-		// Add USDT
+		// Reopen the lots the order consumed
 		_, err = tx.Exec(`
-			UPDATE holdings SET
-				amount = amount + $1,
-				total_cost = total_cost + $1
-			WHERE asset = 'USDT'
-		`, totalUSDT.String())
+			UPDATE tax_lots SET remaining = tax_lots.remaining + d.amount
+			FROM (SELECT lot_id, SUM(amount) AS amount FROM lot_disposals WHERE order_id = $1 GROUP BY lot_id) d
+			WHERE tax_lots.id = d.lot_id
+		`, id)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
+		if _, err = tx.Exec("DELETE FROM lot_disposals WHERE order_id = $1", id); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if _, err = tx.Exec("DELETE FROM realized_pnl WHERE order_id = $1", id); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
 	}
 
-	// Insert order record
-	var orderID int
-	err = tx.QueryRow(`
-		INSERT INTO orders (asset, type, amount, price, total_usdt, is_custom_price)
-		VALUES ($1, $2, $3, $4, $5, $6)
-		RETURNING id
-	`, input.Asset, input.Type, amount.String(), price.String(), totalUSDT.String(), input.IsCustomPrice).Scan(&orderID)
-	if err != nil {
+	original := sellEntry(t, cost)
+	if t.orderType == "buy" {
+		original = buyEntry(t, cost)
+	}
+
+	// Post the mirror image of the trade so the books show both
+	reversal := original.reversal(fmt.Sprintf("Void order %d", orderID), time.Now())
+	if _, err = postEntry(tx, reversal); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	if err = tx.Commit(); err != nil {
+	if _, err = tx.Exec("UPDATE orders SET voided_at = CURRENT_TIMESTAMP WHERE id = $1", orderID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err = recordAudit(tx, currentUser(c), AuditEntityOrder, orderID, "void", auditChanges{}, ""); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"id":      orderID,
-		"asset":   input.Asset,
-		"type":    input.Type,
-		"amount":  amount.String(),
-		"price":   price.String(),
-		"total":   totalUSDT.String(),
-		"message": "Order executed successfully",
-	})
-}
-
-func deleteOrder(c *gin.Context) {
-	id := c.Param("id")
-
-	_, err := db.Exec("DELETE FROM orders WHERE id = $1", id)
-	if err != nil {
+	if err = tx.Commit(); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Order deleted successfully"})
+	c.JSON(http.StatusOK, gin.H{"message": "Order voided successfully"})
 }
 
 // Holdings handlers
 func getHoldings(c *gin.Context) {
-	rows, err := db.Query("SELECT asset, amount, average_price, total_cost FROM holdings WHERE amount > 0")
+	rows, err := db.Query("SELECT asset, amount, average_price, total_cost FROM holdings WHERE amount > 0 AND portfolio_id = $1", portfolioID(c))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -787,41 +1601,105 @@ func getHoldings(c *gin.Context) {
 
 // Portfolio overview
 func getPortfolioOverview(c *gin.Context) {
-	// Get total deposits (initial + dca)
-	var totalDepositsStr sql.NullString
-	err := db.QueryRow("SELECT COALESCE(SUM(amount), 0) FROM capitals WHERE type IN ('initial', 'dca')").Scan(&totalDepositsStr)
+	currency, rate, ok := requestCurrency(c)
+	if !ok {
+		return
+	}
+
+	overview, err := buildPortfolioOverview(portfolioID(c))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+
+	c.JSON(http.StatusOK, overview.inCurrency(currency, rate))
+}
+
+// buildPortfolioOverview values the given portfolios together at current
+// prices.
+func buildPortfolioOverview(portfolioIDs ...int) (PortfolioOverview, error) {
+	ids := pq.Array(portfolioIDs)
+
+	// Get total deposits (initial + dca)
+	var totalDepositsStr sql.NullString
+	err := db.QueryRow("SELECT COALESCE(SUM(amount), 0) FROM capitals WHERE type IN ('initial', 'dca') AND portfolio_id = ANY($1) AND voided_at IS NULL", ids).Scan(&totalDepositsStr)
+	if err != nil {
+		return PortfolioOverview{}, err
+	}
 	totalDeposits, _ := decimal.NewFromString(totalDepositsStr.String)
 
 	// Get total withdrawals
 	var totalWithdrawalsStr sql.NullString
-	err = db.QueryRow("SELECT COALESCE(SUM(ABS(amount)), 0) FROM capitals WHERE type = 'withdraw'").Scan(&totalWithdrawalsStr)
+	err = db.QueryRow("SELECT COALESCE(SUM(ABS(amount)), 0) FROM capitals WHERE type = 'withdraw' AND portfolio_id = ANY($1) AND voided_at IS NULL", ids).Scan(&totalWithdrawalsStr)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+		return PortfolioOverview{}, err
 	}
 	totalWithdrawals, _ := decimal.NewFromString(totalWithdrawalsStr.String)
 
 	// Get realized losses (stored as negative, so we use ABS)
 	var realizedLossStr sql.NullString
-	err = db.QueryRow("SELECT COALESCE(SUM(ABS(amount)), 0) FROM capitals WHERE type = 'realized_loss'").Scan(&realizedLossStr)
+	err = db.QueryRow("SELECT COALESCE(SUM(ABS(amount)), 0) FROM capitals WHERE type = 'realized_loss' AND portfolio_id = ANY($1) AND voided_at IS NULL", ids).Scan(&realizedLossStr)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+		return PortfolioOverview{}, err
 	}
 	realizedLoss, _ := decimal.NewFromString(realizedLossStr.String)
 
+	// Get realized gains and losses recorded on sells
+	var realizedGainsStr, realizedLossesStr string
+	err = db.QueryRow(`
+		SELECT
+			COALESCE(SUM(pnl) FILTER (WHERE pnl > 0), 0),
+			COALESCE(SUM(-pnl) FILTER (WHERE pnl < 0), 0)
+		FROM realized_pnl
+		WHERE order_id IN (SELECT id FROM orders WHERE portfolio_id = ANY($1))
+	`, ids).Scan(&realizedGainsStr, &realizedLossesStr)
+	if err != nil {
+		return PortfolioOverview{}, err
+	}
+	realizedGains, _ := decimal.NewFromString(realizedGainsStr)
+	realizedLosses, _ := decimal.NewFromString(realizedLossesStr)
+
+	// Get trading and network fees paid
+	var totalFeesStr string
+	err = db.QueryRow(`
+		SELECT
+			(SELECT COALESCE(SUM(fee_usdt), 0) FROM orders WHERE voided_at IS NULL AND portfolio_id = ANY($1))
+			+ (SELECT COALESCE(SUM(fee_cost), 0) FROM transfers WHERE voided_at IS NULL AND from_portfolio_id = ANY($1))
+	`, ids).Scan(&totalFeesStr)
+	if err != nil {
+		return PortfolioOverview{}, err
+	}
+	totalFees, _ := decimal.NewFromString(totalFeesStr)
+
+	// Get the cost basis transferred in from other portfolios, less what went
+	// out; it nets to zero across all of them
+	var netTransfersStr string
+	err = db.QueryRow(`
+		SELECT COALESCE(-SUM(p.value), 0)
+		FROM postings p
+		JOIN journal_entries e ON e.id = p.entry_id
+		WHERE p.account = $2 AND e.portfolio_id = ANY($1)
+	`, ids, AccountTransfers).Scan(&netTransfersStr)
+	if err != nil {
+		return PortfolioOverview{}, err
+	}
+	netTransfers, _ := decimal.NewFromString(netTransfersStr)
+
 	// Total capital = deposits - withdrawals (includes realized loss in deposits for tracking total invested)
 	totalCapital := totalDeposits.Sub(totalWithdrawals)
 
-	// Get all holdings
-	rows, err := db.Query("SELECT asset, amount, average_price, total_cost FROM holdings WHERE amount > 0")
+	// Get all holdings, combined across portfolios when aggregating
+	rows, err := db.Query(`
+		SELECT asset, SUM(amount),
+			CASE WHEN asset = 'USDT' THEN 1 ELSE ROUND(SUM(total_cost) / SUM(amount), 8) END,
+			SUM(total_cost)
+		FROM holdings
+		WHERE portfolio_id = ANY($1)
+		GROUP BY asset
+		HAVING SUM(amount) > 0
+	`, ids)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+		return PortfolioOverview{}, err
 	}
 	defer rows.Close()
 
@@ -829,7 +1707,11 @@ func getPortfolioOverview(c *gin.Context) {
 	var totalInvested, currentValue, availableUSDT decimal.Decimal
 
 	// Fetch current prices
-	prices, _ := fetchAllPrices()
+	prices, err := fetchAllPrices(portfolioIDs)
+	if err != nil {
+		log.Printf("Portfolio valuation without complete live prices: %v", err)
+	}
+	var nonLiveAssets []string
 
 	// First pass: collect all holdings and calculate totals
 	for rows.Next() {
@@ -848,9 +1730,15 @@ func getPortfolioOverview(c *gin.Context) {
 			continue
 		}
 
-		currentPrice := decimal.NewFromFloat(1)
+		// Without any quote, value the holding at its average entry price
+		currentPrice := avgPrice
+		priceSource := PriceSourceCost
 		if p, ok := prices[asset]; ok {
 			currentPrice = p.Price
+			priceSource = p.Source
+		}
+		if priceSource != PriceSourceLive {
+			nonLiveAssets = append(nonLiveAssets, asset)
 		}
 
 		holdingValue := amount.Mul(currentPrice)
@@ -870,6 +1758,7 @@ func getPortfolioOverview(c *gin.Context) {
 			PnL:              pnl,
 			PnLPercent:       pnlPercent,
 			PercentOfCapital: decimal.Zero, // Will be calculated after we know portfolio value
+			PriceSource:      priceSource,
 		})
 
 		totalInvested = totalInvested.Add(totalCost)
@@ -893,64 +1782,100 @@ func getPortfolioOverview(c *gin.Context) {
 	displayTotalCapital := totalCapital.Add(realizedLoss)
 
 	// Total PnL = Portfolio Value - Total Capital (what user actually invested)
+	// Transfers from other portfolios count as invested at their cost basis
 	// portfolioValue was already calculated above
-	totalPnL := portfolioValue.Sub(displayTotalCapital)
+	investedBase := displayTotalCapital.Add(netTransfers)
+	totalPnL := portfolioValue.Sub(investedBase)
 
-	// For percentage calculation, use display total capital as the base
+	// For percentage calculation, use the invested base
 	totalPnLPercent := decimal.Zero
-	if !displayTotalCapital.IsZero() {
-		totalPnLPercent = totalPnL.Div(displayTotalCapital).Mul(decimal.NewFromInt(100))
+	if !investedBase.IsZero() {
+		totalPnLPercent = totalPnL.Div(investedBase).Mul(decimal.NewFromInt(100))
 	}
 
 	if holdings == nil {
 		holdings = []HoldingDetail{}
 	}
+	if nonLiveAssets == nil {
+		nonLiveAssets = []string{}
+	}
 
-	c.JSON(http.StatusOK, PortfolioOverview{
+	return PortfolioOverview{
 		TotalCapital:    displayTotalCapital,
 		AvailableUSDT:   availableUSDT,
 		TotalInvested:   totalInvested,
 		CurrentValue:    currentValue,
 		UnrealizedPnL:   unrealizedPnL,
 		RealizedLoss:    realizedLoss,
+		RealizedGains:   realizedGains,
+		RealizedLosses:  realizedLosses,
+		RealizedPnL:     realizedGains.Sub(realizedLosses),
+		TotalFees:       totalFees,
+		NetTransfers:    netTransfers,
 		TotalPnL:        totalPnL,
 		TotalPnLPercent: totalPnLPercent,
 		Holdings:        holdings,
-	})
+		NonLiveAssets:   nonLiveAssets,
+	}, nil
 }
 
 // Price handlers
 func getPrices(c *gin.Context) {
-	prices, err := fetchAllPrices()
+	currency, rate, ok := requestCurrency(c)
+	if !ok {
+		return
+	}
+
+	// Only what the user's own portfolios hold or watch
+	portfolios, err := userPortfolios(currentUser(c))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	ids := make([]int, len(portfolios))
+	for i, p := range portfolios {
+		ids[i] = p.ID
+	}
+
+	prices, err := fetchAllPrices(ids)
+	if err != nil && len(prices) == 0 {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
 
 	priceList := make([]PriceData, 0, len(prices))
 	for _, p := range prices {
 		priceList = append(priceList, p)
 	}
 
-	c.JSON(http.StatusOK, priceList)
+	c.JSON(http.StatusOK, pricesInCurrency(priceList, currency, rate))
 }
 
 func getPrice(c *gin.Context) {
+	currency, rate, ok := requestCurrency(c)
+	if !ok {
+		return
+	}
+
 	symbol := c.Param("symbol")
 	price, err := fetchPrice(symbol)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	c.JSON(http.StatusOK, price)
+	c.JSON(http.StatusOK, price.inCurrency(currency, rate))
 }
 
 func getAssetDetail(c *gin.Context) {
 	symbol := c.Param("symbol")
+	currency, rate, ok := requestCurrency(c)
+	if !ok {
+		return
+	}
 
 	// Get holding data
 	var amountStr, avgPriceStr, totalCostStr string
-	err := db.QueryRow("SELECT amount, average_price, total_cost FROM holdings WHERE asset = $1", symbol).Scan(&amountStr, &avgPriceStr, &totalCostStr)
+	err := db.QueryRow("SELECT amount, average_price, total_cost FROM holdings WHERE asset = $1 AND portfolio_id = $2", symbol, portfolioID(c)).Scan(&amountStr, &avgPriceStr, &totalCostStr)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			c.JSON(http.StatusNotFound, gin.H{"error": "No holdings for this asset"})
@@ -967,9 +1892,11 @@ func getAssetDetail(c *gin.Context) {
 	// Get current price
 	priceData, err := fetchPrice(symbol)
 	currentPrice := avgPrice
+	priceSource := PriceSourceCost
 	var change24h, percentChange24h decimal.Decimal
 	if err == nil {
 		currentPrice = priceData.Price
+		priceSource = priceData.Source
 		change24h = priceData.Change24h
 		percentChange24h = priceData.PercentChange24h
 	}
@@ -983,7 +1910,7 @@ func getAssetDetail(c *gin.Context) {
 
 	// Get total capital for percentage calculation
 	var totalCapitalStr sql.NullString
-	db.QueryRow("SELECT COALESCE(SUM(amount), 0) FROM capitals").Scan(&totalCapitalStr)
+	db.QueryRow("SELECT COALESCE(SUM(amount), 0) FROM capitals WHERE portfolio_id = $1 AND voided_at IS NULL", portfolioID(c)).Scan(&totalCapitalStr)
 	totalCapital, _ := decimal.NewFromString(totalCapitalStr.String)
 
 	percentOfCapital := decimal.Zero
@@ -993,11 +1920,11 @@ func getAssetDetail(c *gin.Context) {
 
 	// Get orders for this asset
 	orderRows, err := db.Query(`
-		SELECT id, asset, type, amount, price, total_usdt, is_custom_price, created_at 
+		SELECT `+orderColumns+`
 		FROM orders 
-		WHERE asset = $1
+		WHERE asset = $1 AND portfolio_id = $2 AND voided_at IS NULL
 		ORDER BY created_at DESC
-	`, symbol)
+	`, symbol, portfolioID(c))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -1006,14 +1933,10 @@ func getAssetDetail(c *gin.Context) {
 
 	var orders []Order
 	for orderRows.Next() {
-		var order Order
-		var oAmount, oPrice, oTotalUSDT string
-		if err := orderRows.Scan(&order.ID, &order.Asset, &order.Type, &oAmount, &oPrice, &oTotalUSDT, &order.IsCustomPrice, &order.CreatedAt); err != nil {
+		order, err := scanOrder(orderRows)
+		if err != nil {
 			continue
 		}
-		order.Amount, _ = decimal.NewFromString(oAmount)
-		order.Price, _ = decimal.NewFromString(oPrice)
-		order.TotalUSDT, _ = decimal.NewFromString(oTotalUSDT)
 		orders = append(orders, order)
 	}
 
@@ -1021,18 +1944,21 @@ func getAssetDetail(c *gin.Context) {
 		orders = []Order{}
 	}
 
+	// Valuations in the reporting currency; orders keep their recorded USDT values
 	c.JSON(http.StatusOK, gin.H{
 		"asset":              symbol,
 		"amount":             amount,
-		"average_price":      avgPrice,
-		"current_price":      currentPrice,
-		"total_cost":         totalCost,
-		"current_value":      currentValue,
-		"pnl":                pnl,
+		"average_price":      avgPrice.Mul(rate),
+		"current_price":      currentPrice.Mul(rate),
+		"price_source":       priceSource,
+		"total_cost":         totalCost.Mul(rate),
+		"current_value":      currentValue.Mul(rate),
+		"pnl":                pnl.Mul(rate),
 		"pnl_percent":        pnlPercent,
 		"percent_of_capital": percentOfCapital,
-		"change_24h":         change24h,
+		"change_24h":         change24h.Mul(rate),
 		"percent_change_24h": percentChange24h,
+		"currency":           currency,
 		"orders":             orders,
 	})
 }
@@ -1049,80 +1975,54 @@ func getTopCoins(c *gin.Context) {
 }
 
 func getTop20Coins(c *gin.Context) {
+	currency, rate, ok := requestCurrency(c)
+	if !ok {
+		return
+	}
+
 	coins, err := fetchTopCoinsWithPrices("20")
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	c.JSON(http.StatusOK, coins)
+	c.JSON(http.StatusOK, pricesInCurrency(coins, currency, rate))
 }
 
 func fetchTopCoins(limit string) ([]CoinInfo, error) {
-	apiKey := os.Getenv("CMC_API_KEY")
-	if apiKey == "" {
-		return getDefaultCoins(), nil
+	n, err := strconv.Atoi(limit)
+	if err != nil || n <= 0 {
+		n = 100
 	}
 
-	url := fmt.Sprintf("https://pro-api.coinmarketcap.com/v1/cryptocurrency/listings/latest?limit=%s&convert=USD", limit)
-	req, _ := http.NewRequest("GET", url, nil)
-	req.Header.Add("X-CMC_PRO_API_KEY", apiKey)
-	req.Header.Add("Accept", "application/json")
-
-	client := &http.Client{Timeout: 15 * time.Second}
-	resp, err := client.Do(req)
+	listings, err := priceProvider.Listings(n)
 	if err != nil {
-		return getDefaultCoins(), nil
-	}
-	defer resp.Body.Close()
-
-	body, _ := io.ReadAll(resp.Body)
-	var cmcResp CMCListingsResponse
-	if err := json.Unmarshal(body, &cmcResp); err != nil {
+		log.Printf("%s listings failed, using defaults: %v", priceProvider.Name(), err)
 		return getDefaultCoins(), nil
 	}
 
-	coins := make([]CoinInfo, 0, len(cmcResp.Data))
-	for i, coin := range cmcResp.Data {
-		coins = append(coins, CoinInfo{
-			Symbol: coin.Symbol,
-			Name:   coin.Name,
-			Price:  decimal.NewFromFloat(coin.Quote.USD.Price),
-			Rank:   i + 1,
-		})
+	coins := make([]CoinInfo, 0, len(listings))
+	for _, l := range listings {
+		coins = append(coins, l.Info)
 	}
-
 	return coins, nil
 }
 
 func fetchTopCoinsWithPrices(limit string) ([]PriceData, error) {
-	apiKey := os.Getenv("CMC_API_KEY")
-	if apiKey == "" {
-		return getDefaultPrices(), nil
+	n, err := strconv.Atoi(limit)
+	if err != nil || n <= 0 {
+		n = 20
 	}
 
-	url := fmt.Sprintf("https://pro-api.coinmarketcap.com/v1/cryptocurrency/listings/latest?limit=%s&convert=USD", limit)
-	req, _ := http.NewRequest("GET", url, nil)
-	req.Header.Add("X-CMC_PRO_API_KEY", apiKey)
-	req.Header.Add("Accept", "application/json")
-
-	client := &http.Client{Timeout: 15 * time.Second}
-	resp, err := client.Do(req)
+	listings, err := priceProvider.Listings(n)
 	if err != nil {
+		log.Printf("%s listings failed, using defaults: %v", priceProvider.Name(), err)
 		return getDefaultPrices(), nil
 	}
-	defer resp.Body.Close()
 
-	body, _ := io.ReadAll(resp.Body)
-	var cmcResp CMCListingsResponse
-	if err := json.Unmarshal(body, &cmcResp); err != nil {
-		return getDefaultPrices(), nil
-	}
-
-	prices := make([]PriceData, 0, len(cmcResp.Data))
-	for _, coin := range cmcResp.Data {
-		prices = append(prices, buildPriceData(coin.Symbol, coin.Quote.USD))
+	prices := make([]PriceData, 0, len(listings))
+	for _, l := range listings {
+		prices = append(prices, l.Quote)
 	}
-
 	return prices, nil
 }
 
@@ -1167,6 +2067,8 @@ func getDefaultPrices() []PriceData {
 			PercentChange7d:  decimal.NewFromFloat(5.0),
 			Change30d:        coin.Price.Mul(decimal.NewFromFloat(0.1)),
 			PercentChange30d: decimal.NewFromFloat(10.0),
+			Source:           PriceSourceMock,
+			AsOf:             time.Now(),
 		})
 	}
 	return prices
@@ -1174,7 +2076,7 @@ func getDefaultPrices() []PriceData {
 
 // Watchlist handlers
 func getWatchlist(c *gin.Context) {
-	rows, err := db.Query("SELECT symbol, name, added_at FROM watchlist ORDER BY added_at DESC")
+	rows, err := db.Query("SELECT symbol, name, added_at FROM watchlist WHERE portfolio_id = $1 ORDER BY added_at DESC", portfolioID(c))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -1209,8 +2111,8 @@ func addToWatchlist(c *gin.Context) {
 	}
 
 	_, err := db.Exec(
-		"INSERT INTO watchlist (symbol, name) VALUES ($1, $2) ON CONFLICT (symbol) DO UPDATE SET name = $2",
-		input.Symbol, input.Name,
+		"INSERT INTO watchlist (portfolio_id, symbol, name) VALUES ($1, $2, $3) ON CONFLICT (portfolio_id, symbol) DO UPDATE SET name = $3",
+		portfolioID(c), input.Symbol, input.Name,
 	)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -1223,7 +2125,7 @@ func addToWatchlist(c *gin.Context) {
 func removeFromWatchlist(c *gin.Context) {
 	symbol := c.Param("symbol")
 
-	_, err := db.Exec("DELETE FROM watchlist WHERE symbol = $1", symbol)
+	_, err := db.Exec("DELETE FROM watchlist WHERE symbol = $1 AND portfolio_id = $2", symbol, portfolioID(c))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -1233,7 +2135,12 @@ func removeFromWatchlist(c *gin.Context) {
 }
 
 func getWatchlistPrices(c *gin.Context) {
-	rows, err := db.Query("SELECT symbol FROM watchlist")
+	currency, rate, ok := requestCurrency(c)
+	if !ok {
+		return
+	}
+
+	rows, err := db.Query("SELECT symbol FROM watchlist WHERE portfolio_id = $1", portfolioID(c))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -1254,92 +2161,28 @@ func getWatchlistPrices(c *gin.Context) {
 		return
 	}
 
-	prices := make([]PriceData, 0, len(symbols))
-	for _, symbol := range symbols {
-		price, err := fetchPrice(symbol)
-		if err == nil {
-			prices = append(prices, price)
-		}
-	}
-
-	c.JSON(http.StatusOK, prices)
-}
-
-// Reset all data handler
-func resetAllData(c *gin.Context) {
-	tx, err := db.Begin()
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
-	defer tx.Rollback()
-
-	// Delete all orders
-	_, err = tx.Exec("DELETE FROM orders")
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
-
-	// Delete all capitals
-	_, err = tx.Exec("DELETE FROM capitals")
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
-
-	// Reset holdings (keep USDT but set to 0)
-	_, err = tx.Exec("DELETE FROM holdings WHERE asset != 'USDT'")
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
-
-	_, err = tx.Exec("UPDATE holdings SET amount = 0, total_cost = 0 WHERE asset = 'USDT'")
-	if err != nil {
+	quotes, err := fetchPrices(symbols)
+	if err != nil && len(quotes) == 0 {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	if err = tx.Commit(); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+	prices := make([]PriceData, 0, len(symbols))
+	for _, symbol := range symbols {
+		if price, ok := quotes[symbol]; ok {
+			prices = append(prices, price.inCurrency(currency, rate))
+		}
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "All data has been reset successfully"})
+	c.JSON(http.StatusOK, prices)
 }
 
-// CMC API functions
+// Price lookups
 func fetchPrice(symbol string) (PriceData, error) {
-	apiKey := os.Getenv("CMC_API_KEY")
-	if apiKey == "" {
-		// Return mock price if no API key
-		return getMockPrice(symbol), nil
-	}
-
-	url := fmt.Sprintf("https://pro-api.coinmarketcap.com/v1/cryptocurrency/quotes/latest?symbol=%s", symbol)
-	req, _ := http.NewRequest("GET", url, nil)
-	req.Header.Add("X-CMC_PRO_API_KEY", apiKey)
-	req.Header.Add("Accept", "application/json")
-
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return getMockPrice(symbol), nil
-	}
-	defer resp.Body.Close()
-
-	body, _ := io.ReadAll(resp.Body)
-	var cmcResp CMCQuoteResponse
-	if err := json.Unmarshal(body, &cmcResp); err != nil {
-		return getMockPrice(symbol), nil
-	}
-
-	if asset, ok := cmcResp.Data[symbol]; ok {
-		return buildPriceData(symbol, asset.Quote.USD), nil
+	if quote, ok := parQuote(symbol); ok {
+		return quote, nil
 	}
-
-	return getMockPrice(symbol), nil
+	return priceProvider.Quote(symbol)
 }
 
 func buildPriceData(symbol string, quote CMCPrice) PriceData {
@@ -1349,6 +2192,7 @@ func buildPriceData(symbol string, quote CMCPrice) PriceData {
 	pct7d := decimal.NewFromFloat(quote.PercentChange7d)
 	pct30d := decimal.NewFromFloat(quote.PercentChange30d)
 
+	// Only upstream vendor data goes through here, so it is live by definition
 	return PriceData{
 		Symbol:           symbol,
 		Price:            price,
@@ -1360,59 +2204,103 @@ func buildPriceData(symbol string, quote CMCPrice) PriceData {
 		PercentChange7d:  pct7d,
 		Change30d:        price.Mul(pct30d).Div(decimal.NewFromInt(100)),
 		PercentChange30d: pct30d,
+		Source:           PriceSourceLive,
+		AsOf:             time.Now(),
 	}
 }
 
-func fetchAllPrices() (map[string]PriceData, error) {
-	symbols := []string{"BTC", "ETH", "SOL", "ONDO", "LINK"}
-	prices := make(map[string]PriceData)
-
-	apiKey := os.Getenv("CMC_API_KEY")
-	if apiKey == "" {
-		// Return mock prices if no API key
-		for _, s := range symbols {
-			prices[s] = getMockPrice(s)
-		}
-		return prices, nil
+// fetchAllPrices prices every asset tracked in the given portfolios.
+func fetchAllPrices(portfolioIDs []int) (map[string]PriceData, error) {
+	symbols, err := portfolioSymbols(portfolioIDs)
+	if err != nil {
+		return nil, err
+	}
+	if len(symbols) == 0 {
+		return map[string]PriceData{}, nil
 	}
+	return fetchPrices(symbols)
+}
 
-	symbolStr := "BTC,ETH,SOL,ONDO,LINK"
-	url := fmt.Sprintf("https://pro-api.coinmarketcap.com/v1/cryptocurrency/quotes/latest?symbol=%s", symbolStr)
-	req, _ := http.NewRequest("GET", url, nil)
-	req.Header.Add("X-CMC_PRO_API_KEY", apiKey)
-	req.Header.Add("Accept", "application/json")
+// trackedSymbols is the universe of assets we price: everything currently
+// held, everything on the watchlist and any extras listed in TRACKED_SYMBOLS.
+// It spans every portfolio, for the ingesters only.
+func trackedSymbols() ([]string, error) {
+	return querySymbols(`
+		SELECT asset FROM holdings WHERE amount > 0 AND asset != 'USDT'
+		UNION
+		SELECT symbol FROM watchlist
+	`)
+}
+
+// portfolioSymbols is the part of the universe held or watched in the given
+// portfolios, so nobody learns what other users hold.
+func portfolioSymbols(portfolioIDs []int) ([]string, error) {
+	return querySymbols(`
+		SELECT asset FROM holdings WHERE amount > 0 AND asset != 'USDT' AND portfolio_id = ANY($1)
+		UNION
+		SELECT symbol FROM watchlist WHERE portfolio_id = ANY($1)
+	`, pq.Array(portfolioIDs))
+}
 
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
+func querySymbols(query string, args ...interface{}) ([]string, error) {
+	rows, err := db.Query(query, args...)
 	if err != nil {
-		for _, s := range symbols {
-			prices[s] = getMockPrice(s)
-		}
-		return prices, nil
+		return nil, err
 	}
-	defer resp.Body.Close()
+	defer rows.Close()
 
-	body, _ := io.ReadAll(resp.Body)
-	var cmcResp CMCQuoteResponse
-	if err := json.Unmarshal(body, &cmcResp); err != nil {
-		for _, s := range symbols {
-			prices[s] = getMockPrice(s)
+	var symbols []string
+	seen := make(map[string]bool)
+	for rows.Next() {
+		var symbol string
+		if err := rows.Scan(&symbol); err != nil {
+			return nil, err
+		}
+		if !seen[symbol] {
+			seen[symbol] = true
+			symbols = append(symbols, symbol)
 		}
-		return prices, nil
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
 	}
 
-	for symbol, asset := range cmcResp.Data {
-		prices[symbol] = buildPriceData(symbol, asset.Quote.USD)
+	for _, symbol := range strings.Split(os.Getenv("TRACKED_SYMBOLS"), ",") {
+		symbol = strings.ToUpper(strings.TrimSpace(symbol))
+		if symbol != "" && !seen[symbol] {
+			seen[symbol] = true
+			symbols = append(symbols, symbol)
+		}
 	}
 
-	// Fill in any missing with mock prices
-	for _, s := range symbols {
-		if _, ok := prices[s]; !ok {
-			prices[s] = getMockPrice(s)
+	sort.Strings(symbols)
+	return symbols, nil
+}
+
+// fetchPrices prices several symbols with a single provider call. Symbols
+// that could not be priced are missing from the map and reported in the error.
+func fetchPrices(symbols []string) (map[string]PriceData, error) {
+	var quoted []string
+	par := make(map[string]PriceData)
+	for _, symbol := range symbols {
+		if quote, ok := parQuote(symbol); ok {
+			par[symbol] = quote
+		} else {
+			quoted = append(quoted, symbol)
 		}
 	}
 
-	return prices, nil
+	prices, err := priceProvider.Quotes(quoted)
+	if prices == nil {
+		prices = make(map[string]PriceData)
+	}
+	for symbol, quote := range par {
+		prices[symbol] = quote
+	}
+	if err != nil {
+		log.Printf("%s quotes failed: %v", priceProvider.Name(), err)
+	}
+	return prices, err
 }
 
 func getMockPrice(symbol string) PriceData {
@@ -1462,6 +2350,8 @@ func getMockPrice(symbol string) PriceData {
 		PercentChange7d:  pct7d,
 		Change30d:        priceD.Mul(pct30d).Div(decimal.NewFromInt(100)),
 		PercentChange30d: pct30d,
+		Source:           PriceSourceMock,
+		AsOf:             time.Now(),
 	}
 }
 
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shopspring/decimal"
+)
+
+// PeriodPerformance holds the returns of the portfolio over one period.
+// TWRPercent is cumulative over the period; IRRPercent is annualized and nil
+// when it cannot be solved (for example with no flows and no value). A
+// period with no snapshot at its start starts at its first snapshot instead;
+// with none in it either, or none to end it on, HistoryTooShort is set and
+// both returns are nil.
+type PeriodPerformance struct {
+	Period          string           `json:"period"` // "MTD", "QTD", "YTD" or "ALL"
+	Start           time.Time        `json:"start"`
+	End             time.Time        `json:"end"`
+	StartValue      decimal.Decimal  `json:"start_value"`
+	EndValue        decimal.Decimal  `json:"end_value"`
+	NetFlows        decimal.Decimal  `json:"net_flows"` // deposits minus withdrawals
+	Gain            decimal.Decimal  `json:"gain"`      // end - start - net flows
+	TWRPercent      *decimal.Decimal `json:"twr_percent"`
+	IRRPercent      *decimal.Decimal `json:"irr_percent"`
+	HistoryTooShort bool             `json:"history_too_short"`
+}
+
+type valuationPoint struct {
+	at    time.Time
+	value decimal.Decimal
+}
+
+// cashFlow is external money moving in (positive) or out (negative).
+type cashFlow struct {
+	at     time.Time
+	amount decimal.Decimal
+}
+
+func getPortfolioPerformance(c *gin.Context) {
+	if !requireUSD(c) {
+		return
+	}
+	id := portfolioID(c)
+	flows, err := loadCashFlows(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	valuations, err := loadValuations(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Value the portfolio now so every period ends on a current figure. A
+	// value resting on mock or stale quotes is left out like such snapshots
+	// are, and the periods end at the last live snapshot instead.
+	overview, err := buildPortfolioOverview(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	now := time.Now()
+	end := now
+	if len(overview.NonLiveAssets) == 0 {
+		valuations = append(valuations, valuationPoint{at: now, value: overview.CurrentValue.Add(overview.AvailableUSDT)})
+	} else if len(valuations) > 0 {
+		end = valuations[len(valuations)-1].at
+	}
+
+	// All-time starts just before the first recorded event
+	inception := now
+	if len(flows) > 0 {
+		inception = flows[0].at
+	}
+	if len(valuations) > 0 && valuations[0].at.Before(inception) {
+		inception = valuations[0].at
+	}
+	inception = inception.Add(-time.Second)
+
+	year, month, _ := now.Date()
+	quarterMonth := time.Month((int(month)-1)/3*3 + 1)
+	periods := []struct {
+		name  string
+		start time.Time
+	}{
+		{"MTD", time.Date(year, month, 1, 0, 0, 0, 0, now.Location())},
+		{"QTD", time.Date(year, quarterMonth, 1, 0, 0, 0, 0, now.Location())},
+		{"YTD", time.Date(year, time.January, 1, 0, 0, 0, 0, now.Location())},
+		{"ALL", inception},
+	}
+
+	results := make([]PeriodPerformance, 0, len(periods))
+	for _, p := range periods {
+		start := p.start
+		if start.Before(inception) {
+			start = inception
+		}
+		results = append(results, periodPerformance(p.name, start, end, valuations, flows))
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"as_of":           end,
+		"periods":         results,
+		"non_live_assets": overview.NonLiveAssets,
+		"currency":        "USD",
+	})
+}
+
+// loadCashFlows returns a portfolio's deposits and withdrawals in
+// chronological order. Manually recorded realized losses are bookkeeping,
+// not money movements.
+func loadCashFlows(portfolioID int) ([]cashFlow, error) {
+	// Transfers count at their market value, in to the receiver and out of
+	// the sender; the network fee is a loss of the sender
+	rows, err := db.Query(`
+		SELECT amount, created_at FROM capitals
+		WHERE type IN ('initial', 'dca', 'withdraw') AND portfolio_id = $1 AND voided_at IS NULL
+		UNION ALL
+		SELECT CASE WHEN to_portfolio_id = $1 THEN market_value ELSE -market_value END, created_at
+		FROM transfers
+		WHERE $1 IN (from_portfolio_id, to_portfolio_id) AND from_portfolio_id <> to_portfolio_id AND voided_at IS NULL
+		ORDER BY created_at
+	`, portfolioID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var flows []cashFlow
+	for rows.Next() {
+		var amountStr string
+		var f cashFlow
+		if err := rows.Scan(&amountStr, &f.at); err != nil {
+			return nil, err
+		}
+		f.amount, _ = decimal.NewFromString(amountStr)
+		flows = append(flows, f)
+	}
+	return flows, rows.Err()
+}
+
+// loadValuations returns the portfolio's snapshot values in chronological
+// order. Snapshots valued without a live quote are left out.
+func loadValuations(portfolioID int) ([]valuationPoint, error) {
+	rows, err := db.Query("SELECT total_value, created_at FROM portfolio_snapshots WHERE portfolio_id = $1 AND non_live_assets = '[]' ORDER BY created_at", portfolioID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var points []valuationPoint
+	for rows.Next() {
+		var valueStr string
+		var p valuationPoint
+		if err := rows.Scan(&valueStr, &p.at); err != nil {
+			return nil, err
+		}
+		p.value, _ = decimal.NewFromString(valueStr)
+		points = append(points, p)
+	}
+	return points, rows.Err()
+}
+
+// periodPerformance links Modified Dietz returns between consecutive
+// valuations into a time-weighted return, and solves the money-weighted
+// return (XIRR) from the start value, the flows and the end value.
+func periodPerformance(name string, start, end time.Time, valuations []valuationPoint, flows []cashFlow) PeriodPerformance {
+	// Value at the start is the last valuation before it
+	var before *valuationPoint
+	var points []valuationPoint
+	for i, v := range valuations {
+		if !v.at.After(start) {
+			before = &valuations[i]
+		} else if !v.at.After(end) {
+			points = append(points, v)
+		}
+	}
+	switch {
+	case before != nil:
+		points = append([]valuationPoint{{at: start, value: before.value}}, points...)
+	case !flowsUntil(flows, start):
+		// Nothing had come in yet, so there was nothing to value
+		points = append([]valuationPoint{{at: start}}, points...)
+	case len(points) > 1:
+		// Unknown at the start; begin at the first snapshot in the period
+		start = points[0].at
+	default:
+		return PeriodPerformance{Period: name, Start: start, End: end, HistoryTooShort: true}
+	}
+	if len(points) < 2 {
+		// No valuation after the start to end the period on
+		return PeriodPerformance{Period: name, Start: start, End: end, HistoryTooShort: true}
+	}
+	startValue := points[0].value
+
+	var periodFlows []cashFlow
+	netFlows := decimal.Zero
+	for _, f := range flows {
+		if f.at.After(start) && !f.at.After(end) {
+			periodFlows = append(periodFlows, f)
+			netFlows = netFlows.Add(f.amount)
+		}
+	}
+
+	growth := decimal.NewFromInt(1)
+	for i := 1; i < len(points); i++ {
+		prev, cur := points[i-1], points[i]
+		length := cur.at.Sub(prev.at)
+		if length <= 0 {
+			continue
+		}
+
+		flow, weighted := decimal.Zero, decimal.Zero
+		for _, f := range periodFlows {
+			if f.at.After(prev.at) && !f.at.After(cur.at) {
+				flow = flow.Add(f.amount)
+				weight := decimal.NewFromInt(int64(cur.at.Sub(f.at))).Div(decimal.NewFromInt(int64(length)))
+				weighted = weighted.Add(f.amount.Mul(weight))
+			}
+		}
+
+		base := prev.value.Add(weighted)
+		if !base.IsPositive() {
+			continue
+		}
+		growth = growth.Mul(decimal.NewFromInt(1).Add(cur.value.Sub(prev.value).Sub(flow).Div(base)))
+	}
+
+	endValue := points[len(points)-1].value
+
+	// Investor's view: money put in is negative, money taken out positive
+	xirrFlows := []cashFlow{}
+	if startValue.IsPositive() {
+		xirrFlows = append(xirrFlows, cashFlow{at: start, amount: startValue.Neg()})
+	}
+	for _, f := range periodFlows {
+		xirrFlows = append(xirrFlows, cashFlow{at: f.at, amount: f.amount.Neg()})
+	}
+	xirrFlows = append(xirrFlows, cashFlow{at: end, amount: endValue})
+
+	twr := growth.Sub(decimal.NewFromInt(1)).Mul(decimal.NewFromInt(100)).Round(4)
+	perf := PeriodPerformance{
+		Period:     name,
+		Start:      start,
+		End:        end,
+		StartValue: startValue.Round(8),
+		EndValue:   endValue.Round(8),
+		NetFlows:   netFlows.Round(8),
+		Gain:       endValue.Sub(startValue).Sub(netFlows).Round(8),
+		TWRPercent: &twr,
+	}
+	if irr, ok := xirr(xirrFlows); ok {
+		pct := decimal.NewFromFloat(irr * 100).Round(4)
+		perf.IRRPercent = &pct
+	}
+	return perf
+}
+
+// flowsUntil reports whether any money flowed at or before t.
+func flowsUntil(flows []cashFlow, t time.Time) bool {
+	return len(flows) > 0 && !flows[0].at.After(t)
+}
+
+// xirr solves for the annual rate r where the net present value of the
+// dated flows is zero, using Newton's method with a bisection fallback. The
+// solver works in float64.
+func xirr(flows []cashFlow) (float64, bool) {
+	if len(flows) < 2 {
+		return 0, false
+	}
+	sort.Slice(flows, func(i, j int) bool { return flows[i].at.Before(flows[j].at) })
+
+	hasIn, hasOut := false, false
+	amounts := make([]float64, len(flows))
+	for i, f := range flows {
+		amounts[i], _ = f.amount.Float64()
+		hasIn = hasIn || f.amount.IsNegative()
+		hasOut = hasOut || f.amount.IsPositive()
+	}
+	if !hasIn || !hasOut {
+		return 0, false
+	}
+
+	t0 := flows[0].at
+	years := make([]float64, len(flows))
+	for i, f := range flows {
+		years[i] = f.at.Sub(t0).Hours() / 24 / 365
+	}
+	npv := func(r float64) (value, derivative float64) {
+		for i, amount := range amounts {
+			discount := math.Pow(1+r, -years[i])
+			value += amount * discount
+			derivative -= years[i] * amount * discount / (1 + r)
+		}
+		return value, derivative
+	}
+
+	r := 0.1
+	for i := 0; i < 100; i++ {
+		value, derivative := npv(r)
+		if math.Abs(value) < 1e-7 {
+			return r, true
+		}
+		if derivative == 0 {
+			break
+		}
+		next := r - value/derivative
+		if next <= -1 || math.IsNaN(next) || math.IsInf(next, 0) {
+			break
+		}
+		if math.Abs(next-r) < 1e-10 {
+			return next, true
+		}
+		r = next
+	}
+
+	// Newton diverged; bisect over a bracket that changes sign
+	lo, hi := -0.9999, 1.0
+	fLo, _ := npv(lo)
+	fHi, _ := npv(hi)
+	for fLo*fHi > 0 && hi < 1e6 {
+		hi *= 10
+		fHi, _ = npv(hi)
+	}
+	if fLo*fHi > 0 {
+		return 0, false
+	}
+	for i := 0; i < 200; i++ {
+		mid := (lo + hi) / 2
+		fMid, _ := npv(mid)
+		if math.Abs(fMid) < 1e-7 || (hi-lo)/2 < 1e-10 {
+			return mid, true
+		}
+		if fLo*fMid < 0 {
+			hi = mid
+		} else {
+			lo, fLo = mid, fMid
+		}
+	}
+	return (lo + hi) / 2, true
+}
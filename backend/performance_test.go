@@ -0,0 +1,148 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestXIRR(t *testing.T) {
+	t0 := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	d := decimal.RequireFromString
+	tests := []struct {
+		name  string
+		flows []cashFlow
+		want  float64
+		ok    bool
+	}{
+		{
+			name:  "ten percent over a year",
+			flows: []cashFlow{{t0, d("-1000")}, {t0.AddDate(0, 0, 365), d("1100")}},
+			want:  0.10, ok: true,
+		},
+		{
+			name:  "loss over a year",
+			flows: []cashFlow{{t0, d("-1000")}, {t0.AddDate(0, 0, 365), d("810")}},
+			want:  -0.19, ok: true,
+		},
+		{
+			name:  "two deposits",
+			flows: []cashFlow{{t0.AddDate(0, 0, 365), d("2200")}, {t0, d("-1000")}, {t0, d("-1000")}},
+			want:  0.10, ok: true,
+		},
+		{
+			name:  "nothing comes back",
+			flows: []cashFlow{{t0, d("-1000")}, {t0.AddDate(0, 1, 0), d("-100")}},
+		},
+		{
+			name:  "a single flow",
+			flows: []cashFlow{{t0, d("-1000")}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := xirr(tt.flows)
+			if ok != tt.ok {
+				t.Fatalf("ok = %v, want %v", ok, tt.ok)
+			}
+			if ok && math.Abs(got-tt.want) > 1e-6 {
+				t.Errorf("rate = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPeriodPerformance(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(0, 0, 10)
+	day := func(n int) time.Time { return start.AddDate(0, 0, n) }
+	d := decimal.RequireFromString
+	tests := []struct {
+		name       string
+		valuations []valuationPoint
+		flows      []cashFlow
+		start      time.Time
+		startValue string
+		netFlows   string
+		gain       string
+		twr        string
+		tooShort   bool
+	}{
+		{
+			name:       "growth without flows",
+			valuations: []valuationPoint{{day(-1), d("1000")}, {end, d("1200")}},
+			flows:      []cashFlow{{day(-30), d("1000")}},
+			start:      start, startValue: "1000", netFlows: "0", gain: "200", twr: "20",
+		},
+		{
+			// Modified Dietz: 500 in halfway weighs 250, so (1600-1000-500)/1250
+			name:       "deposit halfway",
+			valuations: []valuationPoint{{start, d("1000")}, {end, d("1600")}},
+			flows:      []cashFlow{{day(-30), d("1000")}, {day(5), d("500")}},
+			start:      start, startValue: "1000", netFlows: "500", gain: "100", twr: "8",
+		},
+		{
+			name:       "returns of sub-periods are linked",
+			valuations: []valuationPoint{{start, d("1000")}, {day(5), d("1100")}, {end, d("990")}},
+			flows:      []cashFlow{{day(-30), d("1000")}},
+			start:      start, startValue: "1000", netFlows: "0", gain: "-10", twr: "-1",
+		},
+		{
+			name:       "empty before the first deposit",
+			valuations: []valuationPoint{{end, d("1000")}},
+			flows:      []cashFlow{{day(2), d("1000")}},
+			start:      start, startValue: "0", netFlows: "1000", gain: "0", twr: "0",
+		},
+		{
+			name:       "starts at the first snapshot when none precedes the period",
+			valuations: []valuationPoint{{day(3), d("1000")}, {end, d("1100")}},
+			flows:      []cashFlow{{day(-30), d("1000")}},
+			start:      day(3), startValue: "1000", netFlows: "0", gain: "100", twr: "10",
+		},
+		{
+			// As when the current value is left out for lack of live quotes
+			name:       "no snapshot after the start",
+			valuations: []valuationPoint{{day(-5), d("1000")}},
+			flows:      []cashFlow{{day(-30), d("1000")}},
+			start:      start, tooShort: true,
+		},
+		{
+			name:       "no snapshot but the end",
+			valuations: []valuationPoint{{end, d("1100")}},
+			flows:      []cashFlow{{day(-30), d("1000")}},
+			start:      start, tooShort: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := periodPerformance("TEST", start, end, tt.valuations, tt.flows)
+			if got.HistoryTooShort != tt.tooShort {
+				t.Fatalf("history_too_short = %v, want %v", got.HistoryTooShort, tt.tooShort)
+			}
+			if !got.Start.Equal(tt.start) {
+				t.Errorf("start = %v, want %v", got.Start, tt.start)
+			}
+			if tt.tooShort {
+				if got.TWRPercent != nil || got.IRRPercent != nil {
+					t.Errorf("returns should be nil, got %v and %v", got.TWRPercent, got.IRRPercent)
+				}
+				return
+			}
+			for _, field := range []struct {
+				name      string
+				got, want decimal.Decimal
+			}{
+				{"start_value", got.StartValue, d(tt.startValue)},
+				{"net_flows", got.NetFlows, d(tt.netFlows)},
+				{"gain", got.Gain, d(tt.gain)},
+				{"twr_percent", *got.TWRPercent, d(tt.twr)},
+			} {
+				if !field.got.Equal(field.want) {
+					t.Errorf("%s = %s, want %s", field.name, field.got, field.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shopspring/decimal"
+)
+
+const defaultPortfolioSnapshotInterval = time.Hour
+
+// PortfolioSnapshot is a point on the equity curve.
+type PortfolioSnapshot struct {
+	ID              int             `json:"id"`
+	TotalValue      decimal.Decimal `json:"total_value"` // crypto + USDT
+	TotalCapital    decimal.Decimal `json:"total_capital"`
+	AvailableUSDT   decimal.Decimal `json:"available_usdt"`
+	TotalInvested   decimal.Decimal `json:"total_invested"`
+	CurrentValue    decimal.Decimal `json:"current_value"` // crypto only
+	UnrealizedPnL   decimal.Decimal `json:"unrealized_pnl"`
+	TotalPnL        decimal.Decimal `json:"total_pnl"`
+	TotalPnLPercent decimal.Decimal `json:"total_pnl_percent"`
+	Holdings        []HoldingDetail `json:"holdings,omitempty"`
+	NonLiveAssets   []string        `json:"non_live_assets"` // holdings valued without a live quote; empty for a reliable point
+	CreatedAt       time.Time       `json:"created_at"`
+}
+
+// portfolioSnapshotInterval reads PORTFOLIO_SNAPSHOT_INTERVAL as a Go
+// duration. Zero disables the snapshot job.
+func portfolioSnapshotInterval() (time.Duration, error) {
+	v := os.Getenv("PORTFOLIO_SNAPSHOT_INTERVAL")
+	if v == "" {
+		return defaultPortfolioSnapshotInterval, nil
+	}
+	interval, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid PORTFOLIO_SNAPSHOT_INTERVAL %q: %w", v, err)
+	}
+	return interval, nil
+}
+
+// runPortfolioSnapshotter stores the overview of every portfolio on each
+// tick.
+func runPortfolioSnapshotter(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		ids, err := portfolioIDs()
+		if err != nil {
+			log.Printf("Portfolio snapshot failed: %v", err)
+		}
+		for _, id := range ids {
+			if err := snapshotPortfolio(id); err != nil {
+				log.Printf("Portfolio %d snapshot failed: %v", id, err)
+			}
+		}
+		<-ticker.C
+	}
+}
+
+func portfolioIDs() ([]int, error) {
+	rows, err := db.Query("SELECT id FROM portfolios ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func snapshotPortfolio(portfolioID int) error {
+	overview, err := buildPortfolioOverview(portfolioID)
+	if err != nil {
+		return err
+	}
+
+	totalValue := overview.CurrentValue.Add(overview.AvailableUSDT)
+	// Nothing to record before the first deposit
+	if totalValue.IsZero() && overview.TotalCapital.IsZero() {
+		return nil
+	}
+
+	holdings, err := json.Marshal(overview.Holdings)
+	if err != nil {
+		return err
+	}
+	nonLive, err := json.Marshal(overview.NonLiveAssets)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO portfolio_snapshots
+			(portfolio_id, total_value, total_capital, available_usdt, total_invested, current_value, unrealized_pnl, total_pnl, total_pnl_percent, holdings, non_live_assets)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+	`, portfolioID, totalValue.String(), overview.TotalCapital.String(), overview.AvailableUSDT.String(), overview.TotalInvested.String(),
+		overview.CurrentValue.String(), overview.UnrealizedPnL.String(), overview.TotalPnL.String(),
+		overview.TotalPnLPercent.Round(8).String(), string(holdings), string(nonLive))
+	return err
+}
+
+// getPortfolioHistory returns the equity curve between from and to. With an
+// interval, only the last snapshot of each bucket is kept. Snapshots valued
+// without a live quote list those holdings in non_live_assets, and are left
+// out with live_only=true.
+func getPortfolioHistory(c *gin.Context) {
+	if !requireUSD(c) {
+		return
+	}
+	to, err := parseTimeParam(c.Query("to"), time.Now())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid to"})
+		return
+	}
+	from, err := parseTimeParam(c.Query("from"), to.AddDate(0, 0, -90))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid from"})
+		return
+	}
+
+	unit := ""
+	if interval := c.Query("interval"); interval != "" {
+		var ok bool
+		if unit, ok = candleIntervals[interval]; !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid interval, use 1h, 1d or 1w"})
+			return
+		}
+	}
+	includeHoldings := c.Query("holdings") == "true"
+	liveOnly := c.Query("live_only") == "true"
+
+	// An empty unit keeps every snapshot
+	rows, err := db.Query(`
+		SELECT DISTINCT ON (COALESCE(date_trunc(NULLIF($3, ''), created_at), created_at))
+			id, total_value, total_capital, available_usdt, total_invested, current_value,
+			unrealized_pnl, total_pnl, total_pnl_percent, holdings, non_live_assets, created_at
+		FROM portfolio_snapshots
+		WHERE created_at >= $1 AND created_at < $2 AND portfolio_id = $4 AND (NOT $5 OR non_live_assets = '[]')
+		ORDER BY COALESCE(date_trunc(NULLIF($3, ''), created_at), created_at), created_at DESC
+	`, from, to, unit, portfolioID(c), liveOnly)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	snapshots := []PortfolioSnapshot{}
+	for rows.Next() {
+		var s PortfolioSnapshot
+		var totalValue, totalCapital, availableUSDT, totalInvested, currentValue, unrealizedPnL, totalPnL, totalPnLPercent string
+		var holdings, nonLive []byte
+		if err := rows.Scan(&s.ID, &totalValue, &totalCapital, &availableUSDT, &totalInvested, &currentValue,
+			&unrealizedPnL, &totalPnL, &totalPnLPercent, &holdings, &nonLive, &s.CreatedAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		s.TotalValue, _ = decimal.NewFromString(totalValue)
+		s.TotalCapital, _ = decimal.NewFromString(totalCapital)
+		s.AvailableUSDT, _ = decimal.NewFromString(availableUSDT)
+		s.TotalInvested, _ = decimal.NewFromString(totalInvested)
+		s.CurrentValue, _ = decimal.NewFromString(currentValue)
+		s.UnrealizedPnL, _ = decimal.NewFromString(unrealizedPnL)
+		s.TotalPnL, _ = decimal.NewFromString(totalPnL)
+		s.TotalPnLPercent, _ = decimal.NewFromString(totalPnLPercent)
+		if err := json.Unmarshal(nonLive, &s.NonLiveAssets); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if includeHoldings {
+			if err := json.Unmarshal(holdings, &s.Holdings); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		snapshots = append(snapshots, s)
+	}
+
+	c.JSON(http.StatusOK, snapshots)
+}
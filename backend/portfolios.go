@@ -0,0 +1,345 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"github.com/shopspring/decimal"
+)
+
+// portfolioKey holds the portfolio a request works on in the gin context.
+const portfolioKey = "portfolio_id"
+
+// Portfolio scopes capitals, orders, holdings and the watchlist, e.g. one
+// per strategy. Each is created by a user, who can give others a role on it;
+// a user's oldest portfolio is their default, which routes outside
+// /api/portfolios/:id work on and which cannot be deleted.
+type Portfolio struct {
+	ID          int       `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	IsDefault   bool      `json:"is_default"`
+	Role        string    `json:"role"` // the requesting user's role
+	CreatedAt   time.Time `json:"created_at"`
+
+	userID int // creator
+}
+
+// PortfolioSummary is one portfolio's share of the aggregated overview.
+type PortfolioSummary struct {
+	Portfolio
+	TotalCapital    decimal.Decimal `json:"total_capital"`
+	TotalValue      decimal.Decimal `json:"total_value"` // crypto + USDT
+	TotalPnL        decimal.Decimal `json:"total_pnl"`
+	TotalPnLPercent decimal.Decimal `json:"total_pnl_percent"`
+	PercentOfTotal  decimal.Decimal `json:"percent_of_total"`
+}
+
+// withPortfolio scopes a route group to the portfolio in its path, with the
+// user's role on it. Portfolios the user has no role on are not found.
+func withPortfolio(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param(portfolioKey))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid portfolio id"})
+		return
+	}
+	role, err := portfolioRole(db, id, currentUser(c))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Portfolio not found"})
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Set(portfolioKey, id)
+	c.Set(roleKey, role)
+	c.Next()
+}
+
+// withDefaultPortfolio scopes the unprefixed routes to the user's default
+// portfolio.
+func withDefaultPortfolio(c *gin.Context) {
+	var id sql.NullInt64
+	if err := db.QueryRow("SELECT MIN(id) FROM portfolios WHERE user_id = $1", currentUser(c)).Scan(&id); err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !id.Valid {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Portfolio not found"})
+		return
+	}
+	c.Set(portfolioKey, int(id.Int64))
+	c.Set(roleKey, RoleOwner)
+	c.Next()
+}
+
+// portfolioID is the portfolio the request was scoped to.
+func portfolioID(c *gin.Context) int {
+	return c.GetInt(portfolioKey)
+}
+
+// scanPortfolio reads portfolioColumns, then any extra columns into extra.
+// IsDefault is whether it is its creator's default until viewedBy.
+func scanPortfolio(row interface{ Scan(...interface{}) error }, extra ...interface{}) (Portfolio, error) {
+	var p Portfolio
+	dest := append([]interface{}{&p.ID, &p.Name, &p.Description, &p.IsDefault, &p.CreatedAt, &p.userID}, extra...)
+	err := row.Scan(dest...)
+	return p, err
+}
+
+const portfolioColumns = `id, name, COALESCE(description, ''),
+	id = (SELECT MIN(d.id) FROM portfolios d WHERE d.user_id = portfolios.user_id), created_at, COALESCE(user_id, 0)`
+
+// viewedBy is the portfolio as seen by a user with the given role; it is
+// only their default if they created it.
+func (p Portfolio) viewedBy(userID int, role string) Portfolio {
+	p.IsDefault = p.IsDefault && p.userID == userID
+	p.Role = role
+	return p
+}
+
+// userPortfolios lists the portfolios a user has a role on, their default
+// first.
+func userPortfolios(userID int) ([]Portfolio, error) {
+	rows, err := db.Query(`
+		SELECT `+portfolioColumns+`,
+			(SELECT m.role FROM portfolio_members m WHERE m.portfolio_id = portfolios.id AND m.user_id = $1)
+		FROM portfolios
+		WHERE id IN (SELECT portfolio_id FROM portfolio_members WHERE user_id = $1)
+		ORDER BY user_id IS DISTINCT FROM $1, id
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	portfolios := []Portfolio{}
+	for rows.Next() {
+		var role string
+		p, err := scanPortfolio(rows, &role)
+		if err != nil {
+			return nil, err
+		}
+		portfolios = append(portfolios, p.viewedBy(userID, role))
+	}
+	return portfolios, rows.Err()
+}
+
+func getPortfolios(c *gin.Context) {
+	portfolios, err := userPortfolios(currentUser(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, portfolios)
+}
+
+func getPortfolio(c *gin.Context) {
+	p, err := scanPortfolio(db.QueryRow("SELECT "+portfolioColumns+" FROM portfolios WHERE id = $1", portfolioID(c)))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, p.viewedBy(currentUser(c), currentRole(c)))
+}
+
+// portfolioInput is the body of create and update requests.
+type portfolioInput struct {
+	Name        string  `json:"name"`
+	Description *string `json:"description"`
+}
+
+func createPortfolio(c *gin.Context) {
+	var input portfolioInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	input.Name = strings.TrimSpace(input.Name)
+	if input.Name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Name is required"})
+		return
+	}
+
+	// Start transaction
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	p, err := scanPortfolio(tx.QueryRow(
+		"INSERT INTO portfolios (user_id, name, description) VALUES ($1, $2, $3) RETURNING "+portfolioColumns,
+		currentUser(c), input.Name, input.Description,
+	))
+	if err != nil {
+		respondPortfolioWriteError(c, err)
+		return
+	}
+	if _, err = tx.Exec("INSERT INTO portfolio_members (portfolio_id, user_id, role) VALUES ($1, $2, $3)", p.ID, currentUser(c), RoleOwner); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, p.viewedBy(currentUser(c), RoleOwner))
+}
+
+func updatePortfolio(c *gin.Context) {
+	var input portfolioInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	input.Name = strings.TrimSpace(input.Name)
+
+	// Fields left out keep their value
+	p, err := scanPortfolio(db.QueryRow(`
+		UPDATE portfolios
+		SET name = COALESCE(NULLIF($2, ''), name), description = CASE WHEN $3 THEN $4 ELSE description END
+		WHERE id = $1
+		RETURNING `+portfolioColumns,
+		portfolioID(c), input.Name, input.Description != nil, input.Description,
+	))
+	if err != nil {
+		respondPortfolioWriteError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, p.viewedBy(currentUser(c), currentRole(c)))
+}
+
+// deletePortfolio removes an empty portfolio. Its watchlist, snapshots and
+// voided rows go with it; capitals, orders and transfers have to be voided or
+// reset first.
+func deletePortfolio(c *gin.Context) {
+	id := portfolioID(c)
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	p, err := scanPortfolio(tx.QueryRow("SELECT "+portfolioColumns+" FROM portfolios WHERE id = $1", id))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if p.IsDefault {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The default portfolio cannot be deleted"})
+		return
+	}
+
+	var inUse bool
+	err = tx.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM capitals WHERE portfolio_id = $1 AND voided_at IS NULL)
+			OR EXISTS (SELECT 1 FROM orders WHERE portfolio_id = $1 AND voided_at IS NULL)
+			OR EXISTS (SELECT 1 FROM journal_entries WHERE portfolio_id = $1)
+			OR EXISTS (SELECT 1 FROM transfers WHERE $1 IN (from_portfolio_id, to_portfolio_id) AND voided_at IS NULL)
+	`, id).Scan(&inUse)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if inUse {
+		c.JSON(http.StatusConflict, gin.H{"error": "Portfolio still has capitals, orders or transfers; reset it first"})
+		return
+	}
+
+	for _, query := range []string{
+		"DELETE FROM transfers WHERE $1 IN (from_portfolio_id, to_portfolio_id)",
+		"DELETE FROM orders WHERE portfolio_id = $1",
+		"DELETE FROM capitals WHERE portfolio_id = $1",
+		"DELETE FROM portfolios WHERE id = $1",
+	} {
+		if _, err = tx.Exec(query, id); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Portfolio deleted successfully"})
+}
+
+func respondPortfolioWriteError(c *gin.Context, err error) {
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		c.JSON(http.StatusConflict, gin.H{"error": "A portfolio with this name already exists"})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+}
+
+// getAggregateOverview values every portfolio the user created together,
+// with each one's share of the combined value. Portfolios shared with them
+// are left out.
+func getAggregateOverview(c *gin.Context) {
+	currency, rate, ok := requestCurrency(c)
+	if !ok {
+		return
+	}
+
+	all, err := userPortfolios(currentUser(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	var portfolios []Portfolio
+	var ids []int
+	for _, p := range all {
+		if p.userID == currentUser(c) {
+			portfolios = append(portfolios, p)
+			ids = append(ids, p.ID)
+		}
+	}
+
+	total, err := buildPortfolioOverview(ids...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	totalValue := total.CurrentValue.Add(total.AvailableUSDT)
+
+	summaries := make([]PortfolioSummary, 0, len(portfolios))
+	for _, p := range portfolios {
+		overview, err := buildPortfolioOverview(p.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		summary := PortfolioSummary{
+			Portfolio:       p,
+			TotalCapital:    overview.TotalCapital.Mul(rate),
+			TotalValue:      overview.CurrentValue.Add(overview.AvailableUSDT).Mul(rate),
+			TotalPnL:        overview.TotalPnL.Mul(rate),
+			TotalPnLPercent: overview.TotalPnLPercent,
+		}
+		if !totalValue.IsZero() {
+			summary.PercentOfTotal = overview.CurrentValue.Add(overview.AvailableUSDT).Div(totalValue).Mul(decimal.NewFromInt(100))
+		}
+		summaries = append(summaries, summary)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"overview":   total.inCurrency(currency, rate),
+		"portfolios": summaries,
+	})
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const defaultPriceCacheTTL = 60 * time.Second
+
+// cachedProvider wraps a PriceProvider with a shared per-symbol quote cache.
+// Concurrent requests for the same symbol share a single upstream call, and
+// all symbols missing from the cache are fetched in one batch request. Last
+// known quotes are kept past their TTL and served, marked "cached", when the
+// upstream is unavailable.
+type cachedProvider struct {
+	upstream PriceProvider
+	ttl      time.Duration
+
+	mu       sync.Mutex
+	entries  map[string]cachedQuote
+	inflight map[string]*quoteCall
+}
+
+type cachedQuote struct {
+	price     PriceData
+	fetchedAt time.Time
+}
+
+// quoteCall is an upstream batch request that other callers can wait on.
+type quoteCall struct {
+	done chan struct{}
+	err  error
+}
+
+func newCachedProvider(upstream PriceProvider, ttl time.Duration) *cachedProvider {
+	return &cachedProvider{
+		upstream: upstream,
+		ttl:      ttl,
+		entries:  make(map[string]cachedQuote),
+		inflight: make(map[string]*quoteCall),
+	}
+}
+
+// priceCacheTTL reads PRICE_CACHE_TTL as a Go duration ("30s", "2m").
+func priceCacheTTL() (time.Duration, error) {
+	v := os.Getenv("PRICE_CACHE_TTL")
+	if v == "" {
+		return defaultPriceCacheTTL, nil
+	}
+	ttl, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid PRICE_CACHE_TTL %q: %w", v, err)
+	}
+	return ttl, nil
+}
+
+func (p *cachedProvider) Name() string { return p.upstream.Name() }
+
+func (p *cachedProvider) Quote(symbol string) (PriceData, error) {
+	prices, err := p.Quotes([]string{symbol})
+	if price, ok := prices[symbol]; ok {
+		return price, nil
+	}
+	if err == nil {
+		err = fmt.Errorf("no quote for %s", symbol)
+	}
+	return PriceData{}, err
+}
+
+func (p *cachedProvider) Quotes(symbols []string) (map[string]PriceData, error) {
+	prices := make(map[string]PriceData, len(symbols))
+	now := time.Now()
+
+	p.mu.Lock()
+	var missing []string
+	waits := make(map[*quoteCall]struct{})
+	for _, s := range symbols {
+		if _, dup := prices[s]; dup {
+			continue
+		}
+		if e, ok := p.entries[s]; ok && now.Sub(e.fetchedAt) < p.ttl {
+			prices[s] = e.price
+			continue
+		}
+		if call, ok := p.inflight[s]; ok {
+			waits[call] = struct{}{}
+			continue
+		}
+		missing = append(missing, s)
+	}
+
+	var own *quoteCall
+	if len(missing) > 0 {
+		own = &quoteCall{done: make(chan struct{})}
+		for _, s := range missing {
+			p.inflight[s] = own
+		}
+	}
+	p.mu.Unlock()
+
+	var firstErr error
+	if own != nil {
+		fetched, err := p.upstream.Quotes(missing)
+
+		p.mu.Lock()
+		fetchedAt := time.Now()
+		for s, price := range fetched {
+			p.entries[s] = cachedQuote{price: price, fetchedAt: fetchedAt}
+		}
+		for _, s := range missing {
+			delete(p.inflight, s)
+		}
+		p.mu.Unlock()
+
+		own.err = err
+		close(own.done)
+		firstErr = err
+	}
+
+	for call := range waits {
+		<-call.done
+		if call.err != nil && firstErr == nil {
+			firstErr = call.err
+		}
+	}
+
+	// Collect everything that was fetched for us, by us or by someone else.
+	// If the upstream failed, fall back to the last known quote and mark it.
+	p.mu.Lock()
+	for _, s := range symbols {
+		if _, ok := prices[s]; ok {
+			continue
+		}
+		e, ok := p.entries[s]
+		if !ok {
+			continue
+		}
+		price := e.price
+		if e.fetchedAt.Before(now) && price.Source == PriceSourceLive {
+			price.Source = PriceSourceCached
+		}
+		prices[s] = price
+	}
+	p.mu.Unlock()
+
+	return prices, firstErr
+}
+
+// Listings always goes upstream, but the quotes it returns warm the cache.
+func (p *cachedProvider) Listings(limit int) ([]CoinListing, error) {
+	listings, err := p.upstream.Listings(limit)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	fetchedAt := time.Now()
+	for _, l := range listings {
+		p.entries[l.Quote.Symbol] = cachedQuote{price: l.Quote, fetchedAt: fetchedAt}
+	}
+	p.mu.Unlock()
+
+	return listings, nil
+}
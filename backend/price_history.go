@@ -0,0 +1,192 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shopspring/decimal"
+)
+
+const defaultPriceHistoryInterval = 5 * time.Minute
+
+// Candle is an OHLC bar built from recorded quotes.
+type Candle struct {
+	Time    time.Time       `json:"time"`
+	Open    decimal.Decimal `json:"open"`
+	High    decimal.Decimal `json:"high"`
+	Low     decimal.Decimal `json:"low"`
+	Close   decimal.Decimal `json:"close"`
+	Samples int             `json:"samples"`
+}
+
+// Candle intervals accepted by the history endpoint, mapped to date_trunc units.
+var candleIntervals = map[string]string{
+	"1h": "hour",
+	"1d": "day",
+	"1w": "week",
+}
+
+// priceHistoryInterval reads PRICE_HISTORY_INTERVAL as a Go duration. Zero
+// disables the ingester.
+func priceHistoryInterval() (time.Duration, error) {
+	v := os.Getenv("PRICE_HISTORY_INTERVAL")
+	if v == "" {
+		return defaultPriceHistoryInterval, nil
+	}
+	interval, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid PRICE_HISTORY_INTERVAL %q: %w", v, err)
+	}
+	return interval, nil
+}
+
+// runPriceIngester records a quote for every tracked asset on each tick.
+func runPriceIngester(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := recordPriceHistory(); err != nil {
+			log.Printf("Price history ingestion failed: %v", err)
+		}
+		<-ticker.C
+	}
+}
+
+func recordPriceHistory() error {
+	symbols, err := trackedSymbols()
+	if err != nil {
+		return err
+	}
+	if len(symbols) == 0 {
+		return nil
+	}
+
+	prices, err := fetchPrices(symbols)
+	if err != nil && len(prices) == 0 {
+		return err
+	}
+
+	for _, symbol := range symbols {
+		p, ok := prices[symbol]
+		// Only live quotes are history: a cached one was recorded when it
+		// was live, and a mock one is made up
+		if !ok || p.Source != PriceSourceLive {
+			continue
+		}
+		if _, err := db.Exec(
+			"INSERT INTO price_history (symbol, price, source) VALUES ($1, $2, $3)",
+			symbol, p.Price.String(), p.Source,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseTimeParam accepts RFC 3339 timestamps or plain YYYY-MM-DD dates.
+func parseTimeParam(value string, fallback time.Time) (time.Time, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", value, time.Local)
+}
+
+func getPriceHistory(c *gin.Context) {
+	symbol := c.Param("symbol")
+	currency, rate, ok := requestCurrency(c)
+	if !ok {
+		return
+	}
+
+	interval := c.DefaultQuery("interval", "1d")
+	unit, ok := candleIntervals[interval]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid interval, use 1h, 1d or 1w"})
+		return
+	}
+
+	to, err := parseTimeParam(c.Query("to"), time.Now())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid to"})
+		return
+	}
+	from, err := parseTimeParam(c.Query("from"), to.AddDate(0, 0, -30))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid from"})
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT bucket,
+			(array_agg(price ORDER BY recorded_at ASC))[1],
+			MAX(price),
+			MIN(price),
+			(array_agg(price ORDER BY recorded_at DESC))[1],
+			COUNT(*)
+		FROM (
+			SELECT date_trunc($2, recorded_at) AS bucket, price, recorded_at
+			FROM price_history
+			WHERE symbol = $1 AND source = 'live' AND recorded_at >= $3 AND recorded_at < $4
+		) samples
+		GROUP BY bucket
+		ORDER BY bucket
+	`, symbol, unit, from, to)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	candles := []Candle{}
+	for rows.Next() {
+		var candle Candle
+		var open, high, low, closePrice string
+		if err := rows.Scan(&candle.Time, &open, &high, &low, &closePrice, &candle.Samples); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		candle.Open, _ = decimal.NewFromString(open)
+		candle.High, _ = decimal.NewFromString(high)
+		candle.Low, _ = decimal.NewFromString(low)
+		candle.Close, _ = decimal.NewFromString(closePrice)
+		// FX history is not kept, so past candles use today's rate
+		candle.Open, candle.High = candle.Open.Mul(rate), candle.High.Mul(rate)
+		candle.Low, candle.Close = candle.Low.Mul(rate), candle.Close.Mul(rate)
+		candles = append(candles, candle)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"symbol":   symbol,
+		"interval": interval,
+		"from":     from,
+		"to":       to,
+		"currency": currency,
+		"candles":  candles,
+	})
+}
+
+// parseExecutedAt reads the optional time an order or capital entry actually
+// happened. It cannot be in the future.
+func parseExecutedAt(value string) (sql.NullTime, error) {
+	if value == "" {
+		return sql.NullTime{}, nil
+	}
+	t, err := parseTimeParam(value, time.Time{})
+	if err != nil {
+		return sql.NullTime{}, errors.New("invalid executed_at, use RFC 3339 or YYYY-MM-DD")
+	}
+	if t.After(time.Now()) {
+		return sql.NullTime{}, errors.New("executed_at cannot be in the future")
+	}
+	return sql.NullTime{Time: t, Valid: true}, nil
+}
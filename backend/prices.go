@@ -0,0 +1,370 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// PriceProvider is a source of market data. Handlers only talk to the
+// configured provider, never to a specific vendor.
+type PriceProvider interface {
+	// Name identifies the provider in logs and API responses.
+	Name() string
+	// Quote returns the latest quote for a single symbol.
+	Quote(symbol string) (PriceData, error)
+	// Quotes returns the latest quotes for several symbols in one upstream
+	// request. Symbols the provider does not know are omitted from the map.
+	Quotes(symbols []string) (map[string]PriceData, error)
+	// Listings returns the top coins by market cap, best ranked first.
+	Listings(limit int) ([]CoinListing, error)
+}
+
+// CoinListing is a single entry of a market cap ranking.
+type CoinListing struct {
+	Info  CoinInfo
+	Quote PriceData
+}
+
+var priceProvider PriceProvider
+
+// newPriceProvider builds the provider selected by PRICE_PROVIDER
+// ("cmc", "coingecko" or "mock"). When unset it keeps the historical
+// behaviour: CoinMarketCap if CMC_API_KEY is set, mock prices otherwise.
+func newPriceProvider() (PriceProvider, error) {
+	name := strings.ToLower(os.Getenv("PRICE_PROVIDER"))
+	if name == "" {
+		if os.Getenv("CMC_API_KEY") != "" {
+			name = "cmc"
+		} else {
+			name = "mock"
+		}
+	}
+
+	switch name {
+	case "cmc", "coinmarketcap":
+		return &cmcProvider{
+			apiKey:  os.Getenv("CMC_API_KEY"),
+			baseURL: envOrDefault("CMC_BASE_URL", "https://pro-api.coinmarketcap.com"),
+			client:  &http.Client{Timeout: 15 * time.Second},
+		}, nil
+	case "coingecko":
+		return &coinGeckoProvider{
+			apiKey:  os.Getenv("COINGECKO_API_KEY"),
+			baseURL: envOrDefault("COINGECKO_BASE_URL", "https://api.coingecko.com/api/v3"),
+			client:  &http.Client{Timeout: 15 * time.Second},
+		}, nil
+	case "mock":
+		return mockProvider{}, nil
+	default:
+		return nil, fmt.Errorf("unknown PRICE_PROVIDER %q", name)
+	}
+}
+
+// nonLivePricesAllowed reports whether ALLOW_NON_LIVE_PRICES lets orders
+// execute at cached or mock prices without a per-request override, which is
+// handy for local setups running on the mock provider.
+func nonLivePricesAllowed() bool {
+	allowed, _ := strconv.ParseBool(os.Getenv("ALLOW_NON_LIVE_PRICES"))
+	return allowed
+}
+
+func envOrDefault(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return strings.TrimRight(v, "/")
+	}
+	return fallback
+}
+
+// getJSON performs a GET request and decodes a JSON body into out, treating
+// any non-2xx status as an error.
+func getJSON(client *http.Client, rawURL string, headers map[string]string, out interface{}) error {
+	req, err := http.NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Accept", "application/json")
+	for k, v := range headers {
+		req.Header.Add(k, v)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("upstream returned %s", resp.Status)
+	}
+	return json.Unmarshal(body, out)
+}
+
+// CoinMarketCap
+
+// CMC API Response structures
+type CMCQuoteResponse struct {
+	Data map[string]CMCAsset `json:"data"`
+}
+
+type CMCAsset struct {
+	Symbol string   `json:"symbol"`
+	Quote  CMCQuote `json:"quote"`
+}
+
+type CMCQuote struct {
+	USD CMCPrice `json:"USD"`
+}
+
+type CMCPrice struct {
+	Price            float64 `json:"price"`
+	PercentChange1h  float64 `json:"percent_change_1h"`
+	PercentChange24h float64 `json:"percent_change_24h"`
+	PercentChange7d  float64 `json:"percent_change_7d"`
+	PercentChange30d float64 `json:"percent_change_30d"`
+}
+
+// CMC Listings response
+type CMCListingsResponse struct {
+	Data []CMCCoinData `json:"data"`
+}
+
+type CMCCoinData struct {
+	ID     int      `json:"id"`
+	Symbol string   `json:"symbol"`
+	Name   string   `json:"name"`
+	Quote  CMCQuote `json:"quote"`
+}
+
+type cmcProvider struct {
+	apiKey  string
+	baseURL string
+	client  *http.Client
+}
+
+func (p *cmcProvider) Name() string { return "cmc" }
+
+func (p *cmcProvider) headers() map[string]string {
+	return map[string]string{"X-CMC_PRO_API_KEY": p.apiKey}
+}
+
+func (p *cmcProvider) Quote(symbol string) (PriceData, error) {
+	prices, err := p.Quotes([]string{symbol})
+	if err != nil {
+		return PriceData{}, err
+	}
+	price, ok := prices[symbol]
+	if !ok {
+		return PriceData{}, fmt.Errorf("no quote for %s", symbol)
+	}
+	return price, nil
+}
+
+func (p *cmcProvider) Quotes(symbols []string) (map[string]PriceData, error) {
+	prices := make(map[string]PriceData)
+	if len(symbols) == 0 {
+		return prices, nil
+	}
+
+	// Without skip_invalid one unknown symbol fails the whole batch
+	endpoint := fmt.Sprintf("%s/v1/cryptocurrency/quotes/latest?symbol=%s&skip_invalid=true", p.baseURL, url.QueryEscape(strings.Join(symbols, ",")))
+	var cmcResp CMCQuoteResponse
+	if err := getJSON(p.client, endpoint, p.headers(), &cmcResp); err != nil {
+		return nil, err
+	}
+
+	for symbol, asset := range cmcResp.Data {
+		prices[symbol] = buildPriceData(symbol, asset.Quote.USD)
+	}
+	var unknown []string
+	for _, symbol := range symbols {
+		if _, ok := prices[symbol]; !ok {
+			unknown = append(unknown, symbol)
+		}
+	}
+	if len(unknown) > 0 {
+		log.Printf("cmc has no quote for %s", strings.Join(unknown, ", "))
+	}
+	return prices, nil
+}
+
+func (p *cmcProvider) Listings(limit int) ([]CoinListing, error) {
+	endpoint := fmt.Sprintf("%s/v1/cryptocurrency/listings/latest?limit=%d&convert=USD", p.baseURL, limit)
+	var cmcResp CMCListingsResponse
+	if err := getJSON(p.client, endpoint, p.headers(), &cmcResp); err != nil {
+		return nil, err
+	}
+
+	listings := make([]CoinListing, 0, len(cmcResp.Data))
+	for i, coin := range cmcResp.Data {
+		listings = append(listings, CoinListing{
+			Info: CoinInfo{
+				Symbol: coin.Symbol,
+				Name:   coin.Name,
+				Price:  decimal.NewFromFloat(coin.Quote.USD.Price),
+				Rank:   i + 1,
+			},
+			Quote: buildPriceData(coin.Symbol, coin.Quote.USD),
+		})
+	}
+	return listings, nil
+}
+
+// CoinGecko (and API-compatible servers)
+
+type coinGeckoProvider struct {
+	apiKey  string
+	baseURL string
+	client  *http.Client
+}
+
+type coinGeckoMarket struct {
+	Symbol           string  `json:"symbol"`
+	Name             string  `json:"name"`
+	CurrentPrice     float64 `json:"current_price"`
+	MarketCapRank    int     `json:"market_cap_rank"`
+	PercentChange1h  float64 `json:"price_change_percentage_1h_in_currency"`
+	PercentChange24h float64 `json:"price_change_percentage_24h_in_currency"`
+	PercentChange7d  float64 `json:"price_change_percentage_7d_in_currency"`
+	PercentChange30d float64 `json:"price_change_percentage_30d_in_currency"`
+}
+
+func (p *coinGeckoProvider) Name() string { return "coingecko" }
+
+func (p *coinGeckoProvider) headers() map[string]string {
+	if p.apiKey == "" {
+		return nil
+	}
+	return map[string]string{"x-cg-demo-api-key": p.apiKey}
+}
+
+func (p *coinGeckoProvider) markets(query url.Values) ([]coinGeckoMarket, error) {
+	query.Set("vs_currency", "usd")
+	query.Set("price_change_percentage", "1h,24h,7d,30d")
+	var markets []coinGeckoMarket
+	if err := getJSON(p.client, p.baseURL+"/coins/markets?"+query.Encode(), p.headers(), &markets); err != nil {
+		return nil, err
+	}
+	return markets, nil
+}
+
+func (m coinGeckoMarket) priceData() PriceData {
+	return buildPriceData(strings.ToUpper(m.Symbol), CMCPrice{
+		Price:            m.CurrentPrice,
+		PercentChange1h:  m.PercentChange1h,
+		PercentChange24h: m.PercentChange24h,
+		PercentChange7d:  m.PercentChange7d,
+		PercentChange30d: m.PercentChange30d,
+	})
+}
+
+func (p *coinGeckoProvider) Quote(symbol string) (PriceData, error) {
+	prices, err := p.Quotes([]string{symbol})
+	if err != nil {
+		return PriceData{}, err
+	}
+	price, ok := prices[symbol]
+	if !ok {
+		return PriceData{}, fmt.Errorf("no quote for %s", symbol)
+	}
+	return price, nil
+}
+
+func (p *coinGeckoProvider) Quotes(symbols []string) (map[string]PriceData, error) {
+	prices := make(map[string]PriceData)
+	if len(symbols) == 0 {
+		return prices, nil
+	}
+
+	query := url.Values{}
+	query.Set("symbols", strings.ToLower(strings.Join(symbols, ",")))
+	query.Set("order", "market_cap_desc")
+	markets, err := p.markets(query)
+	if err != nil {
+		return nil, err
+	}
+
+	// Several coins can share a ticker; results are ordered by market cap so
+	// the first match is the one users mean.
+	for _, m := range markets {
+		symbol := strings.ToUpper(m.Symbol)
+		if _, seen := prices[symbol]; !seen {
+			prices[symbol] = m.priceData()
+		}
+	}
+	return prices, nil
+}
+
+func (p *coinGeckoProvider) Listings(limit int) ([]CoinListing, error) {
+	query := url.Values{}
+	query.Set("order", "market_cap_desc")
+	query.Set("per_page", fmt.Sprintf("%d", limit))
+	query.Set("page", "1")
+	markets, err := p.markets(query)
+	if err != nil {
+		return nil, err
+	}
+
+	listings := make([]CoinListing, 0, len(markets))
+	for i, m := range markets {
+		quote := m.priceData()
+		listings = append(listings, CoinListing{
+			Info: CoinInfo{
+				Symbol: quote.Symbol,
+				Name:   m.Name,
+				Price:  quote.Price,
+				Rank:   i + 1,
+			},
+			Quote: quote,
+		})
+	}
+	return listings, nil
+}
+
+// Mock prices for offline development
+
+type mockProvider struct{}
+
+func (mockProvider) Name() string { return "mock" }
+
+func (mockProvider) Quote(symbol string) (PriceData, error) {
+	return getMockPrice(symbol), nil
+}
+
+func (mockProvider) Quotes(symbols []string) (map[string]PriceData, error) {
+	prices := make(map[string]PriceData, len(symbols))
+	for _, s := range symbols {
+		prices[s] = getMockPrice(s)
+	}
+	return prices, nil
+}
+
+func (mockProvider) Listings(limit int) ([]CoinListing, error) {
+	coins := getDefaultCoins()
+	quotes := getDefaultPrices()
+	listings := make([]CoinListing, 0, len(coins))
+	for i, coin := range coins {
+		if i >= limit {
+			break
+		}
+		quote := getMockPrice(coin.Symbol)
+		if i < len(quotes) {
+			quote = quotes[i]
+		}
+		listings = append(listings, CoinListing{Info: coin, Quote: quote})
+	}
+	return listings, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestCMCQuotes(t *testing.T) {
+	// Answers the way CoinMarketCap does: without skip_invalid an unknown
+	// symbol fails the request, with it the symbol is left out
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		known := map[string]string{
+			"BTC": `"BTC": {"symbol": "BTC", "quote": {"USD": {"price": 97000, "percent_change_24h": 2}}}`,
+			"ETH": `"ETH": {"symbol": "ETH", "quote": {"USD": {"price": 3400}}}`,
+		}
+		var data []string
+		for _, symbol := range strings.Split(r.URL.Query().Get("symbol"), ",") {
+			entry, ok := known[symbol]
+			if !ok {
+				if r.URL.Query().Get("skip_invalid") != "true" {
+					http.Error(w, `{"status": {"error_code": 400, "error_message": "Invalid value for \"symbol\""}}`, http.StatusBadRequest)
+					return
+				}
+				continue
+			}
+			data = append(data, entry)
+		}
+		w.Write([]byte(`{"data": {` + strings.Join(data, ",") + `}}`))
+	}))
+	defer server.Close()
+	p := &cmcProvider{baseURL: server.URL, client: server.Client()}
+
+	tests := []struct {
+		name    string
+		symbols []string
+		want    map[string]string
+	}{
+		{name: "known symbols", symbols: []string{"BTC", "ETH"}, want: map[string]string{"BTC": "97000", "ETH": "3400"}},
+		{name: "one invalid symbol", symbols: []string{"BTC", "NOTACOIN", "ETH"}, want: map[string]string{"BTC": "97000", "ETH": "3400"}},
+		{name: "only invalid symbols", symbols: []string{"NOTACOIN"}, want: map[string]string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prices, err := p.Quotes(tt.symbols)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(prices) != len(tt.want) {
+				t.Fatalf("got quotes for %d symbols, want %d", len(prices), len(tt.want))
+			}
+			for symbol, want := range tt.want {
+				price, ok := prices[symbol]
+				if !ok || !price.Price.Equal(decimal.RequireFromString(want)) || price.Source != PriceSourceLive {
+					t.Errorf("%s = %+v, want a live quote of %s", symbol, price, want)
+				}
+			}
+		})
+	}
+
+	if _, err := p.Quote("NOTACOIN"); err == nil || err.Error() != "no quote for NOTACOIN" {
+		t.Errorf("Quote of an invalid symbol: error = %v, want no quote for NOTACOIN", err)
+	}
+}
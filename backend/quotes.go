@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// quoteAssets are the assets orders can be priced and settled in. USDT is
+// cash; the others are held like any other asset, at cost.
+var quoteAssets = []string{"USDT", "USDC", "BTC", "ETH", "USD"}
+
+// parseQuoteAsset validates the quote asset of an order, USDT by default.
+func parseQuoteAsset(quote, asset string) (string, error) {
+	quote = strings.ToUpper(quote)
+	if quote == "" {
+		quote = "USDT"
+	}
+	supported := false
+	for _, q := range quoteAssets {
+		supported = supported || q == quote
+	}
+	switch {
+	case !supported:
+		return "", fmt.Errorf("quote_asset must be one of %s", strings.Join(quoteAssets, ", "))
+	case asset == "USDT":
+		return "", errors.New("USDT can only be the quote asset")
+	case asset == quote:
+		return "", fmt.Errorf("cannot trade %s against itself", asset)
+	}
+	return quote, nil
+}
+
+// parseOrderSize sizes an order priced at price in the quote asset from
+// amount or, without one, quoteTotal. Orders creating and editing both go
+// through it, so neither can record a zero or negative size or price.
+func parseOrderSize(amount, quoteTotal string, price decimal.Decimal) (decimal.Decimal, decimal.Decimal, error) {
+	if !price.IsPositive() {
+		return decimal.Zero, decimal.Zero, errors.New("price must be positive")
+	}
+	var a, total decimal.Decimal
+	var err error
+	switch {
+	case amount != "":
+		if a, err = decimal.NewFromString(amount); err != nil {
+			return a, total, errors.New("invalid amount")
+		}
+		total = a.Mul(price)
+	case quoteTotal != "":
+		if total, err = decimal.NewFromString(quoteTotal); err != nil {
+			return a, total, errors.New("invalid quote_total")
+		}
+		a = total.Div(price)
+	default:
+		return a, total, errors.New("either amount or quote_total (total_usdt for USDT orders) is required")
+	}
+	if !a.IsPositive() || !total.IsPositive() {
+		return a, total, errors.New("amount must be positive")
+	}
+	return a, total, nil
+}
+
+// parQuote prices fiat USD, which USDT tracks one to one and no crypto price
+// source quotes.
+func parQuote(symbol string) (PriceData, bool) {
+	if symbol != "USD" {
+		return PriceData{}, false
+	}
+	return PriceData{Symbol: symbol, Price: decimal.NewFromInt(1), Source: PriceSourceLive, AsOf: time.Now()}, true
+}
+
+// trade is what an order exchanged: amount of the asset for quoteTotal of
+// the quote asset, worth rate USDT per unit of the quote asset at the time.
+type trade struct {
+	orderID     int
+	portfolioID int
+	orderType   string
+	asset       string
+	quote       string
+	amount      decimal.Decimal
+	quoteTotal  decimal.Decimal
+	rate        decimal.Decimal
+	fee         tradeFee
+	at          time.Time
+}
+
+// total is the USDT value of the trade before fees.
+func (t trade) total() decimal.Decimal {
+	return t.quoteTotal.Mul(t.rate)
+}
+
+// disposed is what leaves the portfolio, fees included: the quote asset on a
+// buy, the asset on a sell.
+func (t trade) disposed() (string, decimal.Decimal) {
+	if t.orderType == "buy" {
+		return t.quote, t.quoteTotal.Add(t.fee.quote())
+	}
+	return t.asset, t.amount.Add(t.fee.base())
+}
+
+// acquired is what arrives, net of fees.
+func (t trade) acquired() (string, decimal.Decimal) {
+	if t.orderType == "buy" {
+		return t.asset, t.amount.Sub(t.fee.base())
+	}
+	return t.quote, t.quoteTotal.Sub(t.fee.quote())
+}
+
+// worth is the USDT value of the quote asset that changed hands net of
+// fees: the cost basis of what a buy acquires and the proceeds of what a
+// sell disposes. A buy paid in anything but USDT disposes of the quote asset
+// for this much.
+func (t trade) worth() decimal.Decimal {
+	if t.orderType == "buy" {
+		return t.quoteTotal.Add(t.fee.quote()).Mul(t.rate).Round(8)
+	}
+	return t.quoteTotal.Sub(t.fee.quote()).Mul(t.rate).Round(8)
+}
+
+// tradeColumns selects an order's trade for scanTrade. Orders from before
+// quote assets were USDT orders.
+const tradeColumns = `id, portfolio_id, type, asset, COALESCE(quote_asset, 'USDT'), amount, COALESCE(quote_total, total_usdt),
+	COALESCE(quote_rate, 1), fee, COALESCE(fee_asset, 'USDT'), created_at`
+
+// scanTrade reads tradeColumns, then any extra columns into extra.
+func scanTrade(row interface{ Scan(...interface{}) error }, extra ...interface{}) (trade, error) {
+	var t trade
+	var amount, quoteTotal, rate, fee string
+	dest := []interface{}{&t.orderID, &t.portfolioID, &t.orderType, &t.asset, &t.quote, &amount, &quoteTotal, &rate, &fee, &t.fee.Asset, &t.at}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return t, err
+	}
+	t.amount, _ = decimal.NewFromString(amount)
+	t.quoteTotal, _ = decimal.NewFromString(quoteTotal)
+	t.rate, _ = decimal.NewFromString(rate)
+	t.fee.Amount, _ = decimal.NewFromString(fee)
+	t.fee.Quote = t.quote
+	return t, nil
+}
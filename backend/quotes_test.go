@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestParseOrderSize(t *testing.T) {
+	d := decimal.RequireFromString
+	tests := []struct {
+		name, amount, total, price string
+		wantAmount, wantTotal      string
+		wantErr                    string
+	}{
+		{name: "from amount", amount: "0.5", price: "100", wantAmount: "0.5", wantTotal: "50"},
+		{name: "from total", total: "50", price: "100", wantAmount: "0.5", wantTotal: "50"},
+		{name: "amount wins over total", amount: "2", total: "50", price: "100", wantAmount: "2", wantTotal: "200"},
+		{name: "zero price", amount: "1", price: "0", wantErr: "price must be positive"},
+		{name: "negative price", total: "10", price: "-5", wantErr: "price must be positive"},
+		{name: "neither given", price: "100", wantErr: "either amount or quote_total (total_usdt for USDT orders) is required"},
+		{name: "unreadable amount", amount: "lots", price: "100", wantErr: "invalid amount"},
+		{name: "unreadable total", total: "lots", price: "100", wantErr: "invalid quote_total"},
+		{name: "zero amount", amount: "0", price: "100", wantErr: "amount must be positive"},
+		{name: "negative total", total: "-50", price: "100", wantErr: "amount must be positive"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			amount, total, err := parseOrderSize(tt.amount, tt.total, d(tt.price))
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !amount.Equal(d(tt.wantAmount)) || !total.Equal(d(tt.wantTotal)) {
+				t.Errorf("got %s for %s, want %s for %s", amount, total, tt.wantAmount, tt.wantTotal)
+			}
+		})
+	}
+}
+
+func TestParseQuoteAsset(t *testing.T) {
+	tests := []struct {
+		quote, asset, want string
+		wantErr            bool
+	}{
+		{quote: "", asset: "BTC", want: "USDT"},
+		{quote: "usdc", asset: "BTC", want: "USDC"},
+		{quote: "BTC", asset: "ETH", want: "BTC"},
+		{quote: "EUR", asset: "BTC", wantErr: true},
+		{quote: "BTC", asset: "BTC", wantErr: true},
+		{quote: "USDC", asset: "USDT", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseQuoteAsset(tt.quote, tt.asset)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseQuoteAsset(%q, %q) = %q, %v, want %q (error %v)", tt.quote, tt.asset, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,851 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"github.com/shopspring/decimal"
+)
+
+// replayTolerance absorbs the rounding of incremental updates to DECIMAL(20, 8).
+var replayTolerance = decimal.New(1, -6)
+
+// errReplayIssues means history contains events that cannot be applied.
+var errReplayIssues = errors.New("history cannot be replayed cleanly")
+
+// queryer is satisfied by both *sql.DB and *sql.Tx.
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// ReplayIssue is an event that could not be applied cleanly, such as a sell
+// of more than was held at the time.
+type ReplayIssue struct {
+	Event   string    `json:"event"` // "capital", "order" or "transfer"
+	ID      int       `json:"id"`
+	At      time.Time `json:"at"`
+	Message string    `json:"message"`
+}
+
+// HoldingDiff is a holding whose stored values disagree with the replay.
+type HoldingDiff struct {
+	Asset      string          `json:"asset"`
+	Stored     *Holding        `json:"stored"`      // nil when the row is missing
+	Replayed   *Holding        `json:"replayed"`    // nil when the row should not exist
+	AmountDiff decimal.Decimal `json:"amount_diff"` // stored - replayed
+	CostDiff   decimal.Decimal `json:"cost_diff"`   // stored - replayed
+}
+
+// replayEvent is a non-voided capital entry or order, or a transfer.
+type replayEvent struct {
+	kind        string // "capital", "order" or "transfer"
+	id          int
+	at          time.Time
+	portfolioID int // capital entries
+	capitalType string
+	amount      decimal.Decimal // capital entries
+	trade       trade           // orders
+	transfer    transfer        // transfers
+	lotMethod   string
+	lots        []LotSelection
+}
+
+// eventRank orders events at the same instant: capitals, then transfers,
+// then orders.
+var eventRank = map[string]int{"capital": 0, "transfer": 1, "order": 2}
+
+type replayLot struct {
+	id          int // assigned when saved
+	portfolioID int
+	orderID     int
+	transferID  int // the transfer that brought the lot in, if any
+	asset       string
+	amount      decimal.Decimal
+	remaining   decimal.Decimal
+	cost        decimal.Decimal
+	acquiredAt  time.Time
+}
+
+type replayDisposal struct {
+	lot       *replayLot
+	orderID   int
+	amount    decimal.Decimal
+	costBasis decimal.Decimal
+	proceeds  decimal.Decimal
+	at        time.Time
+}
+
+type replayRealized struct {
+	orderID   int
+	asset     string
+	amount    decimal.Decimal
+	proceeds  decimal.Decimal
+	costBasis decimal.Decimal
+	at        time.Time
+}
+
+// replayTransfer is the cost basis a replayed transfer moved.
+type replayTransfer struct {
+	transfer transfer
+	cost     decimal.Decimal
+}
+
+// replayState is everything derived from the capitals, orders and transfers
+// of a group of portfolios linked by transfers.
+type replayState struct {
+	portfolioIDs []int
+	holdings     map[int]map[string]*Holding // by portfolio, then asset
+	entries      []JournalEntry
+	lots         []*replayLot
+	disposals    []replayDisposal
+	realized     []replayRealized
+	transfers    []replayTransfer
+	issues       []ReplayIssue
+}
+
+// linkedPortfolios returns a portfolio and every portfolio connected to it
+// through transfers, directly or not. Their histories depend on each other,
+// so they are replayed together.
+func linkedPortfolios(q queryer, portfolioID int) ([]int, error) {
+	rows, err := q.Query(`
+		WITH RECURSIVE linked(id) AS (
+			SELECT $1::int
+			UNION
+			SELECT CASE WHEN t.from_portfolio_id = l.id THEN t.to_portfolio_id ELSE t.from_portfolio_id END
+			FROM transfers t
+			JOIN linked l ON l.id IN (t.from_portfolio_id, t.to_portfolio_id)
+			WHERE t.voided_at IS NULL
+		)
+		SELECT id FROM linked ORDER BY id
+	`, portfolioID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// loadReplayEvents reads the non-voided capitals and orders and the transfers of
+// the given portfolios in the order they are replayed: by time, then
+// eventRank at the same instant, then id.
+func loadReplayEvents(q queryer, portfolioIDs []int) ([]replayEvent, error) {
+	var events []replayEvent
+	ids := pq.Array(portfolioIDs)
+
+	rows, err := q.Query("SELECT id, portfolio_id, amount, type, created_at FROM capitals WHERE voided_at IS NULL AND portfolio_id = ANY($1)", ids)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		e := replayEvent{kind: "capital"}
+		var amount string
+		if err := rows.Scan(&e.id, &e.portfolioID, &amount, &e.capitalType, &e.at); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		e.amount, _ = decimal.NewFromString(amount)
+		events = append(events, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = q.Query(`
+		SELECT `+tradeColumns+`, COALESCE(lot_method, ''), lot_selections
+		FROM orders
+		WHERE voided_at IS NULL AND portfolio_id = ANY($1)
+	`, ids)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		e := replayEvent{kind: "order"}
+		var lots sql.NullString
+		if e.trade, err = scanTrade(rows, &e.lotMethod, &lots); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		e.id, e.at = e.trade.orderID, e.trade.at
+		if lots.Valid {
+			if err := json.Unmarshal([]byte(lots.String), &e.lots); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("order %d has unreadable lot selections: %w", e.id, err)
+			}
+		}
+		events = append(events, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = q.Query(`
+		SELECT `+transferColumns+`
+		FROM transfers
+		WHERE voided_at IS NULL AND (from_portfolio_id = ANY($1) OR to_portfolio_id = ANY($1))
+	`, ids)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		e := replayEvent{kind: "transfer"}
+		if e.transfer, err = scanTransfer(rows); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		e.id, e.at = e.transfer.id, e.transfer.at
+		events = append(events, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(events, func(i, j int) bool {
+		a, b := events[i], events[j]
+		if !a.at.Equal(b.at) {
+			return a.at.Before(b.at)
+		}
+		if a.kind != b.kind {
+			return eventRank[a.kind] < eventRank[b.kind]
+		}
+		return a.id < b.id
+	})
+	return events, nil
+}
+
+// replay derives holdings, lots and realized PnL from scratch. Problems are
+// collected as issues rather than stopping the replay.
+func replay(portfolioIDs []int, events []replayEvent) *replayState {
+	s := &replayState{portfolioIDs: portfolioIDs, holdings: make(map[int]map[string]*Holding)}
+	for _, id := range portfolioIDs {
+		s.holding(id, "USDT").AveragePrice = decimal.NewFromInt(1)
+	}
+
+	for _, e := range events {
+		switch e.kind {
+		case "capital":
+			s.applyCapital(e)
+		case "transfer":
+			s.applyTransfer(e)
+		default:
+			s.applyOrder(e)
+		}
+	}
+	return s
+}
+
+func (s *replayState) holding(portfolioID int, asset string) *Holding {
+	holdings, ok := s.holdings[portfolioID]
+	if !ok {
+		holdings = make(map[string]*Holding)
+		s.holdings[portfolioID] = holdings
+	}
+	h, ok := holdings[asset]
+	if !ok {
+		h = &Holding{Asset: asset}
+		holdings[asset] = h
+	}
+	return h
+}
+
+func (s *replayState) issue(e replayEvent, format string, args ...interface{}) {
+	s.issues = append(s.issues, ReplayIssue{Event: e.kind, ID: e.id, At: e.at, Message: fmt.Sprintf(format, args...)})
+}
+
+func (s *replayState) applyCapital(e replayEvent) {
+	// Manually recorded losses are bookkeeping only
+	if e.capitalType == "realized_loss" {
+		return
+	}
+	usdt := s.holding(e.portfolioID, "USDT")
+	usdt.Amount = usdt.Amount.Add(e.amount)
+	usdt.TotalCost = usdt.TotalCost.Add(e.amount)
+	if e.amount.IsNegative() && usdt.Amount.IsNegative() {
+		s.issue(e, "USDT balance goes negative (%s)", usdt.Amount)
+	}
+	s.entries = append(s.entries, capitalEntry(e.portfolioID, e.id, e.amount, e.at))
+}
+
+// applyOrder disposes of what an order paid or sold and acquires what it
+// received. USDT is cash; anything else is taken from and added to lots, and
+// disposing of it realizes PnL.
+func (s *replayState) applyOrder(e replayEvent) {
+	t := e.trade
+	if t.orderType != "buy" && t.orderType != "sell" {
+		s.issue(e, "Unknown order type %q", t.orderType)
+		return
+	}
+
+	outAsset, outQty := t.disposed()
+	out := s.holding(t.portfolioID, outAsset)
+	if out.Amount.LessThan(outQty) {
+		s.issue(e, "Insufficient %s balance: %s available, %s needed", outAsset, out.Amount, outQty)
+	}
+	cost := outQty
+	if outAsset != "USDT" {
+		cost = s.disposeLots(e).Round(8)
+	}
+	out.Amount = out.Amount.Sub(outQty)
+	out.TotalCost = out.TotalCost.Sub(cost)
+
+	inAsset, inQty := t.acquired()
+	in := s.holding(t.portfolioID, inAsset)
+	in.Amount = in.Amount.Add(inQty)
+	in.TotalCost = in.TotalCost.Add(t.worth())
+	updateAveragePrices(out, in)
+
+	if t.orderType == "buy" {
+		s.entries = append(s.entries, buyEntry(t, cost))
+	} else {
+		s.entries = append(s.entries, sellEntry(t, cost))
+	}
+	if inAsset != "USDT" {
+		s.lots = append(s.lots, &replayLot{
+			portfolioID: t.portfolioID,
+			orderID:     e.id,
+			asset:       inAsset,
+			amount:      inQty,
+			remaining:   inQty,
+			cost:        t.worth(),
+			acquiredAt:  e.at,
+		})
+	}
+	if outAsset != "USDT" {
+		s.realized = append(s.realized, replayRealized{
+			orderID:   e.id,
+			asset:     outAsset,
+			amount:    outQty,
+			proceeds:  t.worth(),
+			costBasis: cost,
+			at:        e.at,
+		})
+	}
+}
+
+// disposeLots consumes lots for what an order disposed of the way it was
+// executed and returns the cost basis that left. Sells from before lot tracking have no method
+// and were costed at the average, so they take an equal share of every lot.
+func (s *replayState) disposeLots(e replayEvent) decimal.Decimal {
+	asset, sold := e.trade.disposed()
+	open := s.openLots(e.trade.portfolioID, asset)
+	held := decimal.Zero
+	for _, l := range open {
+		held = held.Add(l.remaining)
+	}
+
+	method := e.lotMethod
+	if method == LotMethodSpecific {
+		if cost, ok := s.disposeSelected(e, open); ok {
+			return cost
+		}
+		method = defaultLotMethod()
+	}
+	sortLots(open, method)
+
+	cost := decimal.Zero
+	left := sold
+	for i, l := range open {
+		if !left.IsPositive() {
+			break
+		}
+		qty := decimal.Min(left, l.remaining)
+		if method == "" && i < len(open)-1 && held.IsPositive() {
+			qty = decimal.Min(qty, l.remaining.Mul(sold).Div(held))
+		}
+		cost = cost.Add(s.dispose(e, l, qty))
+		left = left.Sub(qty)
+	}
+	return cost
+}
+
+// openLots returns a portfolio's open lots of an asset, oldest acquisition
+// first.
+func (s *replayState) openLots(portfolioID int, asset string) []*replayLot {
+	var open []*replayLot
+	for _, l := range s.lots {
+		if l.portfolioID == portfolioID && l.asset == asset && l.remaining.IsPositive() {
+			open = append(open, l)
+		}
+	}
+	sort.SliceStable(open, func(i, j int) bool { return open[i].acquiredAt.Before(open[j].acquiredAt) })
+	return open
+}
+
+// sortLots puts open lots in the order method consumes them, matching
+// allocateLots.
+func sortLots(open []*replayLot, method string) {
+	switch method {
+	case LotMethodLIFO:
+		for i, j := 0, len(open)-1; i < j; i, j = i+1, j-1 {
+			open[i], open[j] = open[j], open[i]
+		}
+	case LotMethodHIFO:
+		sort.SliceStable(open, func(i, j int) bool {
+			return open[i].cost.Div(open[i].amount).GreaterThan(open[j].cost.Div(open[j].amount))
+		})
+	}
+}
+
+// lotKey identifies a lot across rebuilds: the buy behind it and the
+// transfer that last moved it, if any.
+type lotKey struct {
+	orderID    int
+	transferID int
+}
+
+func selectionKey(sel LotSelection) lotKey {
+	key := lotKey{orderID: *sel.OrderID}
+	if sel.TransferID != nil {
+		key.transferID = *sel.TransferID
+	}
+	return key
+}
+
+// disposeSelected applies the lots picked for a specific-identification
+// sell. It reports false, touching nothing, if the picks no longer fit.
+func (s *replayState) disposeSelected(e replayEvent, open []*replayLot) (decimal.Decimal, bool) {
+	byKey := make(map[lotKey]*replayLot, len(open))
+	for _, l := range open {
+		byKey[lotKey{l.orderID, l.transferID}] = l
+	}
+
+	taken := make(map[lotKey]decimal.Decimal)
+	total := decimal.Zero
+	for _, sel := range e.lots {
+		if sel.OrderID == nil || byKey[selectionKey(sel)] == nil {
+			s.issue(e, "Selected lot %d is no longer open; using %s", sel.LotID, defaultLotMethod())
+			return decimal.Zero, false
+		}
+		key := selectionKey(sel)
+		taken[key] = taken[key].Add(sel.Amount)
+		if taken[key].GreaterThan(byKey[key].remaining) {
+			s.issue(e, "Selected lot %d no longer has %s remaining; using %s", sel.LotID, sel.Amount, defaultLotMethod())
+			return decimal.Zero, false
+		}
+		total = total.Add(sel.Amount)
+	}
+	if _, sold := e.trade.disposed(); !total.Equal(sold) {
+		s.issue(e, "Selected lots total %s but the order disposes of %s; using %s", total, sold, defaultLotMethod())
+		return decimal.Zero, false
+	}
+
+	cost := decimal.Zero
+	for _, sel := range e.lots {
+		cost = cost.Add(s.dispose(e, byKey[selectionKey(sel)], sel.Amount))
+	}
+	return cost, true
+}
+
+func (s *replayState) dispose(e replayEvent, l *replayLot, qty decimal.Decimal) decimal.Decimal {
+	costBasis := l.cost.Mul(qty).Div(l.amount)
+	_, sold := e.trade.disposed()
+	l.remaining = l.remaining.Sub(qty)
+	s.disposals = append(s.disposals, replayDisposal{
+		lot:       l,
+		orderID:   e.id,
+		amount:    qty,
+		costBasis: costBasis,
+		proceeds:  qty.Mul(e.trade.worth()).Div(sold),
+		at:        e.at,
+	})
+	return costBasis
+}
+
+// applyTransfer moves an asset between portfolios at cost. Lots travel with
+// their acquisition date; the network fee is taken from the same lots and
+// its share of their cost is expensed.
+func (s *replayState) applyTransfer(e replayEvent) {
+	t := e.transfer
+	out := s.holding(t.fromPortfolioID, t.asset)
+	if out.Amount.LessThan(t.sent()) {
+		s.issue(e, "Insufficient %s balance: %s available, %s needed", t.asset, out.Amount, t.sent())
+	}
+	cost := t.sent()
+	if t.asset != "USDT" {
+		cost = s.moveLots(t).Round(8)
+	}
+	out.Amount = out.Amount.Sub(t.sent())
+	out.TotalCost = out.TotalCost.Sub(cost)
+
+	in := s.holding(t.toPortfolioID, t.asset)
+	in.Amount = in.Amount.Add(t.amount)
+	in.TotalCost = in.TotalCost.Add(cost.Sub(t.feeCost(cost)))
+	updateAveragePrices(out, in)
+
+	from, to := transferEntries(t, cost)
+	s.entries = append(s.entries, from, to)
+	s.transfers = append(s.transfers, replayTransfer{transfer: t, cost: cost})
+}
+
+// moveLots takes what a transfer sends from the sender's lots and opens the
+// received part as lots of the receiver. It returns the cost basis sent.
+func (s *replayState) moveLots(t transfer) decimal.Decimal {
+	open := s.openLots(t.fromPortfolioID, t.asset)
+	sortLots(open, t.lotMethod)
+
+	cost := decimal.Zero
+	left := t.sent()
+	for _, l := range open {
+		if !left.IsPositive() {
+			break
+		}
+		qty := decimal.Min(left, l.remaining)
+		taken := l.cost.Mul(qty).Div(l.amount)
+		l.remaining = l.remaining.Sub(qty)
+		cost = cost.Add(taken)
+		left = left.Sub(qty)
+
+		if amount, lotCost := t.received(qty, taken); amount.IsPositive() {
+			s.lots = append(s.lots, &replayLot{
+				portfolioID: t.toPortfolioID,
+				orderID:     l.orderID,
+				transferID:  t.id,
+				asset:       t.asset,
+				amount:      amount,
+				remaining:   amount,
+				cost:        lotCost,
+				acquiredAt:  l.acquiredAt,
+			})
+		}
+	}
+	return cost
+}
+
+// updateAveragePrices recomputes the average price of changed holdings.
+func updateAveragePrices(holdings ...*Holding) {
+	for _, h := range holdings {
+		if h.Asset != "USDT" && h.Amount.IsPositive() {
+			h.AveragePrice = h.TotalCost.Div(h.Amount)
+		}
+	}
+}
+
+// holdingList returns a portfolio's replayed holdings sorted by asset.
+func (s *replayState) holdingList(portfolioID int) []Holding {
+	holdings := make([]Holding, 0, len(s.holdings[portfolioID]))
+	for _, h := range s.holdings[portfolioID] {
+		holdings = append(holdings, *h)
+	}
+	sort.Slice(holdings, func(i, j int) bool { return holdings[i].Asset < holdings[j].Asset })
+	return holdings
+}
+
+// save replaces the portfolios' journal, lots, disposals and realized PnL
+// with the replay, and records what each transfer moved. Holdings follow
+// from the journal.
+func (s *replayState) save(tx *sql.Tx) error {
+	for _, query := range []string{
+		"DELETE FROM lot_disposals WHERE lot_id IN (SELECT id FROM tax_lots WHERE portfolio_id = ANY($1))",
+		"DELETE FROM realized_pnl WHERE order_id IN (SELECT id FROM orders WHERE portfolio_id = ANY($1))",
+		"DELETE FROM tax_lots WHERE portfolio_id = ANY($1)",
+		"DELETE FROM journal_entries WHERE portfolio_id = ANY($1)",
+	} {
+		if _, err := tx.Exec(query, pq.Array(s.portfolioIDs)); err != nil {
+			return err
+		}
+	}
+
+	for _, e := range s.entries {
+		if _, err := postEntry(tx, e); err != nil {
+			return err
+		}
+	}
+
+	for _, l := range s.lots {
+		err := tx.QueryRow(`
+			INSERT INTO tax_lots (order_id, transfer_id, portfolio_id, asset, amount, remaining, cost_basis, acquired_at)
+			VALUES ($1, NULLIF($2, 0), $3, $4, $5, $6, $7, $8)
+			RETURNING id
+		`, l.orderID, l.transferID, l.portfolioID, l.asset, l.amount.String(), l.remaining.String(), l.cost.String(), l.acquiredAt).Scan(&l.id)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, d := range s.disposals {
+		_, err := tx.Exec(`
+			INSERT INTO lot_disposals (lot_id, order_id, amount, cost_basis, proceeds, disposed_at)
+			VALUES ($1, $2, $3, $4, $5, $6)
+		`, d.lot.id, d.orderID, d.amount.String(), d.costBasis.String(), d.proceeds.String(), d.at)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, r := range s.realized {
+		_, err := tx.Exec(`
+			INSERT INTO realized_pnl (order_id, asset, amount, proceeds, cost_basis, pnl, created_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)
+		`, r.orderID, r.asset, r.amount.String(), r.proceeds.String(), r.costBasis.String(), r.proceeds.Sub(r.costBasis).String(), r.at)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, r := range s.transfers {
+		if err := r.transfer.recordCost(tx, r.cost); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadStoredHoldings reads a portfolio's holdings keyed by asset.
+func loadStoredHoldings(q queryer, portfolioID int) (map[string]Holding, error) {
+	rows, err := q.Query("SELECT asset, amount, average_price, total_cost FROM holdings WHERE portfolio_id = $1", portfolioID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	holdings := make(map[string]Holding)
+	for rows.Next() {
+		var h Holding
+		var amount, avgPrice, totalCost string
+		if err := rows.Scan(&h.Asset, &amount, &avgPrice, &totalCost); err != nil {
+			return nil, err
+		}
+		h.Amount, _ = decimal.NewFromString(amount)
+		h.AveragePrice, _ = decimal.NewFromString(avgPrice)
+		h.TotalCost, _ = decimal.NewFromString(totalCost)
+		holdings[h.Asset] = h
+	}
+	return holdings, rows.Err()
+}
+
+// diffHoldings compares a portfolio's stored holdings with its replay.
+// Empty rows on either side count as zero.
+func diffHoldings(stored map[string]Holding, replayed map[string]*Holding) []HoldingDiff {
+	assets := make(map[string]bool)
+	for asset := range stored {
+		assets[asset] = true
+	}
+	for asset := range replayed {
+		assets[asset] = true
+	}
+
+	diffs := []HoldingDiff{}
+	for asset := range assets {
+		diff := HoldingDiff{Asset: asset}
+		var have, want Holding
+		if h, ok := stored[asset]; ok {
+			have = h
+			diff.Stored = &h
+		}
+		if h, ok := replayed[asset]; ok {
+			want = *h
+			diff.Replayed = &want
+		}
+		diff.AmountDiff = have.Amount.Sub(want.Amount)
+		diff.CostDiff = have.TotalCost.Sub(want.TotalCost)
+
+		mismatch := diff.AmountDiff.Abs().GreaterThan(replayTolerance) || diff.CostDiff.Abs().GreaterThan(replayTolerance)
+		if want.Amount.IsPositive() && have.AveragePrice.Sub(want.AveragePrice).Abs().GreaterThan(replayTolerance) {
+			mismatch = true
+		}
+		if mismatch {
+			diffs = append(diffs, diff)
+		}
+	}
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].Asset < diffs[j].Asset })
+	return diffs
+}
+
+// replayLinked replays a portfolio together with the portfolios linked to it
+// by transfers.
+func replayLinked(q queryer, portfolioID int) (*replayState, error) {
+	ids, err := linkedPortfolios(q, portfolioID)
+	if err != nil {
+		return nil, err
+	}
+	events, err := loadReplayEvents(q, ids)
+	if err != nil {
+		return nil, err
+	}
+	return replay(ids, events), nil
+}
+
+// rebuildHoldings replays a portfolio's history, and that of the portfolios
+// it transferred with, inside tx and saves the result. It refuses, saving
+// nothing, when history cannot be replayed cleanly.
+func rebuildHoldings(tx *sql.Tx, portfolioID int) (*replayState, error) {
+	// Keep order and capital writes out while the books are rebuilt
+	if err := lockLedger(tx); err != nil {
+		return nil, err
+	}
+	state, err := replayLinked(tx, portfolioID)
+	if err != nil {
+		return nil, err
+	}
+	if len(state.issues) > 0 {
+		return state, errReplayIssues
+	}
+	return state, state.save(tx)
+}
+
+// verifyHoldings compares the stored holdings against a replay of capitals,
+// orders and transfers.
+func verifyHoldings(c *gin.Context) {
+	id := portfolioID(c)
+	state, err := replayLinked(db, id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	stored, err := loadStoredHoldings(db, id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	diffs := diffHoldings(stored, state.holdings[id])
+	issues := state.issues
+	if issues == nil {
+		issues = []ReplayIssue{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"in_sync":  len(diffs) == 0,
+		"diffs":    diffs,
+		"issues":   issues,
+		"replayed": state.holdingList(id),
+	})
+}
+
+// repairHoldings rewrites the journal, lots and realized PnL from a replay.
+// Portfolios linked by transfers are rebuilt too.
+func repairHoldings(c *gin.Context) {
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	if err = lockLedger(tx); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	stored, err := loadStoredHoldings(tx, portfolioID(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	state, err := rebuildHoldings(tx, portfolioID(c))
+	if err != nil {
+		if err == errReplayIssues {
+			c.JSON(http.StatusConflict, gin.H{"error": "History cannot be replayed cleanly; fix these entries first", "issues": state.issues})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"diffs":    diffHoldings(stored, state.holdings[portfolioID(c)]),
+		"holdings": state.holdingList(portfolioID(c)),
+		"message":  "Holdings rebuilt successfully",
+	})
+}
+
+// errBooksOutOfSync means the current holdings are not what history
+// replays to, so rebuilding after a change would also rewrite other balances.
+var errBooksOutOfSync = errors.New("holdings do not match history")
+
+// backdated reports whether an entry executed at executedAt lands before
+// the newest capital entry, live order or transfer of the portfolio or those
+// linked to it. If so, it also makes sure history replays cleanly to the
+// current holdings, since inserting it means rebuilding everything after it.
+func backdated(tx *sql.Tx, portfolioID int, executedAt sql.NullTime) (bool, error) {
+	if !executedAt.Valid {
+		return false, nil
+	}
+	ids, err := linkedPortfolios(tx, portfolioID)
+	if err != nil {
+		return false, err
+	}
+	var latest sql.NullTime
+	err = tx.QueryRow(`
+		SELECT GREATEST(
+			(SELECT MAX(created_at) FROM capitals WHERE voided_at IS NULL AND portfolio_id = ANY($1)),
+			(SELECT MAX(created_at) FROM orders WHERE voided_at IS NULL AND portfolio_id = ANY($1)),
+			(SELECT MAX(created_at) FROM transfers WHERE voided_at IS NULL AND (from_portfolio_id = ANY($1) OR to_portfolio_id = ANY($1)))
+		)
+	`, pq.Array(ids)).Scan(&latest)
+	if err != nil {
+		return false, err
+	}
+	if !latest.Valid || !executedAt.Time.Before(latest.Time) {
+		return false, nil
+	}
+	return true, checkBooksInSync(tx, portfolioID)
+}
+
+// checkBooksInSync makes sure the history of a portfolio and those linked
+// to it replays cleanly to their current holdings.
+func checkBooksInSync(tx *sql.Tx, portfolioID int) error {
+	state, err := replayLinked(tx, portfolioID)
+	if err != nil {
+		return err
+	}
+	if len(state.issues) > 0 {
+		return errBooksOutOfSync
+	}
+	for _, id := range state.portfolioIDs {
+		stored, err := loadStoredHoldings(tx, id)
+		if err != nil {
+			return err
+		}
+		if len(diffHoldings(stored, state.holdings[id])) > 0 {
+			return errBooksOutOfSync
+		}
+	}
+	return nil
+}
+
+// realizedPnLFor is the replayed realized PnL of a sell order.
+func (s *replayState) realizedPnLFor(orderID int) *decimal.Decimal {
+	for _, r := range s.realized {
+		if r.orderID == orderID {
+			pnl := r.proceeds.Sub(r.costBasis)
+			return &pnl
+		}
+	}
+	return nil
+}
+
+// respondRebuildError reports why a change to past entries was refused.
+func respondRebuildError(c *gin.Context, err error, state *replayState) {
+	switch {
+	case errors.Is(err, errBooksOutOfSync):
+		c.JSON(http.StatusConflict, gin.H{"error": "Holdings do not match history; check /api/holdings/verify and rebuild first"})
+	case errors.Is(err, errReplayIssues):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "This change would break later entries, such as leaving too little balance for them", "issues": state.issues})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
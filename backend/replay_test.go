@@ -0,0 +1,218 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestReplay(t *testing.T) {
+	d := decimal.RequireFromString
+	withFee := func(e replayEvent, fee string) replayEvent {
+		e.trade.fee.Amount = d(fee)
+		return e
+	}
+	tests := []struct {
+		name     string
+		events   []replayEvent
+		usdt     string
+		btc      string
+		btcCost  string
+		realized map[int]string // by sell order
+		issues   int
+	}{
+		{
+			name: "buy and sell with a fee",
+			events: []replayEvent{
+				depositEvent(1, 1, "1000", 0),
+				withFee(orderEvent(2, 1, "buy", "BTC", "0.5", "500", 1), "1"),
+				orderEvent(3, 1, "sell", "BTC", "0.25", "400", 2),
+			},
+			usdt: "899", btc: "0.25", btcCost: "250.5",
+			realized: map[int]string{3: "149.5"},
+		},
+		{
+			name: "recorded losses are bookkeeping only",
+			events: []replayEvent{
+				depositEvent(1, 1, "1000", 0),
+				{kind: "capital", id: 2, at: replayStart.AddDate(0, 0, 1), portfolioID: 1, capitalType: "realized_loss", amount: d("-300")},
+			},
+			usdt: "1000", btc: "0", btcCost: "0",
+		},
+		{
+			name: "buying more than the balance",
+			events: []replayEvent{
+				depositEvent(1, 1, "100", 0),
+				orderEvent(2, 1, "buy", "BTC", "1", "200", 1),
+			},
+			usdt: "-100", btc: "1", btcCost: "200",
+			issues: 1,
+		},
+		{
+			name: "withdrawing more than the balance",
+			events: []replayEvent{
+				depositEvent(1, 1, "100", 0),
+				depositEvent(2, 1, "-150", 1),
+			},
+			usdt: "-50", btc: "0", btcCost: "0",
+			issues: 1,
+		},
+		{
+			name: "unknown order type",
+			events: []replayEvent{
+				depositEvent(1, 1, "100", 0),
+				orderEvent(2, 1, "swap", "BTC", "1", "50", 1),
+			},
+			usdt: "100", btc: "0", btcCost: "0",
+			issues: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := replay([]int{1}, tt.events)
+			if len(s.issues) != tt.issues {
+				t.Fatalf("issues = %+v, want %d", s.issues, tt.issues)
+			}
+			usdt, btc := s.holding(1, "USDT"), s.holding(1, "BTC")
+			if !usdt.Amount.Equal(d(tt.usdt)) || !btc.Amount.Equal(d(tt.btc)) || !btc.TotalCost.Equal(d(tt.btcCost)) {
+				t.Errorf("holdings = %s USDT, %s BTC costing %s; want %s, %s costing %s",
+					usdt.Amount, btc.Amount, btc.TotalCost, tt.usdt, tt.btc, tt.btcCost)
+			}
+			if len(s.realized) != len(tt.realized) {
+				t.Fatalf("realized %d sells, want %d", len(s.realized), len(tt.realized))
+			}
+			for orderID, want := range tt.realized {
+				if got := s.realizedPnLFor(orderID); got == nil || !got.Equal(d(want)) {
+					t.Errorf("realized PnL of order %d = %v, want %s", orderID, got, want)
+				}
+			}
+		})
+	}
+}
+
+// TestReplayTransfer sends half a bitcoin, 0.1 of it as network fee, and
+// sells what arrived in the other portfolio.
+func TestReplayTransfer(t *testing.T) {
+	d := decimal.RequireFromString
+	move := replayEvent{kind: "transfer", id: 1, at: replayStart.AddDate(0, 0, 2), transfer: transfer{
+		id: 1, fromPortfolioID: 1, toPortfolioID: 2, asset: "BTC", amount: d("0.4"), fee: d("0.1"),
+		lotMethod: LotMethodFIFO, at: replayStart.AddDate(0, 0, 2),
+	}}
+	s := replay([]int{1, 2}, []replayEvent{
+		depositEvent(1, 1, "1000", 0),
+		orderEvent(2, 1, "buy", "BTC", "1", "1000", 1),
+		move,
+		orderEvent(3, 2, "sell", "BTC", "0.4", "600", 3),
+	})
+	if len(s.issues) != 0 {
+		t.Fatalf("issues = %+v", s.issues)
+	}
+
+	for _, tt := range []struct {
+		portfolioID          int
+		asset, amount, total string
+	}{
+		{1, "BTC", "0.5", "500"},
+		{1, "USDT", "0", "0"},
+		{2, "BTC", "0", "0"},
+		{2, "USDT", "600", "600"},
+	} {
+		h := s.holding(tt.portfolioID, tt.asset)
+		if !h.Amount.Equal(d(tt.amount)) || !h.TotalCost.Equal(d(tt.total)) {
+			t.Errorf("portfolio %d holds %s %s costing %s, want %s costing %s",
+				tt.portfolioID, h.Amount, tt.asset, h.TotalCost, tt.amount, tt.total)
+		}
+	}
+
+	if len(s.transfers) != 1 || !s.transfers[0].cost.Equal(d("500")) {
+		t.Fatalf("transfers = %+v, want one moving a cost of 500", s.transfers)
+	}
+	var moved *replayLot
+	for _, l := range s.lots {
+		if l.portfolioID == 2 {
+			moved = l
+		}
+	}
+	if moved == nil {
+		t.Fatal("no lot arrived in portfolio 2")
+	}
+	if moved.orderID != 2 || moved.transferID != 1 || !moved.amount.Equal(d("0.4")) ||
+		!moved.cost.Equal(d("400")) || !moved.acquiredAt.Equal(replayStart.AddDate(0, 0, 1)) {
+		t.Errorf("moved lot = %+v, want 0.4 BTC of order 2 costing 400, acquired when bought", moved)
+	}
+	// The fee's share of the cost is expensed, so the sale realizes 600 - 400
+	if got := s.realizedPnLFor(3); got == nil || !got.Equal(d("200")) {
+		t.Errorf("realized PnL = %v, want 200", got)
+	}
+}
+
+func TestDiffHoldings(t *testing.T) {
+	d := decimal.RequireFromString
+	holding := func(asset, amount, cost string) Holding {
+		h := Holding{Asset: asset, Amount: d(amount), TotalCost: d(cost)}
+		if h.Amount.IsPositive() {
+			h.AveragePrice = h.TotalCost.Div(h.Amount)
+		}
+		return h
+	}
+	replayed := func(holdings ...Holding) map[string]*Holding {
+		m := make(map[string]*Holding)
+		for i := range holdings {
+			m[holdings[i].Asset] = &holdings[i]
+		}
+		return m
+	}
+	tests := []struct {
+		name     string
+		stored   map[string]Holding
+		replayed map[string]*Holding
+		want     []string // assets that differ
+	}{
+		{
+			name:     "in sync",
+			stored:   map[string]Holding{"BTC": holding("BTC", "0.5", "500")},
+			replayed: replayed(holding("BTC", "0.5", "500")),
+		},
+		{
+			name:     "rounding within tolerance",
+			stored:   map[string]Holding{"BTC": holding("BTC", "0.5", "500.0000005")},
+			replayed: replayed(holding("BTC", "0.5", "500")),
+		},
+		{
+			name:     "amount beyond tolerance",
+			stored:   map[string]Holding{"BTC": holding("BTC", "0.50001", "500")},
+			replayed: replayed(holding("BTC", "0.5", "500")),
+			want:     []string{"BTC"},
+		},
+		{
+			name:     "cost beyond tolerance",
+			stored:   map[string]Holding{"BTC": holding("BTC", "0.5", "501"), "USDT": holding("USDT", "10", "10")},
+			replayed: replayed(holding("BTC", "0.5", "500"), holding("USDT", "10", "10")),
+			want:     []string{"BTC"},
+		},
+		{
+			name:     "missing and extra rows",
+			stored:   map[string]Holding{"ETH": holding("ETH", "1", "2000")},
+			replayed: replayed(holding("BTC", "0.5", "500")),
+			want:     []string{"BTC", "ETH"},
+		},
+		{
+			name:     "an emptied holding left as zero",
+			stored:   map[string]Holding{"BTC": holding("BTC", "0", "0")},
+			replayed: replayed(),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diffs := diffHoldings(tt.stored, tt.replayed)
+			if len(diffs) != len(tt.want) {
+				t.Fatalf("diffs = %+v, want %v", diffs, tt.want)
+			}
+			for i, diff := range diffs {
+				if diff.Asset != tt.want[i] {
+					t.Errorf("diff %d is for %s, want %s", i, diff.Asset, tt.want[i])
+				}
+			}
+		})
+	}
+}
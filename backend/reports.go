@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shopspring/decimal"
+)
+
+// CapitalGain is one disposal of (part of) a lot.
+type CapitalGain struct {
+	Asset       string          `json:"asset"`
+	Amount      decimal.Decimal `json:"amount"`
+	AcquiredAt  *time.Time      `json:"acquired_at"` // nil when the sale or the lot predates lot tracking
+	DisposedAt  time.Time       `json:"disposed_at"`
+	Proceeds    decimal.Decimal `json:"proceeds"`
+	CostBasis   decimal.Decimal `json:"cost_basis"`
+	Gain        decimal.Decimal `json:"gain"`
+	Term        string          `json:"term"` // "short", "long" or "unknown"
+	SellOrderID int             `json:"sell_order_id"`
+	LotID       *int            `json:"lot_id"`
+}
+
+// CapitalGainsReport lists every disposal in a tax year.
+type CapitalGainsReport struct {
+	Year            int             `json:"year"`
+	Disposals       []CapitalGain   `json:"disposals"`
+	TotalProceeds   decimal.Decimal `json:"total_proceeds"`
+	TotalCostBasis  decimal.Decimal `json:"total_cost_basis"`
+	ShortTermGain   decimal.Decimal `json:"short_term_gain"`
+	LongTermGain    decimal.Decimal `json:"long_term_gain"`
+	UnknownTermGain decimal.Decimal `json:"unknown_term_gain"`
+	TotalGain       decimal.Decimal `json:"total_gain"`
+	Currency        string          `json:"currency"` // always USD
+}
+
+// holdingTerm classifies a holding period: held more than one year is long-term.
+func holdingTerm(acquired, disposed time.Time) string {
+	if disposed.After(acquired.AddDate(1, 0, 0)) {
+		return "long"
+	}
+	return "short"
+}
+
+func getCapitalGainsReport(c *gin.Context) {
+	if !requireUSD(c) {
+		return
+	}
+	year := time.Now().Year()
+	if v := c.Query("year"); v != "" {
+		var err error
+		if year, err = strconv.Atoi(v); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid year"})
+			return
+		}
+	}
+
+	report, err := buildCapitalGainsReport(portfolioID(c), year)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if c.Query("format") == "csv" {
+		writeCapitalGainsCSV(c, report)
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+func buildCapitalGainsReport(portfolioID, year int) (CapitalGainsReport, error) {
+	report := CapitalGainsReport{Year: year, Disposals: []CapitalGain{}, Currency: "USD"}
+
+	rows, err := db.Query(`
+		SELECT l.asset, d.amount, l.acquired_at, l.order_id IS NULL, d.disposed_at, d.proceeds, d.cost_basis, d.order_id, l.id
+		FROM lot_disposals d
+		JOIN tax_lots l ON l.id = d.lot_id
+		WHERE EXTRACT(YEAR FROM d.disposed_at) = $1 AND l.portfolio_id = $2
+		ORDER BY d.disposed_at, d.id
+	`, year, portfolioID)
+	if err != nil {
+		return report, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var g CapitalGain
+		var amount, proceeds, costBasis string
+		var acquiredAt time.Time
+		var opening bool
+		var lotID int
+		if err := rows.Scan(&g.Asset, &amount, &acquiredAt, &opening, &g.DisposedAt, &proceeds, &costBasis, &g.SellOrderID, &lotID); err != nil {
+			return report, err
+		}
+		g.Amount, _ = decimal.NewFromString(amount)
+		g.Proceeds, _ = decimal.NewFromString(proceeds)
+		g.CostBasis, _ = decimal.NewFromString(costBasis)
+		g.Gain = g.Proceeds.Sub(g.CostBasis)
+		g.LotID = &lotID
+		g.dateLot(acquiredAt, opening)
+		report.Disposals = append(report.Disposals, g)
+	}
+	if err := rows.Err(); err != nil {
+		return report, err
+	}
+
+	// Sells, or parts of sells, that no lot covered still have to be filed
+	untracked, err := db.Query(`
+		SELECT r.asset,
+			r.amount - COALESCE(SUM(d.amount), 0),
+			o.created_at,
+			r.proceeds - COALESCE(SUM(d.proceeds), 0),
+			r.cost_basis - COALESCE(SUM(d.cost_basis), 0),
+			r.order_id
+		FROM realized_pnl r
+		JOIN orders o ON o.id = r.order_id
+		LEFT JOIN lot_disposals d ON d.order_id = r.order_id
+		WHERE EXTRACT(YEAR FROM o.created_at) = $1 AND o.portfolio_id = $2
+		GROUP BY r.id, o.created_at
+		HAVING r.amount - COALESCE(SUM(d.amount), 0) > 0
+		ORDER BY o.created_at
+	`, year, portfolioID)
+	if err != nil {
+		return report, err
+	}
+	defer untracked.Close()
+
+	for untracked.Next() {
+		var g CapitalGain
+		var amount, proceeds, costBasis string
+		if err := untracked.Scan(&g.Asset, &amount, &g.DisposedAt, &proceeds, &costBasis, &g.SellOrderID); err != nil {
+			return report, err
+		}
+		g.Amount, _ = decimal.NewFromString(amount)
+		g.Proceeds, _ = decimal.NewFromString(proceeds)
+		g.CostBasis, _ = decimal.NewFromString(costBasis)
+		g.Gain = g.Proceeds.Sub(g.CostBasis)
+		g.Term = "unknown"
+		report.Disposals = append(report.Disposals, g)
+	}
+	if err := untracked.Err(); err != nil {
+		return report, err
+	}
+
+	report.total()
+	return report, nil
+}
+
+// dateLot sets when the disposed lot was acquired and so the holding term.
+// Opening lots, opened for holdings that predate lot tracking, are dated at
+// the asset's first order only as a placeholder, so their term is unknown.
+func (g *CapitalGain) dateLot(acquiredAt time.Time, opening bool) {
+	if opening {
+		g.AcquiredAt = nil
+		g.Term = "unknown"
+		return
+	}
+	g.AcquiredAt = &acquiredAt
+	g.Term = holdingTerm(acquiredAt, g.DisposedAt)
+}
+
+// total sums the disposals, by term.
+func (r *CapitalGainsReport) total() {
+	for _, g := range r.Disposals {
+		r.TotalProceeds = r.TotalProceeds.Add(g.Proceeds)
+		r.TotalCostBasis = r.TotalCostBasis.Add(g.CostBasis)
+		r.TotalGain = r.TotalGain.Add(g.Gain)
+		switch g.Term {
+		case "long":
+			r.LongTermGain = r.LongTermGain.Add(g.Gain)
+		case "short":
+			r.ShortTermGain = r.ShortTermGain.Add(g.Gain)
+		default:
+			r.UnknownTermGain = r.UnknownTermGain.Add(g.Gain)
+		}
+	}
+}
+
+func writeCapitalGainsCSV(c *gin.Context, report CapitalGainsReport) {
+	c.Header("Content-Type", "text/csv")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=capital-gains-%d.csv", report.Year))
+	c.Status(http.StatusOK)
+
+	w := csv.NewWriter(c.Writer)
+	w.Write([]string{"Description", "Date Acquired", "Date Sold", "Proceeds", "Cost Basis", "Gain or Loss", "Term", "Sell Order", "Lot"})
+	for _, g := range report.Disposals {
+		acquired := "VARIOUS"
+		if g.AcquiredAt != nil {
+			acquired = g.AcquiredAt.Format("2006-01-02")
+		}
+		lot := ""
+		if g.LotID != nil {
+			lot = strconv.Itoa(*g.LotID)
+		}
+		w.Write([]string{
+			fmt.Sprintf("%s %s", g.Amount.String(), g.Asset),
+			acquired,
+			g.DisposedAt.Format("2006-01-02"),
+			g.Proceeds.StringFixed(2),
+			g.CostBasis.StringFixed(2),
+			g.Gain.StringFixed(2),
+			g.Term,
+			strconv.Itoa(g.SellOrderID),
+			lot,
+		})
+	}
+	w.Flush()
+}
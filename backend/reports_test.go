@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shopspring/decimal"
+)
+
+func TestHoldingTerm(t *testing.T) {
+	bought := time.Date(2023, 3, 15, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		sold time.Time
+		want string
+	}{
+		{bought.AddDate(0, 6, 0), "short"},
+		{bought.AddDate(1, 0, 0), "short"},
+		{bought.AddDate(1, 0, 1), "long"},
+	}
+	for _, tt := range tests {
+		if got := holdingTerm(bought, tt.sold); got != tt.want {
+			t.Errorf("sold %s: term = %s, want %s", tt.sold.Format("2006-01-02"), got, tt.want)
+		}
+	}
+}
+
+func TestCapitalGainsReportTerms(t *testing.T) {
+	d := decimal.RequireFromString
+	sold := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name       string
+		acquiredAt time.Time
+		opening    bool
+		gain       string
+		term       string
+	}{
+		{name: "bought this year", acquiredAt: sold.AddDate(0, -1, 0), gain: "10", term: "short"},
+		{name: "bought two years ago", acquiredAt: sold.AddDate(-2, 0, 0), gain: "100", term: "long"},
+		// Dated at an old order only as a placeholder, so the term is unknown
+		{name: "opening lot", acquiredAt: sold.AddDate(-3, 0, 0), opening: true, gain: "-5", term: "unknown"},
+	}
+
+	report := CapitalGainsReport{Year: 2024}
+	for _, tt := range tests {
+		g := CapitalGain{Asset: "BTC", Amount: d("0.1"), DisposedAt: sold, Proceeds: d("200"), Gain: d(tt.gain)}
+		g.CostBasis = g.Proceeds.Sub(g.Gain)
+		g.dateLot(tt.acquiredAt, tt.opening)
+		if g.Term != tt.term {
+			t.Errorf("%s: term = %s, want %s", tt.name, g.Term, tt.term)
+		}
+		if (g.AcquiredAt == nil) != tt.opening {
+			t.Errorf("%s: acquired_at = %v, want it set only for lots bought by an order", tt.name, g.AcquiredAt)
+		}
+		report.Disposals = append(report.Disposals, g)
+	}
+
+	report.total()
+	for _, field := range []struct {
+		name      string
+		got, want decimal.Decimal
+	}{
+		{"short_term_gain", report.ShortTermGain, d("10")},
+		{"long_term_gain", report.LongTermGain, d("100")},
+		{"unknown_term_gain", report.UnknownTermGain, d("-5")},
+		{"total_gain", report.TotalGain, d("105")},
+		{"total_proceeds", report.TotalProceeds, d("600")},
+	} {
+		if !field.got.Equal(field.want) {
+			t.Errorf("%s = %s, want %s", field.name, field.got, field.want)
+		}
+	}
+
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	writeCapitalGainsCSV(c, report)
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("CSV has %d lines, want a header and 3 disposals:\n%s", len(lines), w.Body.String())
+	}
+	if !strings.HasPrefix(lines[3], "0.1 BTC,VARIOUS,2024-06-01,") {
+		t.Errorf("opening lot row = %q, want it acquired VARIOUS", lines[3])
+	}
+	if !strings.HasPrefix(lines[2], "0.1 BTC,2022-06-01,2024-06-01,") {
+		t.Errorf("tracked lot row = %q, want its acquisition date", lines[2])
+	}
+}
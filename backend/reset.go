@@ -0,0 +1,662 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// resetConfirmationTTL is how long a reset preview's confirmation token can
+// be used.
+const resetConfirmationTTL = 10 * time.Minute
+
+// What a reset can void
+const (
+	ResetCapitals  = "capitals" // capital entries, withdrawals and realized losses
+	ResetOrders    = "orders"
+	ResetTransfers = "transfers"
+)
+
+// resetOptions narrows a reset. The zero value resets everything.
+type resetOptions struct {
+	Include []string `json:"include"` // ResetCapitals, ResetOrders and ResetTransfers; all when empty
+	Asset   string   `json:"asset"`   // only orders and transfers of this asset
+	From    string   `json:"from"`    // only what happened at or after from
+	To      string   `json:"to"`      // and before to
+}
+
+// resetFilter is a parsed resetOptions, applied through resetWhere.
+type resetFilter struct {
+	capitals, orders, transfers bool
+	asset                       string
+	from, to                    sql.NullTime
+}
+
+// ResetCounts is how many rows a reset voids, or a restore puts back.
+type ResetCounts struct {
+	Capitals  int `json:"capitals"`
+	Orders    int `json:"orders"`
+	Transfers int `json:"transfers"`
+}
+
+// changes records counts in the audit history, each as a change from zero.
+func (r ResetCounts) changes() auditChanges {
+	changes := auditChanges{}
+	changes.compare(ResetCapitals, "0", strconv.Itoa(r.Capitals))
+	changes.compare(ResetOrders, "0", strconv.Itoa(r.Orders))
+	changes.compare(ResetTransfers, "0", strconv.Itoa(r.Transfers))
+	return changes
+}
+
+func parseResetOptions(o resetOptions) (resetFilter, error) {
+	var f resetFilter
+	if len(o.Include) == 0 {
+		o.Include = []string{ResetCapitals, ResetOrders, ResetTransfers}
+	}
+	for _, kind := range o.Include {
+		switch strings.ToLower(kind) {
+		case ResetCapitals:
+			f.capitals = true
+		case ResetOrders:
+			f.orders = true
+		case ResetTransfers:
+			f.transfers = true
+		default:
+			return f, fmt.Errorf("invalid include %q, use capitals, orders or transfers", kind)
+		}
+	}
+
+	// Capitals are cash, so an asset reset leaves them alone
+	f.asset = strings.ToUpper(strings.TrimSpace(o.Asset))
+	if f.asset != "" {
+		f.capitals = false
+	}
+
+	for _, bound := range []struct {
+		name, value string
+		into        *sql.NullTime
+	}{{"from", o.From, &f.from}, {"to", o.To, &f.to}} {
+		if bound.value == "" {
+			continue
+		}
+		t, err := parseTimeParam(bound.value, time.Time{})
+		if err != nil {
+			return f, fmt.Errorf("invalid %s, use RFC 3339 or YYYY-MM-DD", bound.name)
+		}
+		*bound.into = sql.NullTime{Time: t, Valid: true}
+	}
+	if f.from.Valid && f.to.Valid && !f.from.Time.Before(f.to.Time) {
+		return f, errors.New("from must be before to")
+	}
+	if !f.capitals && !f.orders && !f.transfers {
+		return f, errors.New("nothing to reset: capitals are not reset by asset")
+	}
+	return f, nil
+}
+
+// args are the parameters of every resetWhere condition.
+func (f resetFilter) args(portfolioID int) []interface{} {
+	return []interface{}{portfolioID, f.asset, f.from, f.to}
+}
+
+// resetWhere selects what a reset voids in a table, with f.args.
+var resetWhere = map[string]string{
+	ResetCapitals:  "portfolio_id = $1 AND voided_at IS NULL AND $2 = ''" + resetTimeRange,
+	ResetOrders:    "portfolio_id = $1 AND voided_at IS NULL AND ($2 = '' OR asset = $2)" + resetTimeRange,
+	ResetTransfers: "$1 IN (from_portfolio_id, to_portfolio_id) AND voided_at IS NULL AND ($2 = '' OR asset = $2)" + resetTimeRange,
+}
+
+const resetTimeRange = " AND ($3::timestamp IS NULL OR created_at >= $3) AND ($4::timestamp IS NULL OR created_at < $4)"
+
+// includes reports whether the reset voids rows of table.
+func (f resetFilter) includes(table string) bool {
+	switch table {
+	case ResetCapitals:
+		return f.capitals
+	case ResetOrders:
+		return f.orders
+	default:
+		return f.transfers
+	}
+}
+
+// count is how many rows the reset would void.
+func (f resetFilter) count(tx *sql.Tx, portfolioID int) (ResetCounts, error) {
+	var counts ResetCounts
+	for table, into := range map[string]*int{ResetCapitals: &counts.Capitals, ResetOrders: &counts.Orders, ResetTransfers: &counts.Transfers} {
+		if !f.includes(table) {
+			continue
+		}
+		if err := tx.QueryRow("SELECT COUNT(*) FROM "+table+" WHERE "+resetWhere[table], f.args(portfolioID)...).Scan(into); err != nil {
+			return counts, err
+		}
+	}
+	return counts, nil
+}
+
+// counterparties returns the other portfolios of the transfers the reset
+// selects, whose history changes with them.
+func (f resetFilter) counterparties(q queryer, portfolioID int) ([]int, error) {
+	if !f.transfers {
+		return nil, nil
+	}
+	rows, err := q.Query(`
+		SELECT DISTINCT CASE WHEN from_portfolio_id = $1 THEN to_portfolio_id ELSE from_portfolio_id END AS other
+		FROM transfers
+		WHERE `+resetWhere[ResetTransfers]+`
+		ORDER BY other
+	`, f.args(portfolioID)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		if id != portfolioID {
+			ids = append(ids, id)
+		}
+	}
+	return ids, rows.Err()
+}
+
+// previewReset counts what a reset would void and issues the token that
+// confirms it.
+func previewReset(c *gin.Context) {
+	// No body resets everything
+	var input resetOptions
+	if err := c.ShouldBindJSON(&input); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	f, err := parseResetOptions(input)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	options, err := json.Marshal(input)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	counts, err := f.count(tx, portfolioID(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	// Refused now rather than once confirmed
+	counterparties, err := f.counterparties(tx, portfolioID(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !requireRoleOn(c, tx, RoleTrader, counterparties...) {
+		return
+	}
+
+	token, hash, err := newToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	var expiresAt time.Time
+	err = tx.QueryRow(`
+		INSERT INTO reset_confirmations (token_hash, portfolio_id, user_id, options, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING expires_at
+	`, hash, portfolioID(c), currentUser(c), string(options), time.Now().Add(resetConfirmationTTL)).Scan(&expiresAt)
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM reset_confirmations WHERE expires_at <= CURRENT_TIMESTAMP")
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"confirmation_token": token,
+		"expires_at":         expiresAt,
+		"would_void":         counts,
+	})
+}
+
+// resetAllData voids what a reset preview selected, once confirmed with its
+// token. A backup of the whole portfolio is written first, and the portfolio
+// and those it transferred with are replayed without the voided rows. Voiding
+// a transfer rewrites the other portfolio too, so it takes the trader role
+// there, as deleting the transfer would.
+func resetAllData(c *gin.Context) {
+	var input struct {
+		ConfirmationToken string `json:"confirmation_token"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil || input.ConfirmationToken == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "confirmation_token is required; get one from POST /reset/preview"})
+		return
+	}
+	id := portfolioID(c)
+
+	// Start transaction
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	// The token can only be used once, for the portfolio and user it was issued to
+	var options []byte
+	err = tx.QueryRow(`
+		DELETE FROM reset_confirmations
+		WHERE token_hash = $1 AND portfolio_id = $2 AND user_id = $3 AND expires_at > CURRENT_TIMESTAMP
+		RETURNING options
+	`, hashToken(input.ConfirmationToken), id, currentUser(c)).Scan(&options)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Confirmation token invalid or expired; preview the reset again"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	var o resetOptions
+	if err = json.Unmarshal(options, &o); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	f, err := parseResetOptions(o)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err = lockLedger(tx); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	// Replaying would silently overwrite books that drifted from history;
+	// counterparties are linked to the portfolio, so they are checked too
+	if err = checkBooksInSync(tx, id); err != nil {
+		respondRebuildError(c, err, nil)
+		return
+	}
+
+	counterparties, err := f.counterparties(tx, id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !requireRoleOn(c, tx, RoleTrader, counterparties...) {
+		return
+	}
+
+	backup, err := writeBackup(tx, id, currentUser(c), "reset")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	voided, err := f.void(tx, id, backup.ID)
+	if err == nil {
+		err = recordAudit(tx, currentUser(c), AuditEntityBackup, backup.ID, "reset", voided.changes(), "")
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Replay what is left; voided transfers may have unlinked counterparties
+	for _, pid := range append([]int{id}, counterparties...) {
+		if state, err := rebuildHoldings(tx, pid); err != nil {
+			if errors.Is(err, errReplayIssues) {
+				c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Portfolio %d cannot be replayed without the voided rows; narrow the reset", pid), "issues": state.issues})
+				return
+			}
+			respondRebuildError(c, err, state)
+			return
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"backup_id": backup.ID,
+		"voided":    voided,
+		"message":   fmt.Sprintf("Portfolio data has been reset; restore backup %d to undo", backup.ID),
+	})
+}
+
+// void marks what the reset selects as voided by backupID. The rows and
+// their edit history stay, for restoring the backup to bring back.
+func (f resetFilter) void(tx *sql.Tx, portfolioID, backupID int) (ResetCounts, error) {
+	var counts ResetCounts
+	args := append(f.args(portfolioID), backupID)
+	for table, into := range map[string]*int{ResetCapitals: &counts.Capitals, ResetOrders: &counts.Orders, ResetTransfers: &counts.Transfers} {
+		if !f.includes(table) {
+			continue
+		}
+		result, err := tx.Exec("UPDATE "+table+" SET voided_at = CURRENT_TIMESTAMP, reset_backup_id = $5 WHERE "+resetWhere[table], args...)
+		if err != nil {
+			return counts, err
+		}
+		n, _ := result.RowsAffected()
+		*into = int(n)
+	}
+	return counts, nil
+}
+
+// Backup is a full export of a portfolio: its capitals, orders (voided ones
+// included), transfers, edit history and watchlist. Holdings, lots and the
+// journal are left out, since they are replayed from these.
+type Backup struct {
+	ID          int             `json:"id"`
+	PortfolioID int             `json:"portfolio_id"`
+	Reason      string          `json:"reason"` // "reset" or "manual"
+	Counts      ResetCounts     `json:"counts"`
+	CreatedAt   time.Time       `json:"created_at"`
+	RestoredAt  *time.Time      `json:"restored_at"`
+	Data        json.RawMessage `json:"data,omitempty"`
+}
+
+const backupColumns = "id, portfolio_id, reason, capitals, orders, transfers, created_at, restored_at"
+
+func scanBackup(row interface{ Scan(...interface{}) error }, extra ...interface{}) (Backup, error) {
+	var b Backup
+	var restoredAt sql.NullTime
+	dest := append([]interface{}{&b.ID, &b.PortfolioID, &b.Reason, &b.Counts.Capitals, &b.Counts.Orders, &b.Counts.Transfers, &b.CreatedAt, &restoredAt}, extra...)
+	err := row.Scan(dest...)
+	b.RestoredAt = nullTimePtr(restoredAt)
+	return b, err
+}
+
+// writeBackup exports a portfolio into the backups table.
+func writeBackup(tx *sql.Tx, portfolioID, userID int, reason string) (Backup, error) {
+	return scanBackup(tx.QueryRow(`
+		INSERT INTO backups (portfolio_id, user_id, reason, data, capitals, orders, transfers)
+		SELECT $1, $2, $3, data,
+			jsonb_array_length(data->'capitals'), jsonb_array_length(data->'orders'), jsonb_array_length(data->'transfers')
+		FROM (SELECT jsonb_build_object(
+			'capitals', COALESCE((SELECT jsonb_agg(t ORDER BY t.id) FROM capitals t WHERE t.portfolio_id = $1), '[]'),
+			'orders', COALESCE((SELECT jsonb_agg(t ORDER BY t.id) FROM orders t WHERE t.portfolio_id = $1), '[]'),
+			'transfers', COALESCE((SELECT jsonb_agg(t ORDER BY t.id) FROM transfers t WHERE $1 IN (t.from_portfolio_id, t.to_portfolio_id)), '[]'),
+			'audit_history', COALESCE((SELECT jsonb_agg(t ORDER BY t.id) FROM audit_history t
+				WHERE (t.entity = 'order' AND t.entity_id IN (SELECT id FROM orders WHERE portfolio_id = $1))
+					OR (t.entity = 'capital' AND t.entity_id IN (SELECT id FROM capitals WHERE portfolio_id = $1))), '[]'),
+			'watchlist', COALESCE((SELECT jsonb_agg(t ORDER BY t.symbol) FROM watchlist t WHERE t.portfolio_id = $1), '[]')
+		) AS data) snapshot
+		RETURNING `+backupColumns,
+		portfolioID, userID, reason,
+	))
+}
+
+// getBackups lists the portfolio's backups, newest first, without their data.
+func getBackups(c *gin.Context) {
+	rows, err := db.Query("SELECT "+backupColumns+" FROM backups WHERE portfolio_id = $1 ORDER BY created_at DESC, id DESC", portfolioID(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	backups := []Backup{}
+	for rows.Next() {
+		b, err := scanBackup(rows)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		backups = append(backups, b)
+	}
+
+	c.JSON(http.StatusOK, backups)
+}
+
+// getBackup returns a backup with its data, e.g. to download it.
+func getBackup(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid backup id"})
+		return
+	}
+	var data []byte
+	b, err := scanBackup(db.QueryRow("SELECT "+backupColumns+", data FROM backups WHERE id = $1 AND portfolio_id = $2", id, portfolioID(c)), &data)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Backup not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	b.Data = data
+	c.JSON(http.StatusOK, b)
+}
+
+// createBackup exports the portfolio on demand.
+func createBackup(c *gin.Context) {
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	// A consistent export while orders and capitals are kept out
+	if err = lockLedger(tx); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	b, err := writeBackup(tx, portfolioID(c), currentUser(c), "manual")
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, b)
+}
+
+// restoreBackup puts back the capitals, orders and transfers its reset
+// voided, and those of the backup that are no longer there along with their
+// edit history, then replays every portfolio they belong to. Rows still
+// present, and anything recorded since the backup, are kept as they are.
+// Restored transfers take the trader role on their other portfolio.
+func restoreBackup(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid backup id"})
+		return
+	}
+
+	// Start transaction
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	var data []byte
+	err = tx.QueryRow("SELECT data FROM backups WHERE id = $1 AND portfolio_id = $2", id, portfolioID(c)).Scan(&data)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Backup not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err = lockLedger(tx); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	// Check before restoring: afterwards the replay would include the
+	// restored rows while the stored holdings do not
+	linked, err := backupPortfolios(tx, id, data)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	for _, pid := range append([]int{portfolioID(c)}, linked...) {
+		if err = checkBooksInSync(tx, pid); err != nil {
+			respondRebuildError(c, err, nil)
+			return
+		}
+	}
+
+	var restored ResetCounts
+	touched := map[int]bool{portfolioID(c): true}
+	for table, into := range map[string]*int{ResetCapitals: &restored.Capitals, ResetOrders: &restored.Orders, ResetTransfers: &restored.Transfers} {
+		if *into, err = restoreRows(tx, table, id, data, touched); err != nil {
+			if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23503" {
+				c.JSON(http.StatusConflict, gin.H{"error": "A portfolio the backup transferred with no longer exists"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	_, err = tx.Exec(`
+		INSERT INTO audit_history
+		SELECT * FROM jsonb_populate_recordset(NULL::audit_history, $1::jsonb->'audit_history')
+		ON CONFLICT DO NOTHING
+	`, string(data))
+	if err == nil {
+		err = recordAudit(tx, currentUser(c), AuditEntityBackup, id, "restore", restored.changes(), "")
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	portfolios := make([]int, 0, len(touched))
+	for pid := range touched {
+		portfolios = append(portfolios, pid)
+	}
+	sort.Ints(portfolios)
+	if !requireRoleOn(c, tx, RoleTrader, portfolios...) {
+		return
+	}
+	for _, pid := range portfolios {
+		if state, err := rebuildHoldings(tx, pid); err != nil {
+			if errors.Is(err, errReplayIssues) {
+				c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("History of portfolio %d cannot be replayed with the backup restored", pid), "issues": state.issues})
+				return
+			}
+			respondRebuildError(c, err, state)
+			return
+		}
+	}
+
+	if _, err = tx.Exec("UPDATE backups SET restored_at = CURRENT_TIMESTAMP WHERE id = $1", id); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"restored": restored, "message": "Backup restored successfully"})
+}
+
+// backupPortfolios returns the portfolios on either side of the transfers a
+// restore could bring back, which may not be linked to the backup's
+// portfolio any more.
+func backupPortfolios(q queryer, backupID int, data []byte) ([]int, error) {
+	rows, err := q.Query(`
+		SELECT from_portfolio_id, to_portfolio_id FROM jsonb_populate_recordset(NULL::transfers, $2::jsonb->'transfers')
+		UNION
+		SELECT from_portfolio_id, to_portfolio_id FROM transfers WHERE reset_backup_id = $1
+	`, backupID, string(data))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	seen := make(map[int]bool)
+	var ids []int
+	for rows.Next() {
+		var from, to int
+		if err := rows.Scan(&from, &to); err != nil {
+			return nil, err
+		}
+		for _, id := range []int{from, to} {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	sort.Ints(ids)
+	return ids, rows.Err()
+}
+
+// restoreRows un-voids the rows of table that the reset writing backupID
+// voided, and inserts those of the backup that are missing, keeping their
+// ids so the edit history still points at them. The portfolios of the rows
+// are added to touched.
+func restoreRows(tx *sql.Tx, table string, backupID int, data []byte, touched map[int]bool) (int, error) {
+	portfolios := "portfolio_id, portfolio_id"
+	if table == ResetTransfers {
+		portfolios = "from_portfolio_id, to_portfolio_id"
+	}
+	n := 0
+	for _, q := range []struct {
+		query string
+		arg   interface{}
+	}{
+		{"UPDATE " + table + " SET voided_at = NULL, reset_backup_id = NULL WHERE reset_backup_id = $1", backupID},
+		{"INSERT INTO " + table + " SELECT * FROM jsonb_populate_recordset(NULL::" + table + ", $1::jsonb->'" + table + "') ON CONFLICT DO NOTHING", string(data)},
+	} {
+		rows, err := tx.Query(q.query+" RETURNING "+portfolios, q.arg)
+		if err != nil {
+			return n, err
+		}
+		for rows.Next() {
+			var from, to int
+			if err := rows.Scan(&from, &to); err != nil {
+				rows.Close()
+				return n, err
+			}
+			touched[from], touched[to] = true, true
+			n++
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
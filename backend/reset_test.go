@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseResetOptions(t *testing.T) {
+	tests := []struct {
+		name                        string
+		options                     resetOptions
+		capitals, orders, transfers bool
+		asset                       string
+		wantErr                     string
+	}{
+		{name: "everything", capitals: true, orders: true, transfers: true},
+		{name: "some kinds", options: resetOptions{Include: []string{"Orders", "transfers"}}, orders: true, transfers: true},
+		{name: "an asset leaves capitals alone", options: resetOptions{Asset: " btc "}, orders: true, transfers: true, asset: "BTC"},
+		{name: "a time range", options: resetOptions{From: "2024-01-01", To: "2024-02-01T00:00:00Z"}, capitals: true, orders: true, transfers: true},
+		{name: "unknown kind", options: resetOptions{Include: []string{"holdings"}}, wantErr: `invalid include "holdings", use capitals, orders or transfers`},
+		{name: "unreadable from", options: resetOptions{From: "last week"}, wantErr: "invalid from, use RFC 3339 or YYYY-MM-DD"},
+		{name: "unreadable to", options: resetOptions{To: "01/02/2024"}, wantErr: "invalid to, use RFC 3339 or YYYY-MM-DD"},
+		{name: "from after to", options: resetOptions{From: "2024-02-01T00:00:00Z", To: "2024-01-01T00:00:00Z"}, wantErr: "from must be before to"},
+		{name: "empty range", options: resetOptions{From: "2024-01-01T00:00:00Z", To: "2024-01-01T00:00:00Z"}, wantErr: "from must be before to"},
+		{
+			name:    "only capitals of an asset",
+			options: resetOptions{Include: []string{ResetCapitals}, Asset: "ETH"},
+			wantErr: "nothing to reset: capitals are not reset by asset",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := parseResetOptions(tt.options)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for table, want := range map[string]bool{ResetCapitals: tt.capitals, ResetOrders: tt.orders, ResetTransfers: tt.transfers} {
+				if f.includes(table) != want {
+					t.Errorf("includes(%s) = %v, want %v", table, !want, want)
+				}
+			}
+			if f.asset != tt.asset {
+				t.Errorf("asset = %q, want %q", f.asset, tt.asset)
+			}
+			if f.from.Valid != (tt.options.From != "") || f.to.Valid != (tt.options.To != "") {
+				t.Errorf("range = %v to %v, want bounds for %q to %q", f.from, f.to, tt.options.From, tt.options.To)
+			}
+		})
+	}
+}
+
+func TestResetFilterArgs(t *testing.T) {
+	f, err := parseResetOptions(resetOptions{Asset: "sol", To: "2024-03-01T00:00:00Z"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := f.args(7)
+	if len(args) != 4 || args[0] != 7 || args[1] != "SOL" {
+		t.Fatalf("args = %v", args)
+	}
+	want := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	if to := f.to; !to.Valid || !to.Time.Equal(want) || f.from.Valid {
+		t.Errorf("range = %v to %v, want open to %v", f.from, f.to, want)
+	}
+}
+
+func TestResetCountsChanges(t *testing.T) {
+	changes := ResetCounts{Capitals: 2, Transfers: 1}.changes()
+	if len(changes) != 2 {
+		t.Fatalf("changes = %v, want capitals and transfers", changes)
+	}
+	if c := changes[ResetCapitals]; c.From != "0" || c.To != "2" {
+		t.Errorf("capitals = %+v, want 0 to 2", c)
+	}
+	if c := changes[ResetTransfers]; c.From != "0" || c.To != "1" {
+		t.Errorf("transfers = %+v, want 0 to 1", c)
+	}
+	if _, ok := changes[ResetOrders]; ok {
+		t.Error("orders should not be recorded when none changed")
+	}
+}
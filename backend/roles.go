@@ -0,0 +1,208 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Roles a user can hold on a portfolio
+const (
+	RoleOwner  = "owner"  // everything, including reset and managing members
+	RoleTrader = "trader" // records capitals, orders, transfers and the watchlist
+	RoleViewer = "viewer" // read-only
+)
+
+// roleRank orders the roles; each includes what the lower ones may do.
+var roleRank = map[string]int{
+	RoleViewer: 1,
+	RoleTrader: 2,
+	RoleOwner:  3,
+}
+
+// roleKey holds the user's role on the request's portfolio in the gin context.
+const roleKey = "role"
+
+// Member is a user with a role on a portfolio.
+type Member struct {
+	UserID    int       `json:"user_id"`
+	Email     string    `json:"email"`
+	Name      string    `json:"name"`
+	Role      string    `json:"role"`
+	IsCreator bool      `json:"is_creator"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// portfolioRole is the user's role on a portfolio, or sql.ErrNoRows when
+// they have none.
+func portfolioRole(q queryer, portfolioID, userID int) (string, error) {
+	rows, err := q.Query("SELECT role FROM portfolio_members WHERE portfolio_id = $1 AND user_id = $2", portfolioID, userID)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return "", err
+		}
+		return "", sql.ErrNoRows
+	}
+	var role string
+	err = rows.Scan(&role)
+	return role, err
+}
+
+// hasRole reports whether role allows what min does.
+func hasRole(role, min string) bool {
+	return roleRank[role] >= roleRank[min]
+}
+
+// requireRole lets a request through only if the user's role on the
+// portfolio is at least min.
+func requireRole(min string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !hasRole(currentRole(c), min) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Requires the " + min + " role on this portfolio"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// requireRoleOn checks the user's role on every portfolio a change writes
+// to besides the request's own, such as the other side of a transfer. It
+// responds and reports false when a role falls short.
+func requireRoleOn(c *gin.Context, q queryer, min string, portfolioIDs ...int) bool {
+	for _, id := range portfolioIDs {
+		role, err := portfolioRole(q, id, currentUser(c))
+		if err != nil && err != sql.ErrNoRows {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return false
+		}
+		if !hasRole(role, min) {
+			c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("Requires the %s role on portfolio %d", min, id)})
+			return false
+		}
+	}
+	return true
+}
+
+// currentRole is the user's role on the request's portfolio.
+func currentRole(c *gin.Context) string {
+	return c.GetString(roleKey)
+}
+
+// getMembers lists who has access to the portfolio.
+func getMembers(c *gin.Context) {
+	rows, err := db.Query(`
+		SELECT u.id, u.email, COALESCE(u.name, ''), m.role, p.user_id = u.id, m.created_at
+		FROM portfolio_members m
+		JOIN users u ON u.id = m.user_id
+		JOIN portfolios p ON p.id = m.portfolio_id
+		WHERE m.portfolio_id = $1
+		ORDER BY m.created_at, u.id
+	`, portfolioID(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	members := []Member{}
+	for rows.Next() {
+		var m Member
+		if err := rows.Scan(&m.UserID, &m.Email, &m.Name, &m.Role, &m.IsCreator, &m.CreatedAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		members = append(members, m)
+	}
+
+	c.JSON(http.StatusOK, members)
+}
+
+// assignMember gives a registered user a role on the portfolio, or changes
+// the role they have.
+func assignMember(c *gin.Context) {
+	var input struct {
+		Email string `json:"email" binding:"required"`
+		Role  string `json:"role" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	input.Role = strings.ToLower(input.Role)
+	if _, ok := roleRank[input.Role]; !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Role must be owner, trader or viewer"})
+		return
+	}
+
+	var userID int
+	err := db.QueryRow("SELECT id FROM users WHERE email = $1", strings.ToLower(strings.TrimSpace(input.Email))).Scan(&userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "No account with this email; ask them to register first"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if isPortfolioCreator(c, userID) {
+		return
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO portfolio_members (portfolio_id, user_id, role) VALUES ($1, $2, $3)
+		ON CONFLICT (portfolio_id, user_id) DO UPDATE SET role = EXCLUDED.role
+	`, portfolioID(c), userID, input.Role)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Member assigned successfully"})
+}
+
+// removeMember takes away a user's access to the portfolio.
+func removeMember(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("user_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user id"})
+		return
+	}
+	if isPortfolioCreator(c, userID) {
+		return
+	}
+
+	result, err := db.Exec("DELETE FROM portfolio_members WHERE portfolio_id = $1 AND user_id = $2", portfolioID(c), userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Member not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Member removed successfully"})
+}
+
+// isPortfolioCreator refuses changes to the role of the user who created the
+// portfolio, who always stays its owner.
+func isPortfolioCreator(c *gin.Context, userID int) bool {
+	var creator bool
+	if err := db.QueryRow("SELECT user_id = $2 FROM portfolios WHERE id = $1", portfolioID(c), userID).Scan(&creator); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return true
+	}
+	if creator {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The portfolio's creator is always an owner"})
+	}
+	return creator
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestHasRole(t *testing.T) {
+	tests := []struct {
+		role, min string
+		want      bool
+	}{
+		{RoleOwner, RoleOwner, true},
+		{RoleOwner, RoleViewer, true},
+		{RoleTrader, RoleTrader, true},
+		{RoleTrader, RoleOwner, false},
+		{RoleViewer, RoleViewer, true},
+		{RoleViewer, RoleTrader, false},
+		{"", RoleViewer, false},
+		{"admin", RoleViewer, false},
+	}
+	for _, tt := range tests {
+		if got := hasRole(tt.role, tt.min); got != tt.want {
+			t.Errorf("hasRole(%q, %q) = %v, want %v", tt.role, tt.min, got, tt.want)
+		}
+	}
+}
+
+// serveWith runs a request through handlers after setting the given context
+// values, as the auth and portfolio middleware would.
+func serveWith(values map[string]interface{}, handlers ...gin.HandlerFunc) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	handlers = append([]gin.HandlerFunc{func(c *gin.Context) {
+		for k, v := range values {
+			c.Set(k, v)
+		}
+	}}, handlers...)
+	handlers = append(handlers, func(c *gin.Context) { c.Status(http.StatusNoContent) })
+	r.GET("/", handlers...)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	return w
+}
+
+func TestRequireRole(t *testing.T) {
+	tests := []struct {
+		role, min string
+		want      int
+	}{
+		{RoleOwner, RoleOwner, http.StatusNoContent},
+		{RoleTrader, RoleTrader, http.StatusNoContent},
+		{RoleTrader, RoleViewer, http.StatusNoContent},
+		{RoleViewer, RoleTrader, http.StatusForbidden},
+		{RoleTrader, RoleOwner, http.StatusForbidden},
+		{"", RoleViewer, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		w := serveWith(map[string]interface{}{roleKey: tt.role}, requireRole(tt.min))
+		if w.Code != tt.want {
+			t.Errorf("%q on a %s route: status %d, want %d", tt.role, tt.min, w.Code, tt.want)
+		}
+	}
+}
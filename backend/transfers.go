@@ -0,0 +1,457 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shopspring/decimal"
+)
+
+// Transfer moves an asset between portfolios, or between wallets of one
+// portfolio, at cost. Capital contributed and realized PnL do not change;
+// the network fee, paid in the asset, is an expense of the sender.
+type Transfer struct {
+	ID              int             `json:"id"`
+	FromPortfolioID int             `json:"from_portfolio_id"`
+	ToPortfolioID   int             `json:"to_portfolio_id"`
+	FromWallet      string          `json:"from_wallet"`
+	ToWallet        string          `json:"to_wallet"`
+	Asset           string          `json:"asset"`
+	Amount          decimal.Decimal `json:"amount"` // received; amount + fee is sent
+	Fee             decimal.Decimal `json:"fee"`
+	LotMethod       string          `json:"lot_method"`
+	CostBasis       decimal.Decimal `json:"cost_basis"`   // moved to the receiver
+	FeeCost         decimal.Decimal `json:"fee_cost"`     // expensed by the sender
+	MarketValue     decimal.Decimal `json:"market_value"` // of the amount received, in USDT at the time
+	Description     string          `json:"description"`
+	CreatedAt       time.Time       `json:"created_at"`
+}
+
+// transfer is what the ledger and replay need of a transfer.
+type transfer struct {
+	id              int
+	fromPortfolioID int
+	toPortfolioID   int
+	asset           string
+	amount          decimal.Decimal
+	fee             decimal.Decimal
+	lotMethod       string
+	at              time.Time
+}
+
+// sent is what leaves the sender, network fee included.
+func (t transfer) sent() decimal.Decimal {
+	return t.amount.Add(t.fee)
+}
+
+// feeCost is the network fee's share of the cost basis sent.
+func (t transfer) feeCost(cost decimal.Decimal) decimal.Decimal {
+	if !t.fee.IsPositive() {
+		return decimal.Zero
+	}
+	return cost.Mul(t.fee).Div(t.sent()).Round(8)
+}
+
+// received scales a quantity taken from one lot, and its cost, down to what
+// arrives once the fee's share stays behind.
+func (t transfer) received(qty, cost decimal.Decimal) (decimal.Decimal, decimal.Decimal) {
+	return qty.Mul(t.amount).Div(t.sent()).Round(8), cost.Mul(t.amount).Div(t.sent()).Round(8)
+}
+
+// recordCost stores the cost basis a transfer moved, which changes when
+// history before it is rebuilt.
+func (t transfer) recordCost(tx *sql.Tx, cost decimal.Decimal) error {
+	cost = cost.Round(8)
+	feeCost := t.feeCost(cost)
+	_, err := tx.Exec("UPDATE transfers SET cost_basis = $2, fee_cost = $3 WHERE id = $1", t.id, cost.Sub(feeCost).String(), feeCost.String())
+	return err
+}
+
+// transferColumns selects a transfer for scanTransfer.
+const transferColumns = "id, from_portfolio_id, to_portfolio_id, asset, amount, fee, lot_method, created_at"
+
+func scanTransfer(row interface{ Scan(...interface{}) error }) (transfer, error) {
+	var t transfer
+	var amount, fee string
+	if err := row.Scan(&t.id, &t.fromPortfolioID, &t.toPortfolioID, &t.asset, &amount, &fee, &t.lotMethod, &t.at); err != nil {
+		return t, err
+	}
+	t.amount, _ = decimal.NewFromString(amount)
+	t.fee, _ = decimal.NewFromString(fee)
+	return t, nil
+}
+
+const transferListColumns = `id, from_portfolio_id, to_portfolio_id, COALESCE(from_wallet, ''), COALESCE(to_wallet, ''), asset, amount, fee,
+	lot_method, cost_basis, fee_cost, market_value, COALESCE(description, ''), created_at`
+
+func scanTransferRow(row interface{ Scan(...interface{}) error }) (Transfer, error) {
+	var t Transfer
+	var amount, fee, costBasis, feeCost, marketValue string
+	err := row.Scan(&t.ID, &t.FromPortfolioID, &t.ToPortfolioID, &t.FromWallet, &t.ToWallet, &t.Asset, &amount, &fee,
+		&t.LotMethod, &costBasis, &feeCost, &marketValue, &t.Description, &t.CreatedAt)
+	if err != nil {
+		return t, err
+	}
+	t.Amount, _ = decimal.NewFromString(amount)
+	t.Fee, _ = decimal.NewFromString(fee)
+	t.CostBasis, _ = decimal.NewFromString(costBasis)
+	t.FeeCost, _ = decimal.NewFromString(feeCost)
+	t.MarketValue, _ = decimal.NewFromString(marketValue)
+	return t, nil
+}
+
+// getTransfers lists the transfers into and out of the portfolio, newest
+// first.
+func getTransfers(c *gin.Context) {
+	rows, err := db.Query(`
+		SELECT `+transferListColumns+`
+		FROM transfers
+		WHERE (from_portfolio_id = $1 OR to_portfolio_id = $1) AND voided_at IS NULL
+		ORDER BY created_at DESC, id DESC
+	`, portfolioID(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	transfers := []Transfer{}
+	for rows.Next() {
+		t, err := scanTransferRow(rows)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		transfers = append(transfers, t)
+	}
+
+	c.JSON(http.StatusOK, transfers)
+}
+
+// createTransfer sends an asset from the portfolio to another portfolio or
+// wallet. Lots move with their acquisition date and cost, so the receiver
+// carries the sender's cost basis.
+func createTransfer(c *gin.Context) {
+	var input struct {
+		Asset  string `json:"asset" binding:"required"`
+		Amount string `json:"amount" binding:"required"` // what arrives
+		// Fee is the network fee in the asset, sent on top of amount
+		Fee string `json:"fee"`
+		// ToPortfolioID defaults to the sending portfolio, for moves between its wallets
+		ToPortfolioID int    `json:"to_portfolio_id"`
+		FromWallet    string `json:"from_wallet"`
+		ToWallet      string `json:"to_wallet"`
+		// LotMethod overrides LOT_METHOD for which lots are sent
+		LotMethod string `json:"lot_method"`
+		// Price values the transfer for performance figures, fetched when not given
+		Price       string `json:"price"`
+		Description string `json:"description"`
+		// ExecutedAt backdates the transfer (RFC 3339 or YYYY-MM-DD)
+		ExecutedAt string `json:"executed_at"`
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	t := transfer{fromPortfolioID: portfolioID(c), toPortfolioID: input.ToPortfolioID, asset: strings.ToUpper(input.Asset), fee: decimal.Zero}
+	if t.toPortfolioID == 0 {
+		t.toPortfolioID = t.fromPortfolioID
+	}
+	input.FromWallet = strings.TrimSpace(input.FromWallet)
+	input.ToWallet = strings.TrimSpace(input.ToWallet)
+	if t.toPortfolioID == t.fromPortfolioID && input.FromWallet == input.ToWallet {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A transfer needs another portfolio or a different wallet"})
+		return
+	}
+
+	var err error
+	if t.amount, err = decimal.NewFromString(input.Amount); err != nil || !t.amount.IsPositive() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid amount"})
+		return
+	}
+	if input.Fee != "" {
+		if t.fee, err = decimal.NewFromString(input.Fee); err != nil || t.fee.IsNegative() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid fee"})
+			return
+		}
+	}
+	if t.lotMethod, err = resolveLotMethod(input.LotMethod, nil); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	executedAt, err := parseExecutedAt(input.ExecutedAt)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Value what arrives, for cash flows in performance figures
+	price := decimal.NewFromInt(1)
+	switch {
+	case input.Price != "":
+		if price, err = decimal.NewFromString(input.Price); err != nil || !price.IsPositive() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid price"})
+			return
+		}
+	case t.asset == "USDT":
+	case executedAt.Valid:
+		// Today's quotes say nothing about a past transfer
+		c.JSON(http.StatusBadRequest, gin.H{"error": "price is required with executed_at"})
+		return
+	default:
+		priceData, err := fetchPrice(t.asset)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch price: " + err.Error()})
+			return
+		}
+		// The value is an external cash flow in performance figures, so a
+		// fake or stale quote would skew returns
+		if priceData.Source != PriceSourceLive {
+			c.JSON(http.StatusConflict, gin.H{
+				"error": fmt.Sprintf("No live price for %s (only a %s price from %s); give the transfer's price",
+					t.asset, priceData.Source, priceData.AsOf.Format(time.RFC3339)),
+			})
+			return
+		}
+		price = priceData.Price
+	}
+
+	// Start transaction
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	// The receiver is written to as well
+	role, err := portfolioRole(tx, t.toPortfolioID, currentUser(c))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Destination portfolio not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !hasRole(role, RoleTrader) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Requires the trader role on the destination portfolio"})
+		return
+	}
+
+	if err = lockLedger(tx); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	isBackdated, err := transferBackdated(tx, t, executedAt)
+	if err != nil {
+		respondRebuildError(c, err, nil)
+		return
+	}
+
+	// Cost basis of what is sent, and the lots it came from
+	cost := t.sent()
+	var disposals []lotDisposal
+	if !isBackdated {
+		var balanceStr, totalCostStr string
+		err = tx.QueryRow("SELECT amount, total_cost FROM holdings WHERE asset = $1 AND portfolio_id = $2", t.asset, t.fromPortfolioID).Scan(&balanceStr, &totalCostStr)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "No holdings for this asset"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		balance, _ := decimal.NewFromString(balanceStr)
+		if balance.LessThan(t.sent()) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Insufficient %s balance", t.asset)})
+			return
+		}
+		if t.asset != "USDT" {
+			totalCost, _ := decimal.NewFromString(totalCostStr)
+			if disposals, cost, err = allocateLots(tx, t.fromPortfolioID, t.asset, t.sent(), t.lotMethod, nil, balance, totalCost); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			cost = cost.Round(8)
+		}
+	}
+
+	// Insert transfer record
+	err = tx.QueryRow(`
+		INSERT INTO transfers (from_portfolio_id, to_portfolio_id, from_wallet, to_wallet, asset, amount, fee, lot_method, market_value, description, created_at)
+		VALUES ($1, $2, NULLIF($3, ''), NULLIF($4, ''), $5, $6, $7, $8, $9, NULLIF($10, ''), COALESCE($11, CURRENT_TIMESTAMP))
+		RETURNING id, created_at
+	`, t.fromPortfolioID, t.toPortfolioID, input.FromWallet, input.ToWallet, t.asset, t.amount.String(), t.fee.String(), t.lotMethod,
+		t.amount.Mul(price).Round(8).String(), input.Description, executedAt,
+	).Scan(&t.id, &t.at)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if isBackdated {
+		// Replay history so later entries of both sides see the transfer
+		if state, err := rebuildHoldings(tx, t.fromPortfolioID); err != nil {
+			respondRebuildError(c, err, state)
+			return
+		}
+	} else {
+		from, to := transferEntries(t, cost)
+		_, err = postEntry(tx, from)
+		if err == nil {
+			_, err = postEntry(tx, to)
+		}
+		if err == nil {
+			err = moveLots(tx, t, disposals)
+		}
+		if err == nil {
+			err = t.recordCost(tx, cost)
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	transferRow, err := scanTransferRow(tx.QueryRow("SELECT "+transferListColumns+" FROM transfers WHERE id = $1", t.id))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"transfer": transferRow, "message": "Transfer recorded successfully"})
+}
+
+// transferBackdated is backdated for both sides of a transfer. Rebuilding
+// replays both, so a side that is not backdated still has to be in sync.
+func transferBackdated(tx *sql.Tx, t transfer, executedAt sql.NullTime) (bool, error) {
+	sides := []int{t.fromPortfolioID, t.toPortfolioID}
+	checked := make(map[int]bool)
+	for _, id := range sides {
+		isBackdated, err := backdated(tx, id, executedAt)
+		if err != nil {
+			return false, err
+		}
+		checked[id] = isBackdated
+	}
+	if !checked[t.fromPortfolioID] && !checked[t.toPortfolioID] {
+		return false, nil
+	}
+	for _, id := range sides {
+		if !checked[id] {
+			if err := checkBooksInSync(tx, id); err != nil {
+				return false, err
+			}
+		}
+	}
+	return true, nil
+}
+
+// moveLots consumes the sender's allocated lots and opens what arrives as
+// lots of the receiver, keeping the buy and acquisition date behind each.
+func moveLots(tx *sql.Tx, t transfer, disposals []lotDisposal) error {
+	for _, d := range disposals {
+		if _, err := tx.Exec("UPDATE tax_lots SET remaining = remaining - $1 WHERE id = $2", d.amount.String(), d.lotID); err != nil {
+			return err
+		}
+		amount, cost := t.received(d.amount, d.costBasis)
+		if !amount.IsPositive() {
+			continue
+		}
+		_, err := tx.Exec(`
+			INSERT INTO tax_lots (order_id, transfer_id, portfolio_id, asset, amount, remaining, cost_basis, acquired_at)
+			VALUES ($1, $2, $3, $4, $5, $5, $6, $7)
+		`, d.orderID, t.id, t.toPortfolioID, t.asset, amount.String(), cost.String(), d.acquiredAt)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteTransfer voids a transfer and replays both sides without it. It
+// needs the trader role on both sides and is refused if the receiver has
+// since used what arrived.
+func deleteTransfer(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid transfer id"})
+		return
+	}
+
+	// Start transaction
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	if err = lockLedger(tx); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	t, err := scanTransfer(tx.QueryRow("SELECT "+transferColumns+" FROM transfers WHERE id = $1 AND $2 IN (from_portfolio_id, to_portfolio_id) AND voided_at IS NULL", id, portfolioID(c)))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Transfer not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	// Both sides are rewritten, whichever one the request came through
+	if !requireRoleOn(c, tx, RoleTrader, t.fromPortfolioID, t.toPortfolioID) {
+		return
+	}
+	if err = checkBooksInSync(tx, t.fromPortfolioID); err != nil {
+		respondRebuildError(c, err, nil)
+		return
+	}
+
+	// The row is kept; replaying both sides drops its journal entries and lots
+	if _, err = tx.Exec("UPDATE transfers SET voided_at = CURRENT_TIMESTAMP WHERE id = $1", id); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err = recordAudit(tx, currentUser(c), AuditEntityTransfer, id, "void", auditChanges{}, ""); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// The two sides may no longer be linked, so rebuild each
+	for _, portfolio := range []int{t.fromPortfolioID, t.toPortfolioID} {
+		if state, err := rebuildHoldings(tx, portfolio); err != nil {
+			if errors.Is(err, errReplayIssues) {
+				c.JSON(http.StatusConflict, gin.H{"error": "The transferred amount has been used since; delete what used it first", "issues": state.issues})
+				return
+			}
+			respondRebuildError(c, err, state)
+			return
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Transfer voided successfully"})
+}
@@ -13,7 +13,7 @@ import {
   ArrowUpRight,
   Coins
 } from 'lucide-react';
-import { getPortfolioOverview } from '@/lib/api';
+import { getPortfolioOverview, getToken, logout } from '@/lib/api';
 import { PortfolioOverview, ASSET_COLORS, HoldingDetail } from '@/lib/types';
 import { formatCurrency, formatPercent, isPositive, classNames } from '@/lib/utils';
 import StatCard from '@/components/StatCard';
@@ -26,6 +26,7 @@ import PricesTicker from '@/components/PricesTicker';
 import SettingsMenu from '@/components/SettingsMenu';
 import WithdrawModal from '@/components/WithdrawModal';
 import RealizedLossModal from '@/components/RealizedLossModal';
+import LoginModal from '@/components/LoginModal';
 
 // Portfolio Allocation Component with interactive donut chart
 function PortfolioAllocation({ 
@@ -158,6 +159,7 @@ export default function Dashboard() {
   const [loading, setLoading] = useState(true);
   const [error, setError] = useState('');
   const [refreshTrigger, setRefreshTrigger] = useState(0);
+  const [signedIn, setSignedIn] = useState(true);
 
   // Modal states
   const [showAddCapital, setShowAddCapital] = useState(false);
@@ -173,12 +175,23 @@ export default function Dashboard() {
   }, [refreshTrigger]);
 
   const fetchPortfolio = async () => {
+    if (!getToken()) {
+      setSignedIn(false);
+      setLoading(false);
+      return;
+    }
     try {
       setLoading(true);
       const data = await getPortfolioOverview();
       setPortfolio(data);
+      setError('');
     } catch (err) {
-      setError(err instanceof Error ? err.message : 'Failed to load portfolio');
+      // A rejected session clears the token
+      if (!getToken()) {
+        setSignedIn(false);
+      } else {
+        setError(err instanceof Error ? err.message : 'Failed to load portfolio');
+      }
     } finally {
       setLoading(false);
     }
@@ -188,6 +201,17 @@ export default function Dashboard() {
     setRefreshTrigger(prev => prev + 1);
   };
 
+  const handleSignIn = () => {
+    setSignedIn(true);
+    handleRefresh();
+  };
+
+  const handleSignOut = async () => {
+    await logout().catch(() => {});
+    setPortfolio(null);
+    setSignedIn(false);
+  };
+
   const handleAssetClick = (asset: string) => {
     setSelectedAsset(asset);
   };
@@ -232,6 +256,10 @@ export default function Dashboard() {
   const pieData = pieDataUnsorted.sort((a, b) => b.percent - a.percent);
   const totalValue = pieData.reduce((sum, d) => sum + d.value, 0);
 
+  if (!signedIn) {
+    return <LoginModal onSuccess={handleSignIn} />;
+  }
+
   return (
     <div className="min-h-screen pb-12">
       {/* Header */}
@@ -270,7 +298,7 @@ export default function Dashboard() {
                 <ArrowRightLeft size={18} />
                 <span className="hidden sm:inline">Trade</span>
               </button>
-              <SettingsMenu onReset={handleRefresh} onAddRealizedLoss={() => setShowRealizedLoss(true)} />
+              <SettingsMenu onReset={handleRefresh} onAddRealizedLoss={() => setShowRealizedLoss(true)} onSignOut={handleSignOut} />
             </div>
           </div>
         </div>
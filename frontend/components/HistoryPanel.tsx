@@ -38,7 +38,7 @@ export default function HistoryPanel({ refreshTrigger, onRefresh }: HistoryPanel
   };
 
   const handleDeleteCapital = async (id: number) => {
-    if (!confirm('Are you sure you want to delete this capital entry? This will also adjust your USDT balance.')) {
+    if (!confirm('Are you sure you want to void this capital entry? This will reverse it in your USDT balance.')) {
       return;
     }
     try {
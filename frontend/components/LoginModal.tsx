@@ -0,0 +1,114 @@
+'use client';
+
+import { useState } from 'react';
+import { Lock, Mail, User as UserIcon } from 'lucide-react';
+import { login, register } from '@/lib/api';
+
+interface LoginModalProps {
+  onSuccess: () => void;
+}
+
+export default function LoginModal({ onSuccess }: LoginModalProps) {
+  const [mode, setMode] = useState<'login' | 'register'>('login');
+  const [email, setEmail] = useState('');
+  const [password, setPassword] = useState('');
+  const [name, setName] = useState('');
+  const [loading, setLoading] = useState(false);
+  const [error, setError] = useState('');
+
+  const handleSubmit = async (e: React.FormEvent) => {
+    e.preventDefault();
+    setLoading(true);
+    setError('');
+
+    try {
+      if (mode === 'login') {
+        await login(email, password);
+      } else {
+        await register(email, password, name || undefined);
+      }
+      onSuccess();
+    } catch (err) {
+      setError(err instanceof Error ? err.message : 'Failed to sign in');
+    } finally {
+      setLoading(false);
+    }
+  };
+
+  return (
+    <div className="modal-overlay">
+      <div className="modal-content max-w-md">
+        <div className="flex items-center gap-3 mb-6">
+          <div className="p-2 rounded-xl bg-accent/10 text-accent">
+            <Lock size={24} />
+          </div>
+          <h2 className="text-xl font-semibold">{mode === 'login' ? 'Sign In' : 'Create Account'}</h2>
+        </div>
+
+        <form onSubmit={handleSubmit} className="space-y-5">
+          {mode === 'register' && (
+            <div>
+              <label className="block text-sm font-medium mb-2">
+                <UserIcon size={14} className="inline mr-1" />
+                Name (Optional)
+              </label>
+              <input
+                type="text"
+                value={name}
+                onChange={e => setName(e.target.value)}
+                className="input-field"
+              />
+            </div>
+          )}
+
+          <div>
+            <label className="block text-sm font-medium mb-2">
+              <Mail size={14} className="inline mr-1" />
+              Email
+            </label>
+            <input
+              type="email"
+              value={email}
+              onChange={e => setEmail(e.target.value)}
+              className="input-field"
+              required
+            />
+          </div>
+
+          <div>
+            <label className="block text-sm font-medium mb-2">
+              <Lock size={14} className="inline mr-1" />
+              Password
+            </label>
+            <input
+              type="password"
+              value={password}
+              onChange={e => setPassword(e.target.value)}
+              minLength={mode === 'register' ? 8 : undefined}
+              className="input-field"
+              required
+            />
+          </div>
+
+          {error && (
+            <div className="p-3 bg-danger/10 border border-danger/20 rounded-lg text-danger text-sm">
+              {error}
+            </div>
+          )}
+
+          <button type="submit" disabled={loading} className="btn-primary w-full disabled:opacity-50">
+            {loading ? 'Please wait...' : mode === 'login' ? 'Sign In' : 'Create Account'}
+          </button>
+
+          <button
+            type="button"
+            onClick={() => { setMode(mode === 'login' ? 'register' : 'login'); setError(''); }}
+            className="w-full text-sm text-muted-foreground hover:text-foreground transition-colors"
+          >
+            {mode === 'login' ? 'No account yet? Create one' : 'Already have an account? Sign in'}
+          </button>
+        </form>
+      </div>
+    </div>
+  );
+}
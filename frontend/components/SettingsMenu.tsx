@@ -1,19 +1,23 @@
 'use client';
 
 import { useState, useRef, useEffect } from 'react';
-import { Settings, Sun, Moon, Trash2, X, AlertTriangle, TrendingDown } from 'lucide-react';
+import { Settings, Sun, Moon, Trash2, X, AlertTriangle, TrendingDown, LogOut } from 'lucide-react';
 import { useTheme } from './ThemeProvider';
-import { resetAllData } from '@/lib/api';
+import { previewReset, resetAllData } from '@/lib/api';
+import { ResetPreview } from '@/lib/types';
 
 interface SettingsMenuProps {
   onReset: () => void;
   onAddRealizedLoss: () => void;
+  onSignOut: () => void;
 }
 
-export default function SettingsMenu({ onReset, onAddRealizedLoss }: SettingsMenuProps) {
+export default function SettingsMenu({ onReset, onAddRealizedLoss, onSignOut }: SettingsMenuProps) {
   const [isOpen, setIsOpen] = useState(false);
   const [showResetConfirm, setShowResetConfirm] = useState(false);
   const [resetting, setResetting] = useState(false);
+  const [preview, setPreview] = useState<ResetPreview | null>(null);
+  const [resetError, setResetError] = useState('');
   const { theme, toggleTheme } = useTheme();
   const menuRef = useRef<HTMLDivElement>(null);
 
@@ -27,15 +31,28 @@ export default function SettingsMenu({ onReset, onAddRealizedLoss }: SettingsMen
     return () => document.removeEventListener('mousedown', handleClickOutside);
   }, []);
 
+  // The preview counts what goes and issues the token that confirms the reset
+  const openResetConfirm = async () => {
+    setShowResetConfirm(true);
+    setPreview(null);
+    setResetError('');
+    try {
+      setPreview(await previewReset());
+    } catch (err) {
+      setResetError(err instanceof Error ? err.message : 'Failed to preview reset');
+    }
+  };
+
   const handleReset = async () => {
+    if (!preview) return;
     try {
       setResetting(true);
-      await resetAllData();
+      await resetAllData(preview.confirmation_token);
       setShowResetConfirm(false);
       setIsOpen(false);
       onReset();
     } catch (err) {
-      console.error('Failed to reset:', err);
+      setResetError(err instanceof Error ? err.message : 'Failed to reset');
     } finally {
       setResetting(false);
     }
@@ -87,12 +104,23 @@ export default function SettingsMenu({ onReset, onAddRealizedLoss }: SettingsMen
 
             {/* Reset Button */}
             <button
-              onClick={() => setShowResetConfirm(true)}
+              onClick={openResetConfirm}
               className="w-full flex items-center gap-3 px-3 py-2.5 hover:bg-danger/10 text-danger rounded-lg transition-colors"
             >
               <Trash2 size={18} />
               <span>Reset All Data</span>
             </button>
+
+            <div className="h-px bg-border my-2" />
+
+            {/* Sign Out Button */}
+            <button
+              onClick={() => { setIsOpen(false); onSignOut(); }}
+              className="w-full flex items-center gap-3 px-3 py-2.5 hover:bg-muted rounded-lg transition-colors"
+            >
+              <LogOut size={18} />
+              <span>Sign Out</span>
+            </button>
           </div>
         )}
       </div>
@@ -115,17 +143,21 @@ export default function SettingsMenu({ onReset, onAddRealizedLoss }: SettingsMen
             </div>
 
             <p className="text-muted-foreground mb-6">
-              Are you sure you want to reset all data? This will permanently delete:
+              Are you sure you want to reset all data? This will void:
             </p>
 
             <ul className="space-y-2 mb-6 ml-4">
               <li className="flex items-center gap-2 text-sm">
                 <span className="w-1.5 h-1.5 rounded-full bg-danger" />
-                All capital entries
+                {preview ? `${preview.would_void.capitals} capital entries` : 'All capital entries'}
+              </li>
+              <li className="flex items-center gap-2 text-sm">
+                <span className="w-1.5 h-1.5 rounded-full bg-danger" />
+                {preview ? `${preview.would_void.orders} trading orders` : 'All trading orders'}
               </li>
               <li className="flex items-center gap-2 text-sm">
                 <span className="w-1.5 h-1.5 rounded-full bg-danger" />
-                All trading orders
+                {preview ? `${preview.would_void.transfers} transfers` : 'All transfers'}
               </li>
               <li className="flex items-center gap-2 text-sm">
                 <span className="w-1.5 h-1.5 rounded-full bg-danger" />
@@ -134,9 +166,15 @@ export default function SettingsMenu({ onReset, onAddRealizedLoss }: SettingsMen
             </ul>
 
             <p className="text-sm text-muted-foreground mb-6">
-              This action cannot be undone.
+              A backup is saved first, so the reset can be undone by restoring it.
             </p>
 
+            {resetError && (
+              <div className="p-3 mb-6 bg-danger/10 border border-danger/20 rounded-lg text-danger text-sm">
+                {resetError}
+              </div>
+            )}
+
             <div className="flex gap-3">
               <button 
                 onClick={() => setShowResetConfirm(false)} 
@@ -146,7 +184,7 @@ export default function SettingsMenu({ onReset, onAddRealizedLoss }: SettingsMen
               </button>
               <button 
                 onClick={handleReset}
-                disabled={resetting}
+                disabled={resetting || !preview}
                 className="flex-1 bg-danger hover:bg-danger/90 text-white font-medium py-3 px-4 rounded-xl transition-colors disabled:opacity-50"
               >
                 {resetting ? 'Resetting...' : 'Yes, Reset Everything'}
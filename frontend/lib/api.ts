@@ -1,16 +1,36 @@
-import { Capital, Order, PortfolioOverview, PriceData, AssetDetail, Holding, CoinInfo, WatchlistItem } from './types';
+import { Capital, Order, PortfolioOverview, PriceData, AssetDetail, Holding, CoinInfo, WatchlistItem, LotMethod, TaxLot, HoldingDiff, HoldingsVerification, JournalEntry, TrialBalance, FieldChange, AuditRecord, QuoteAsset, Portfolio, AggregateOverview, Transfer, TransferInput, User, AuthSession, Role, PortfolioMember, APIToken, APITokenScope, ResetOptions, ResetCounts, ResetPreview, Backup, TradeExchange, TradeImportResult } from './types';
 
 const API_BASE = '/api';
+const TOKEN_KEY = 'session_token';
+
+// The session token is kept in localStorage and sent with every request.
+export function getToken(): string | null {
+  return typeof window === 'undefined' ? null : localStorage.getItem(TOKEN_KEY);
+}
+
+function setToken(token: string | null) {
+  if (token) {
+    localStorage.setItem(TOKEN_KEY, token);
+  } else {
+    localStorage.removeItem(TOKEN_KEY);
+  }
+}
 
 async function fetchAPI<T>(endpoint: string, options?: RequestInit): Promise<T> {
+  const token = getToken();
   const res = await fetch(`${API_BASE}${endpoint}`, {
     ...options,
     headers: {
-      'Content-Type': 'application/json',
+      // Uploads set their own multipart content type
+      ...(options?.body instanceof FormData ? {} : { 'Content-Type': 'application/json' }),
+      ...(token ? { Authorization: `Bearer ${token}` } : {}),
       ...options?.headers,
     },
   });
   
+  if (res.status === 401) {
+    setToken(null);
+  }
   if (!res.ok) {
     const error = await res.json().catch(() => ({ error: 'Unknown error' }));
     throw new Error(error.error || 'Request failed');
@@ -19,19 +39,75 @@ async function fetchAPI<T>(endpoint: string, options?: RequestInit): Promise<T>
   return res.json();
 }
 
+// Auth API
+export async function register(email: string, password: string, name?: string): Promise<AuthSession> {
+  const session = await fetchAPI<AuthSession>('/auth/register', {
+    method: 'POST',
+    body: JSON.stringify({ email, password, name }),
+  });
+  setToken(session.token);
+  return session;
+}
+
+export async function login(email: string, password: string): Promise<AuthSession> {
+  const session = await fetchAPI<AuthSession>('/auth/login', {
+    method: 'POST',
+    body: JSON.stringify({ email, password }),
+  });
+  setToken(session.token);
+  return session;
+}
+
+export async function logout(): Promise<void> {
+  try {
+    await fetchAPI('/auth/logout', { method: 'POST' });
+  } finally {
+    setToken(null);
+  }
+}
+
+export async function claimPortfolios(claimToken: string): Promise<{ claimed: number; message: string }> {
+  return fetchAPI('/auth/claim', {
+    method: 'POST',
+    body: JSON.stringify({ claim_token: claimToken }),
+  });
+}
+
+export async function getCurrentUser(): Promise<User> {
+  return fetchAPI<User>('/auth/me');
+}
+
+// API tokens API
+export async function getAPITokens(): Promise<APIToken[]> {
+  return fetchAPI<APIToken[]>('/tokens');
+}
+
+export async function createAPIToken(name: string, scopes: APITokenScope[], expiresAt?: string): Promise<{ token: string; api_token: APIToken; message: string }> {
+  return fetchAPI('/tokens', {
+    method: 'POST',
+    body: JSON.stringify({ name, scopes, expires_at: expiresAt }),
+  });
+}
+
+export async function revokeAPIToken(id: number): Promise<{ message: string }> {
+  return fetchAPI(`/tokens/${id}`, {
+    method: 'DELETE',
+  });
+}
+
 // Capital API
 export async function getCapitals(): Promise<Capital[]> {
   return fetchAPI<Capital[]>('/capitals');
 }
 
-export async function addCapital(data: { amount: string; type: string; description?: string }): Promise<{ id: number; message: string }> {
+export async function addCapital(data: { amount: string; type: string; description?: string; executed_at?: string }): Promise<{ id: number; message: string }> {
   return fetchAPI('/capitals', {
     method: 'POST',
     body: JSON.stringify(data),
   });
 }
 
-export async function withdrawCapital(data: { amount: string; description?: string }): Promise<{ id: number; message: string }> {
+export async function withdrawCapital(data: { amount: string; description?: string; executed_at?: string }): Promise<{ id: number; message: string }> {
   return fetchAPI('/withdraw', {
     method: 'POST',
     body: JSON.stringify(data),
@@ -45,12 +121,29 @@ export async function addRealizedLoss(data: { amount: string; description?: stri
   });
 }
 
+export async function updateCapital(id: number, data: {
+  amount?: string;
+  type?: string;
+  description?: string;
+  executed_at?: string;
+  reason?: string;
+}): Promise<{ id: number; changes: Record<string, FieldChange>; message: string }> {
+  return fetchAPI(`/capitals/${id}`, {
+    method: 'PUT',
+    body: JSON.stringify(data),
+  });
+}
+
 export async function deleteCapital(id: number): Promise<{ message: string }> {
   return fetchAPI(`/capitals/${id}`, {
     method: 'DELETE',
   });
 }
 
+export async function getCapitalHistory(id: number): Promise<AuditRecord[]> {
+  return fetchAPI<AuditRecord[]>(`/capitals/${id}/history`);
+}
+
 // Orders API
 export async function getOrders(asset?: string): Promise<Order[]> {
   const query = asset ? `?asset=${asset}` : '';
@@ -64,41 +157,126 @@ export async function createOrder(data: {
   total_usdt?: string;
   price?: string;
   is_custom_price?: boolean;
-}): Promise<{ id: number; message: string; amount: string; price: string; total: string }> {
+  allow_non_live_price?: boolean;
+  quote_asset?: QuoteAsset;
+  quote_total?: string;
+  quote_rate?: string;
+  lot_method?: LotMethod;
+  lots?: { lot_id: number; amount: string }[];
+  fee?: string;
+  fee_rate?: string;
+  fee_asset?: string;
+  executed_at?: string;
+}): Promise<{ id: number; message: string; amount: string; price: string; total: string; quote_asset: QuoteAsset; quote_price: string; quote_total: string; quote_rate: string; fee: string; fee_asset: string; fee_usdt: string; source: string; realized_pnl: string | null; lot_method: string }> {
   return fetchAPI('/orders', {
     method: 'POST',
     body: JSON.stringify(data),
   });
 }
 
+export async function updateOrder(id: number, data: {
+  asset?: string;
+  type?: 'buy' | 'sell';
+  quote_asset?: QuoteAsset;
+  quote_rate?: string;
+  amount?: string;
+  quote_total?: string;
+  total_usdt?: string;
+  price?: string;
+  fee?: string;
+  fee_rate?: string;
+  fee_asset?: string;
+  lot_method?: LotMethod;
+  lots?: { lot_id: number; amount: string }[];
+  executed_at?: string;
+  reason?: string;
+}): Promise<{ id: number; changes: Record<string, FieldChange>; realized_pnl: string | null; message: string }> {
+  return fetchAPI(`/orders/${id}`, {
+    method: 'PUT',
+    body: JSON.stringify(data),
+  });
+}
+
+export async function getOrderHistory(id: number): Promise<AuditRecord[]> {
+  return fetchAPI<AuditRecord[]>(`/orders/${id}/history`);
+}
+
 export async function deleteOrder(id: number): Promise<{ message: string }> {
   return fetchAPI(`/orders/${id}`, {
     method: 'DELETE',
   });
 }
 
+// Trade import API
+export async function importTrades(file: File, exchange: TradeExchange, options?: { dryRun?: boolean; skipInvalid?: boolean; lotMethod?: LotMethod }): Promise<TradeImportResult> {
+  const form = new FormData();
+  form.append('file', file);
+  form.append('exchange', exchange);
+  if (options?.dryRun) form.append('dry_run', 'true');
+  if (options?.skipInvalid) form.append('skip_invalid', 'true');
+  if (options?.lotMethod) form.append('lot_method', options.lotMethod);
+  return fetchAPI<TradeImportResult>('/import/trades', {
+    method: 'POST',
+    body: form,
+  });
+}
+
 // Holdings API
 export async function getHoldings(): Promise<Holding[]> {
   return fetchAPI<Holding[]>('/holdings');
 }
 
+export async function verifyHoldings(): Promise<HoldingsVerification> {
+  return fetchAPI<HoldingsVerification>('/holdings/verify');
+}
+
+export async function rebuildHoldings(): Promise<{ diffs: HoldingDiff[]; holdings: Holding[]; message: string }> {
+  return fetchAPI('/holdings/rebuild', {
+    method: 'POST',
+  });
+}
+
+// Ledger API
+export async function getJournal(params: { account?: string; order_id?: number; capital_id?: number; limit?: number } = {}): Promise<JournalEntry[]> {
+  const query = new URLSearchParams();
+  Object.entries(params).forEach(([key, value]) => {
+    if (value !== undefined) query.set(key, String(value));
+  });
+  const qs = query.toString();
+  return fetchAPI<JournalEntry[]>(`/ledger/entries${qs ? `?${qs}` : ''}`);
+}
+
+export async function getTrialBalance(): Promise<TrialBalance> {
+  return fetchAPI<TrialBalance>('/ledger/balances');
+}
+
+// currencyQuery asks for values in a reporting currency other than the server default.
+function currencyQuery(currency?: string): string {
+  return currency ? `?currency=${encodeURIComponent(currency)}` : '';
+}
+
 // Portfolio API
-export async function getPortfolioOverview(): Promise<PortfolioOverview> {
-  return fetchAPI<PortfolioOverview>('/portfolio');
+export async function getPortfolioOverview(currency?: string): Promise<PortfolioOverview> {
+  return fetchAPI<PortfolioOverview>(`/portfolio${currencyQuery(currency)}`);
 }
 
 // Prices API
-export async function getPrices(): Promise<PriceData[]> {
-  return fetchAPI<PriceData[]>('/prices');
+export async function getPrices(currency?: string): Promise<PriceData[]> {
+  return fetchAPI<PriceData[]>(`/prices${currencyQuery(currency)}`);
 }
 
-export async function getPrice(symbol: string): Promise<PriceData> {
-  return fetchAPI<PriceData>(`/prices/${symbol}`);
+export async function getPrice(symbol: string, currency?: string): Promise<PriceData> {
+  return fetchAPI<PriceData>(`/prices/${symbol}${currencyQuery(currency)}`);
 }
 
 // Asset Detail API
-export async function getAssetDetail(symbol: string): Promise<AssetDetail> {
-  return fetchAPI<AssetDetail>(`/assets/${symbol}`);
+export async function getAssetDetail(symbol: string, currency?: string): Promise<AssetDetail> {
+  return fetchAPI<AssetDetail>(`/assets/${symbol}${currencyQuery(currency)}`);
+}
+
+export async function getAssetLots(symbol: string, all: boolean = false): Promise<TaxLot[]> {
+  const query = all ? '?all=true' : '';
+  return fetchAPI<TaxLot[]>(`/assets/${symbol}/lots${query}`);
 }
 
 // Top Coins API
@@ -106,8 +284,8 @@ export async function getTopCoins(limit: number = 100): Promise<CoinInfo[]> {
   return fetchAPI<CoinInfo[]>(`/coins/top?limit=${limit}`);
 }
 
-export async function getTop20Prices(): Promise<PriceData[]> {
-  return fetchAPI<PriceData[]>('/coins/top20');
+export async function getTop20Prices(currency?: string): Promise<PriceData[]> {
+  return fetchAPI<PriceData[]>(`/coins/top20${currencyQuery(currency)}`);
 }
 
 // Watchlist API
@@ -128,14 +306,116 @@ export async function removeFromWatchlist(symbol: string): Promise<{ message: st
   });
 }
 
-export async function getWatchlistPrices(): Promise<PriceData[]> {
-  return fetchAPI<PriceData[]>('/watchlist/prices');
+export async function getWatchlistPrices(currency?: string): Promise<PriceData[]> {
+  return fetchAPI<PriceData[]>(`/watchlist/prices${currencyQuery(currency)}`);
+}
+
+// Portfolios API; the other calls work on the default portfolio
+export async function getPortfolios(): Promise<Portfolio[]> {
+  return fetchAPI<Portfolio[]>('/portfolios');
+}
+
+export async function createPortfolio(name: string, description?: string): Promise<Portfolio> {
+  return fetchAPI<Portfolio>('/portfolios', {
+    method: 'POST',
+    body: JSON.stringify({ name, description }),
+  });
+}
+
+export async function updatePortfolio(id: number, data: { name?: string; description?: string }): Promise<Portfolio> {
+  return fetchAPI<Portfolio>(`/portfolios/${id}`, {
+    method: 'PUT',
+    body: JSON.stringify(data),
+  });
+}
+
+export async function deletePortfolio(id: number): Promise<{ message: string }> {
+  return fetchAPI(`/portfolios/${id}`, {
+    method: 'DELETE',
+  });
+}
+
+export async function getAggregateOverview(currency?: string): Promise<AggregateOverview> {
+  return fetchAPI<AggregateOverview>(`/portfolios/overview${currencyQuery(currency)}`);
+}
+
+// Transfers API
+export async function getTransfers(): Promise<Transfer[]> {
+  return fetchAPI<Transfer[]>('/transfers');
 }
 
-// Reset API
-export async function resetAllData(): Promise<{ message: string }> {
+export async function createTransfer(data: TransferInput): Promise<{ transfer: Transfer; message: string }> {
+  return fetchAPI('/transfers', {
+    method: 'POST',
+    body: JSON.stringify(data),
+  });
+}
+
+export async function deleteTransfer(id: number): Promise<{ message: string }> {
+  return fetchAPI(`/transfers/${id}`, {
+    method: 'DELETE',
+  });
+}
+
+export async function getTransferHistory(id: number): Promise<AuditRecord[]> {
+  return fetchAPI<AuditRecord[]>(`/transfers/${id}/history`);
+}
+
+// Members API
+export async function getMembers(portfolioId: number): Promise<PortfolioMember[]> {
+  return fetchAPI<PortfolioMember[]>(`/portfolios/${portfolioId}/members`);
+}
+
+export async function assignMember(portfolioId: number, email: string, role: Role): Promise<{ message: string }> {
+  return fetchAPI(`/portfolios/${portfolioId}/members`, {
+    method: 'POST',
+    body: JSON.stringify({ email, role }),
+  });
+}
+
+export async function removeMember(portfolioId: number, userId: number): Promise<{ message: string }> {
+  return fetchAPI(`/portfolios/${portfolioId}/members/${userId}`, {
+    method: 'DELETE',
+  });
+}
+
+// Reset API; a reset needs the token from its preview and is backed up first
+export async function previewReset(options: ResetOptions = {}): Promise<ResetPreview> {
+  return fetchAPI<ResetPreview>('/reset/preview', {
+    method: 'POST',
+    body: JSON.stringify(options),
+  });
+}
+
+export async function resetAllData(confirmationToken: string): Promise<{ backup_id: number; voided: ResetCounts; message: string }> {
   return fetchAPI('/reset', {
     method: 'POST',
+    body: JSON.stringify({ confirmation_token: confirmationToken }),
+  });
+}
+
+// Backups API
+export async function getBackups(): Promise<Backup[]> {
+  return fetchAPI<Backup[]>('/backups');
+}
+
+export async function getBackup(id: number): Promise<Backup> {
+  return fetchAPI<Backup>(`/backups/${id}`);
+}
+
+export async function getBackupHistory(id: number): Promise<AuditRecord[]> {
+  return fetchAPI<AuditRecord[]>(`/backups/${id}/history`);
+}
+
+export async function createBackup(): Promise<Backup> {
+  return fetchAPI<Backup>('/backups', {
+    method: 'POST',
+  });
+}
+
+export async function restoreBackup(id: number): Promise<{ restored: ResetCounts; message: string }> {
+  return fetchAPI(`/backups/${id}/restore`, {
+    method: 'POST',
   });
 }
 
@@ -4,6 +4,7 @@ export interface Capital {
   type: 'initial' | 'dca' | 'withdraw' | 'realized_loss';
   description: string;
   created_at: string;
+  voided_at: string | null;
 }
 
 export interface Order {
@@ -13,8 +14,36 @@ export interface Order {
   amount: string;
   price: string;
   total_usdt: string;
+  quote_asset: QuoteAsset;
+  quote_price: string;
+  quote_total: string;
+  quote_rate: string;
   is_custom_price: boolean;
+  price_source: PriceSource | '';
+  fee: string;
+  fee_asset: string;
+  fee_usdt: string;
+  realized_pnl: string | null;
   created_at: string;
+  voided_at: string | null;
+  exchange?: TradeExchange;
+  exchange_trade_id?: string;
+}
+
+export type QuoteAsset = 'USDT' | 'USDC' | 'BTC' | 'ETH' | 'USD';
+
+export type LotMethod = 'fifo' | 'lifo' | 'hifo' | 'specific';
+
+export interface TaxLot {
+  id: number;
+  order_id: number | null;
+  transfer_id: number | null;
+  asset: string;
+  amount: string;
+  remaining: string;
+  cost_basis: string;
+  unit_cost: string;
+  acquired_at: string;
 }
 
 export interface Holding {
@@ -24,6 +53,28 @@ export interface Holding {
   total_cost: string;
 }
 
+export interface ReplayIssue {
+  event: 'capital' | 'order';
+  id: number;
+  at: string;
+  message: string;
+}
+
+export interface HoldingDiff {
+  asset: string;
+  stored: Holding | null;
+  replayed: Holding | null;
+  amount_diff: string;
+  cost_diff: string;
+}
+
+export interface HoldingsVerification {
+  in_sync: boolean;
+  diffs: HoldingDiff[];
+  issues: ReplayIssue[];
+  replayed: Holding[];
+}
+
 export interface HoldingDetail {
   asset: string;
   amount: string;
@@ -34,6 +85,7 @@ export interface HoldingDetail {
   pnl: string;
   pnl_percent: string;
   percent_of_capital: string;
+  price_source: PriceSource;
 }
 
 export interface PortfolioOverview {
@@ -43,11 +95,20 @@ export interface PortfolioOverview {
   current_value: string;
   unrealized_pnl: string;
   realized_loss: string;
+  realized_gains: string;
+  realized_losses: string;
+  realized_pnl: string;
+  total_fees: string;
+  net_transfers: string;
   total_pnl: string;
   total_pnl_percent: string;
   holdings: HoldingDetail[];
+  non_live_assets: string[];
+  currency: string;
 }
 
+export type PriceSource = 'live' | 'cached' | 'mock' | 'manual' | 'cost';
+
 export interface PriceData {
   symbol: string;
   price: string;
@@ -59,6 +120,9 @@ export interface PriceData {
   percent_change_7d: string;
   change_30d: string;
   percent_change_30d: string;
+  source: PriceSource;
+  as_of: string;
+  currency?: string;
 }
 
 export interface AssetDetail {
@@ -66,6 +130,7 @@ export interface AssetDetail {
   amount: string;
   average_price: string;
   current_price: string;
+  price_source: PriceSource;
   total_cost: string;
   current_value: string;
   pnl: string;
@@ -73,6 +138,7 @@ export interface AssetDetail {
   percent_of_capital: string;
   change_24h: string;
   percent_change_24h: string;
+  currency: string;
   orders: Order[];
 }
 
@@ -111,3 +177,201 @@ export const ASSET_COLORS: Record<string, string> = {
   USDT: '#26a17b',
 };
 
+export interface Posting {
+  account: string;
+  asset?: string;
+  quantity: string;
+  value: string;
+}
+
+export interface JournalEntry {
+  id: number;
+  portfolio_id: number;
+  kind: 'deposit' | 'withdrawal' | 'buy' | 'sell' | 'adjustment' | 'transfer';
+  capital_id: number | null;
+  order_id: number | null;
+  transfer_id: number | null;
+  description: string;
+  occurred_at: string;
+  postings: Posting[];
+}
+
+export interface TrialBalance {
+  accounts: Posting[];
+  total: string;
+  balanced: boolean;
+}
+
+export interface FieldChange {
+  from: string;
+  to: string;
+}
+
+export interface AuditRecord {
+  id: number;
+  entity: 'order' | 'capital' | 'transfer' | 'backup';
+  entity_id: number;
+  action: string;
+  changes: Record<string, FieldChange>;
+  reason: string;
+  user_id: number | null;
+  created_at: string;
+}
+
+export type Role = 'owner' | 'trader' | 'viewer';
+
+export interface Portfolio {
+  id: number;
+  name: string;
+  description: string;
+  is_default: boolean;
+  role: Role;
+  created_at: string;
+}
+
+export interface PortfolioSummary extends Portfolio {
+  total_capital: string;
+  total_value: string;
+  total_pnl: string;
+  total_pnl_percent: string;
+  percent_of_total: string;
+}
+
+export interface AggregateOverview {
+  overview: PortfolioOverview;
+  portfolios: PortfolioSummary[];
+}
+
+export interface Transfer {
+  id: number;
+  from_portfolio_id: number;
+  to_portfolio_id: number;
+  from_wallet: string;
+  to_wallet: string;
+  asset: string;
+  amount: string;
+  fee: string;
+  lot_method: LotMethod;
+  cost_basis: string;
+  fee_cost: string;
+  market_value: string;
+  description: string;
+  created_at: string;
+}
+
+export interface TransferInput {
+  asset: string;
+  amount: string;
+  fee?: string;
+  to_portfolio_id?: number;
+  from_wallet?: string;
+  to_wallet?: string;
+  lot_method?: LotMethod;
+  price?: string;
+  description?: string;
+  executed_at?: string;
+}
+
+export interface User {
+  id: number;
+  email: string;
+  name: string;
+  created_at: string;
+}
+
+export interface AuthSession {
+  token: string;
+  expires_at: string;
+  user: User;
+}
+
+export interface PortfolioMember {
+  user_id: number;
+  email: string;
+  name: string;
+  role: Role;
+  is_creator: boolean;
+  created_at: string;
+}
+
+export type APITokenScope =
+  | 'read:portfolio'
+  | 'write:capitals'
+  | 'write:orders'
+  | 'write:transfers'
+  | 'write:watchlist'
+  | 'write:portfolio';
+
+export interface APIToken {
+  id: number;
+  name: string;
+  prefix: string;
+  scopes: APITokenScope[];
+  created_at: string;
+  last_used_at: string | null;
+  expires_at: string | null;
+  revoked_at: string | null;
+}
+
+export interface ResetOptions {
+  include?: ('capitals' | 'orders' | 'transfers')[];
+  asset?: string;
+  from?: string;
+  to?: string;
+}
+
+export interface ResetCounts {
+  capitals: number;
+  orders: number;
+  transfers: number;
+}
+
+export interface ResetPreview {
+  confirmation_token: string;
+  expires_at: string;
+  would_void: ResetCounts;
+}
+
+export interface Backup {
+  id: number;
+  portfolio_id: number;
+  reason: 'reset' | 'manual';
+  counts: ResetCounts;
+  created_at: string;
+  restored_at: string | null;
+  data?: Record<string, unknown[]>;
+}
+
+export type TradeExchange = 'binance' | 'coinbase' | 'kraken' | 'okx';
+
+export interface ImportedTrade {
+  row: number;
+  trade_id: string;
+  executed_at: string;
+  type: 'buy' | 'sell';
+  asset: string;
+  quote_asset: string;
+  amount: string;
+  quote_price: string;
+  quote_total: string;
+  fee: string;
+  fee_asset: string;
+  order_id?: number;
+}
+
+export interface ImportProblem {
+  row: number;
+  trade_id?: string;
+  reason: string;
+}
+
+export interface TradeImportResult {
+  exchange: TradeExchange;
+  dry_run: boolean;
+  trades: ImportedTrade[];
+  skipped: ImportProblem[];
+  errors: ImportProblem[];
+  issues?: ReplayIssue[];
+  message?: string;
+  error?: string;
+}
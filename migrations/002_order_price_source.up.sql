@@ -0,0 +1,2 @@
+-- Record where the execution price of each order came from
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS price_source VARCHAR(10);
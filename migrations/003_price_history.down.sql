@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_price_history_symbol_recorded_at;
+DROP TABLE IF EXISTS price_history;
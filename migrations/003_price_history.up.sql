@@ -0,0 +1,10 @@
+-- Create price history table
+CREATE TABLE IF NOT EXISTS price_history (
+    id BIGSERIAL PRIMARY KEY,
+    symbol VARCHAR(20) NOT NULL,
+    price DECIMAL(20, 8) NOT NULL,
+    source VARCHAR(10) NOT NULL,
+    recorded_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_price_history_symbol_recorded_at ON price_history(symbol, recorded_at);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_portfolio_snapshots_created_at;
+DROP TABLE IF EXISTS portfolio_snapshots;
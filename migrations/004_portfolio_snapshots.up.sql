@@ -0,0 +1,16 @@
+-- Create portfolio snapshots table
+CREATE TABLE IF NOT EXISTS portfolio_snapshots (
+    id BIGSERIAL PRIMARY KEY,
+    total_value DECIMAL(20, 8) NOT NULL,
+    total_capital DECIMAL(20, 8) NOT NULL,
+    available_usdt DECIMAL(20, 8) NOT NULL,
+    total_invested DECIMAL(20, 8) NOT NULL,
+    current_value DECIMAL(20, 8) NOT NULL,
+    unrealized_pnl DECIMAL(20, 8) NOT NULL,
+    total_pnl DECIMAL(20, 8) NOT NULL,
+    total_pnl_percent DECIMAL(20, 8) NOT NULL,
+    holdings JSONB NOT NULL DEFAULT '[]',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_portfolio_snapshots_created_at ON portfolio_snapshots(created_at);
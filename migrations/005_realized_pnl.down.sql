@@ -0,0 +1 @@
+DROP TABLE IF EXISTS realized_pnl;
@@ -0,0 +1,11 @@
+-- Realized profit and loss recorded on each sell order
+CREATE TABLE IF NOT EXISTS realized_pnl (
+    id SERIAL PRIMARY KEY,
+    order_id INTEGER NOT NULL UNIQUE REFERENCES orders(id) ON DELETE CASCADE,
+    asset VARCHAR(10) NOT NULL,
+    amount DECIMAL(20, 8) NOT NULL,
+    proceeds DECIMAL(20, 8) NOT NULL,
+    cost_basis DECIMAL(20, 8) NOT NULL,
+    pnl DECIMAL(20, 8) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
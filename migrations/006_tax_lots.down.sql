@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS idx_lot_disposals_order_id;
+DROP INDEX IF EXISTS idx_tax_lots_asset;
+DROP TABLE IF EXISTS lot_disposals;
+DROP TABLE IF EXISTS tax_lots;
+
+ALTER TABLE orders DROP COLUMN IF EXISTS lot_selections;
+ALTER TABLE orders DROP COLUMN IF EXISTS lot_method;
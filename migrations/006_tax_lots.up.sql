@@ -0,0 +1,36 @@
+-- Lot matching settings recorded on sell orders
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS lot_method VARCHAR(10);
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS lot_selections JSONB;
+
+-- Create tax lots table
+CREATE TABLE IF NOT EXISTS tax_lots (
+    id SERIAL PRIMARY KEY,
+    order_id INTEGER REFERENCES orders(id) ON DELETE CASCADE,
+    asset VARCHAR(10) NOT NULL,
+    amount DECIMAL(20, 8) NOT NULL,
+    remaining DECIMAL(20, 8) NOT NULL,
+    cost_basis DECIMAL(20, 8) NOT NULL,
+    acquired_at TIMESTAMP NOT NULL
+);
+
+-- Create lot disposals table
+CREATE TABLE IF NOT EXISTS lot_disposals (
+    id SERIAL PRIMARY KEY,
+    lot_id INTEGER NOT NULL REFERENCES tax_lots(id) ON DELETE CASCADE,
+    order_id INTEGER NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+    amount DECIMAL(20, 8) NOT NULL,
+    cost_basis DECIMAL(20, 8) NOT NULL,
+    proceeds DECIMAL(20, 8) NOT NULL,
+    disposed_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_tax_lots_asset ON tax_lots(asset);
+CREATE INDEX IF NOT EXISTS idx_lot_disposals_order_id ON lot_disposals(order_id);
+
+-- Open one lot per existing holding that predates lot tracking
+INSERT INTO tax_lots (order_id, asset, amount, remaining, cost_basis, acquired_at)
+SELECT NULL, h.asset, h.amount, h.amount, h.total_cost,
+    COALESCE((SELECT MIN(o.created_at) FROM orders o WHERE o.asset = h.asset), CURRENT_TIMESTAMP)
+FROM holdings h
+WHERE h.asset != 'USDT' AND h.amount > 0
+    AND NOT EXISTS (SELECT 1 FROM tax_lots l WHERE l.asset = h.asset);
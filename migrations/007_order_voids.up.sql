@@ -0,0 +1,2 @@
+-- Deleted orders are voided: their effect is reversed but the row is kept
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS voided_at TIMESTAMP;
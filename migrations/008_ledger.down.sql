@@ -0,0 +1,8 @@
+-- Materialize the view back into a table
+CREATE TABLE holdings_table AS SELECT asset, amount, average_price, total_cost FROM holdings;
+DROP VIEW IF EXISTS holdings;
+ALTER TABLE holdings_table RENAME TO holdings;
+ALTER TABLE holdings ADD PRIMARY KEY (asset);
+
+DROP TABLE IF EXISTS postings;
+DROP TABLE IF EXISTS journal_entries;
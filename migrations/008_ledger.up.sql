@@ -0,0 +1,66 @@
+-- Create journal entries table
+CREATE TABLE IF NOT EXISTS journal_entries (
+    id SERIAL PRIMARY KEY,
+    kind VARCHAR(20) NOT NULL,
+    capital_id INTEGER REFERENCES capitals(id) ON DELETE CASCADE,
+    order_id INTEGER REFERENCES orders(id) ON DELETE CASCADE,
+    description TEXT,
+    occurred_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Create postings table (values in USDT, debits positive)
+CREATE TABLE IF NOT EXISTS postings (
+    id BIGSERIAL PRIMARY KEY,
+    entry_id INTEGER NOT NULL REFERENCES journal_entries(id) ON DELETE CASCADE,
+    account VARCHAR(40) NOT NULL,
+    asset VARCHAR(10),
+    quantity DECIMAL(20, 8) NOT NULL DEFAULT 0,
+    value DECIMAL(20, 8) NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_postings_entry_id ON postings(entry_id);
+CREATE INDEX IF NOT EXISTS idx_postings_account ON postings(account);
+CREATE INDEX IF NOT EXISTS idx_journal_entries_order_id ON journal_entries(order_id);
+CREATE INDEX IF NOT EXISTS idx_journal_entries_capital_id ON journal_entries(capital_id);
+
+-- Carry the current holdings over as an opening entry
+DO $$
+DECLARE
+    opening_id INTEGER;
+BEGIN
+    IF EXISTS (SELECT 1 FROM information_schema.tables
+        WHERE table_schema = current_schema() AND table_name = 'holdings' AND table_type = 'BASE TABLE') THEN
+        IF EXISTS (SELECT 1 FROM holdings WHERE amount <> 0 OR total_cost <> 0) THEN
+            INSERT INTO journal_entries (kind, description)
+            VALUES ('adjustment', 'Opening balances carried over from the holdings table')
+            RETURNING id INTO opening_id;
+
+            INSERT INTO postings (entry_id, account, asset, quantity, value)
+            SELECT opening_id, CASE WHEN asset = 'USDT' THEN 'cash:' ELSE 'asset:' END || asset, asset, amount, total_cost
+            FROM holdings
+            WHERE amount <> 0 OR total_cost <> 0;
+
+            INSERT INTO postings (entry_id, account, quantity, value)
+            SELECT opening_id, 'equity:adjustments', 0, -SUM(total_cost) FROM holdings;
+        END IF;
+        DROP TABLE holdings;
+    END IF;
+END $$;
+
+-- Holdings are the balances of the cash and asset accounts
+CREATE OR REPLACE VIEW holdings AS
+SELECT asset,
+    SUM(quantity) AS amount,
+    CASE
+        WHEN asset = 'USDT' THEN 1
+        WHEN SUM(quantity) > 0 THEN ROUND(SUM(value) / SUM(quantity), 8)
+        ELSE 0
+    END AS average_price,
+    SUM(value) AS total_cost
+FROM (
+    SELECT asset, quantity, value FROM postings WHERE account LIKE 'cash:%' OR account LIKE 'asset:%'
+    UNION ALL
+    SELECT 'USDT', 0, 0
+) balances
+GROUP BY asset;
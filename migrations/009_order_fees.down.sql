@@ -0,0 +1,3 @@
+ALTER TABLE orders DROP COLUMN IF EXISTS fee_usdt;
+ALTER TABLE orders DROP COLUMN IF EXISTS fee_asset;
+ALTER TABLE orders DROP COLUMN IF EXISTS fee;
@@ -0,0 +1,4 @@
+-- Trading fees: the amount, the asset it was paid in, and its USDT value
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS fee DECIMAL(20, 8) NOT NULL DEFAULT 0;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS fee_asset VARCHAR(10);
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS fee_usdt DECIMAL(20, 8) NOT NULL DEFAULT 0;
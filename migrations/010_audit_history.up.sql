@@ -0,0 +1,12 @@
+-- Edits to orders and capital entries, field by field
+CREATE TABLE IF NOT EXISTS audit_history (
+    id SERIAL PRIMARY KEY,
+    entity VARCHAR(20) NOT NULL,
+    entity_id INTEGER NOT NULL,
+    action VARCHAR(20) NOT NULL,
+    changes JSONB NOT NULL,
+    reason TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_audit_history_entity ON audit_history(entity, entity_id);
@@ -0,0 +1,4 @@
+ALTER TABLE orders DROP COLUMN IF EXISTS quote_rate;
+ALTER TABLE orders DROP COLUMN IF EXISTS quote_total;
+ALTER TABLE orders DROP COLUMN IF EXISTS quote_price;
+ALTER TABLE orders DROP COLUMN IF EXISTS quote_asset;
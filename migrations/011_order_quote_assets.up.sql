@@ -0,0 +1,9 @@
+-- Quote asset an order was priced and settled in, with its USDT rate.
+-- price and total_usdt stay in USDT.
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS quote_asset VARCHAR(10) NOT NULL DEFAULT 'USDT';
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS quote_price DECIMAL(30, 18);
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS quote_total DECIMAL(20, 8);
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS quote_rate DECIMAL(20, 8) NOT NULL DEFAULT 1;
+
+-- Existing orders were all against USDT
+UPDATE orders SET quote_price = price, quote_total = total_usdt WHERE quote_total IS NULL;
@@ -0,0 +1,31 @@
+-- Merge every portfolio back into one set of books
+DROP VIEW IF EXISTS holdings;
+CREATE VIEW holdings AS
+SELECT asset,
+    SUM(quantity) AS amount,
+    CASE
+        WHEN asset = 'USDT' THEN 1
+        WHEN SUM(quantity) > 0 THEN ROUND(SUM(value) / SUM(quantity), 8)
+        ELSE 0
+    END AS average_price,
+    SUM(value) AS total_cost
+FROM (
+    SELECT asset, quantity, value FROM postings WHERE account LIKE 'cash:%' OR account LIKE 'asset:%'
+    UNION ALL
+    SELECT 'USDT', 0, 0
+) balances
+GROUP BY asset;
+
+DELETE FROM watchlist w USING watchlist d
+WHERE w.symbol = d.symbol AND w.portfolio_id > d.portfolio_id;
+ALTER TABLE watchlist DROP CONSTRAINT IF EXISTS watchlist_pkey;
+ALTER TABLE watchlist DROP COLUMN IF EXISTS portfolio_id;
+ALTER TABLE watchlist ADD PRIMARY KEY (symbol);
+
+ALTER TABLE portfolio_snapshots DROP COLUMN IF EXISTS portfolio_id;
+ALTER TABLE tax_lots DROP COLUMN IF EXISTS portfolio_id;
+ALTER TABLE journal_entries DROP COLUMN IF EXISTS portfolio_id;
+ALTER TABLE orders DROP COLUMN IF EXISTS portfolio_id;
+ALTER TABLE capitals DROP COLUMN IF EXISTS portfolio_id;
+
+DROP TABLE IF EXISTS portfolios;
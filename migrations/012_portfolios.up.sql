@@ -0,0 +1,47 @@
+-- Create portfolios table
+CREATE TABLE IF NOT EXISTS portfolios (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(100) NOT NULL UNIQUE,
+    description TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Everything recorded so far belongs to the default portfolio
+INSERT INTO portfolios (name) SELECT 'Main' WHERE NOT EXISTS (SELECT 1 FROM portfolios);
+
+ALTER TABLE capitals ADD COLUMN IF NOT EXISTS portfolio_id INTEGER NOT NULL DEFAULT 1 REFERENCES portfolios(id);
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS portfolio_id INTEGER NOT NULL DEFAULT 1 REFERENCES portfolios(id);
+ALTER TABLE journal_entries ADD COLUMN IF NOT EXISTS portfolio_id INTEGER NOT NULL DEFAULT 1 REFERENCES portfolios(id);
+ALTER TABLE tax_lots ADD COLUMN IF NOT EXISTS portfolio_id INTEGER NOT NULL DEFAULT 1 REFERENCES portfolios(id);
+ALTER TABLE portfolio_snapshots ADD COLUMN IF NOT EXISTS portfolio_id INTEGER NOT NULL DEFAULT 1 REFERENCES portfolios(id) ON DELETE CASCADE;
+
+CREATE INDEX IF NOT EXISTS idx_capitals_portfolio_id ON capitals(portfolio_id);
+CREATE INDEX IF NOT EXISTS idx_orders_portfolio_id ON orders(portfolio_id);
+CREATE INDEX IF NOT EXISTS idx_journal_entries_portfolio_id ON journal_entries(portfolio_id);
+CREATE INDEX IF NOT EXISTS idx_portfolio_snapshots_portfolio_id ON portfolio_snapshots(portfolio_id, created_at);
+
+-- The watchlist is kept per portfolio
+ALTER TABLE watchlist ADD COLUMN IF NOT EXISTS portfolio_id INTEGER NOT NULL DEFAULT 1 REFERENCES portfolios(id) ON DELETE CASCADE;
+ALTER TABLE watchlist DROP CONSTRAINT IF EXISTS watchlist_pkey;
+ALTER TABLE watchlist ADD PRIMARY KEY (portfolio_id, symbol);
+
+-- Holdings are the balances of the cash and asset accounts of each portfolio
+CREATE OR REPLACE VIEW holdings AS
+SELECT asset,
+    SUM(quantity) AS amount,
+    CASE
+        WHEN asset = 'USDT' THEN 1
+        WHEN SUM(quantity) > 0 THEN ROUND(SUM(value) / SUM(quantity), 8)
+        ELSE 0
+    END AS average_price,
+    SUM(value) AS total_cost,
+    portfolio_id
+FROM (
+    SELECT e.portfolio_id, p.asset, p.quantity, p.value
+    FROM postings p
+    JOIN journal_entries e ON e.id = p.entry_id
+    WHERE p.account LIKE 'cash:%' OR p.account LIKE 'asset:%'
+    UNION ALL
+    SELECT id, 'USDT', 0, 0 FROM portfolios
+) balances
+GROUP BY portfolio_id, asset;
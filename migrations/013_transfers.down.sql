@@ -0,0 +1,6 @@
+-- Dropping transfers drops their journal entries and lots; rebuild holdings afterwards
+DELETE FROM transfers;
+DROP INDEX IF EXISTS idx_journal_entries_transfer_id;
+ALTER TABLE tax_lots DROP COLUMN IF EXISTS transfer_id;
+ALTER TABLE journal_entries DROP COLUMN IF EXISTS transfer_id;
+DROP TABLE IF EXISTS transfers;
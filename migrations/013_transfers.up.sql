@@ -0,0 +1,25 @@
+-- Create transfers table; transfers move an asset at cost between portfolios or wallets
+CREATE TABLE IF NOT EXISTS transfers (
+    id SERIAL PRIMARY KEY,
+    from_portfolio_id INTEGER NOT NULL REFERENCES portfolios(id),
+    to_portfolio_id INTEGER NOT NULL REFERENCES portfolios(id),
+    from_wallet VARCHAR(100),
+    to_wallet VARCHAR(100),
+    asset VARCHAR(10) NOT NULL,
+    amount DECIMAL(20, 8) NOT NULL,
+    fee DECIMAL(20, 8) NOT NULL DEFAULT 0,
+    lot_method VARCHAR(10) NOT NULL,
+    cost_basis DECIMAL(20, 8) NOT NULL DEFAULT 0,
+    fee_cost DECIMAL(20, 8) NOT NULL DEFAULT 0,
+    market_value DECIMAL(20, 8) NOT NULL,
+    description TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_transfers_from_portfolio_id ON transfers(from_portfolio_id);
+CREATE INDEX IF NOT EXISTS idx_transfers_to_portfolio_id ON transfers(to_portfolio_id);
+
+-- Journal entries and lots created by a transfer go with it
+ALTER TABLE journal_entries ADD COLUMN IF NOT EXISTS transfer_id INTEGER REFERENCES transfers(id) ON DELETE CASCADE;
+ALTER TABLE tax_lots ADD COLUMN IF NOT EXISTS transfer_id INTEGER REFERENCES transfers(id) ON DELETE CASCADE;
+CREATE INDEX IF NOT EXISTS idx_journal_entries_transfer_id ON journal_entries(transfer_id);
@@ -0,0 +1,6 @@
+-- Fails if two users have portfolios with the same name
+DROP INDEX IF EXISTS idx_portfolios_user_id_name;
+ALTER TABLE portfolios DROP COLUMN IF EXISTS user_id;
+ALTER TABLE portfolios ADD CONSTRAINT portfolios_name_key UNIQUE (name);
+DROP TABLE IF EXISTS sessions;
+DROP TABLE IF EXISTS users;
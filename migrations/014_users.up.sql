@@ -0,0 +1,24 @@
+-- Users sign in with sessions and own portfolios; those recorded before
+-- accounts existed stay unowned until claimed with CLAIM_TOKEN
+CREATE TABLE IF NOT EXISTS users (
+    id SERIAL PRIMARY KEY,
+    email VARCHAR(255) NOT NULL UNIQUE,
+    name VARCHAR(100),
+    password_hash VARCHAR(100) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS sessions (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    token_hash VARCHAR(64) NOT NULL UNIQUE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions(user_id);
+
+-- Portfolio names are unique per user
+ALTER TABLE portfolios ADD COLUMN IF NOT EXISTS user_id INTEGER REFERENCES users(id);
+ALTER TABLE portfolios DROP CONSTRAINT IF EXISTS portfolios_name_key;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_portfolios_user_id_name ON portfolios(user_id, name);
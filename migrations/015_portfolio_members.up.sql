@@ -0,0 +1,14 @@
+-- Roles of users on portfolios; creators are owners of their own
+CREATE TABLE IF NOT EXISTS portfolio_members (
+    portfolio_id INTEGER NOT NULL REFERENCES portfolios(id) ON DELETE CASCADE,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    role VARCHAR(10) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (portfolio_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_portfolio_members_user_id ON portfolio_members(user_id);
+
+INSERT INTO portfolio_members (portfolio_id, user_id, role)
+SELECT id, user_id, 'owner' FROM portfolios WHERE user_id IS NOT NULL
+ON CONFLICT DO NOTHING;
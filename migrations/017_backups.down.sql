@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS reset_confirmations;
+DROP TABLE IF EXISTS backups;
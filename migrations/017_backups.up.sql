@@ -0,0 +1,24 @@
+-- Full exports of a portfolio, written before every reset
+CREATE TABLE IF NOT EXISTS backups (
+    id SERIAL PRIMARY KEY,
+    portfolio_id INTEGER NOT NULL REFERENCES portfolios(id) ON DELETE CASCADE,
+    user_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    reason VARCHAR(20) NOT NULL,
+    data JSONB NOT NULL,
+    capitals INTEGER NOT NULL DEFAULT 0,
+    orders INTEGER NOT NULL DEFAULT 0,
+    transfers INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    restored_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_backups_portfolio_id ON backups(portfolio_id, created_at);
+
+-- Tokens from reset previews, each confirming one reset
+CREATE TABLE IF NOT EXISTS reset_confirmations (
+    token_hash VARCHAR(64) PRIMARY KEY,
+    portfolio_id INTEGER NOT NULL REFERENCES portfolios(id) ON DELETE CASCADE,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    options JSONB NOT NULL,
+    expires_at TIMESTAMP NOT NULL
+);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_orders_exchange_trade;
+ALTER TABLE orders DROP COLUMN IF EXISTS exchange_trade_id;
+ALTER TABLE orders DROP COLUMN IF EXISTS exchange;
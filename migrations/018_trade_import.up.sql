@@ -0,0 +1,6 @@
+-- Orders imported from exchange exports keep the fill they came from, so
+-- importing the same export twice skips what is already there
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS exchange VARCHAR(20);
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS exchange_trade_id VARCHAR(100);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_orders_exchange_trade ON orders(portfolio_id, exchange, exchange_trade_id) WHERE exchange_trade_id IS NOT NULL;
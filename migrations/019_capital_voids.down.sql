@@ -0,0 +1 @@
+ALTER TABLE capitals DROP COLUMN IF EXISTS voided_at;
@@ -0,0 +1,3 @@
+-- Capital entries are voided rather than deleted, so the ledger keeps the
+-- movement and its reversal
+ALTER TABLE capitals ADD COLUMN IF NOT EXISTS voided_at TIMESTAMP;
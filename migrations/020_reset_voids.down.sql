@@ -0,0 +1,4 @@
+ALTER TABLE transfers DROP COLUMN IF EXISTS reset_backup_id;
+ALTER TABLE orders DROP COLUMN IF EXISTS reset_backup_id;
+ALTER TABLE capitals DROP COLUMN IF EXISTS reset_backup_id;
+ALTER TABLE transfers DROP COLUMN IF EXISTS voided_at;
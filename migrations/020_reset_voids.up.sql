@@ -0,0 +1,6 @@
+-- Resets void rows rather than deleting them, marked with the backup written
+-- before the reset so that restoring it puts them back
+ALTER TABLE transfers ADD COLUMN IF NOT EXISTS voided_at TIMESTAMP;
+ALTER TABLE capitals ADD COLUMN IF NOT EXISTS reset_backup_id INTEGER REFERENCES backups(id) ON DELETE SET NULL;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS reset_backup_id INTEGER REFERENCES backups(id) ON DELETE SET NULL;
+ALTER TABLE transfers ADD COLUMN IF NOT EXISTS reset_backup_id INTEGER REFERENCES backups(id) ON DELETE SET NULL;
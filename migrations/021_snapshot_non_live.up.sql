@@ -0,0 +1,3 @@
+-- Holdings a snapshot valued without a live quote; such points are marked on
+-- the equity curve and left out of performance
+ALTER TABLE portfolio_snapshots ADD COLUMN IF NOT EXISTS non_live_assets JSONB NOT NULL DEFAULT '[]';
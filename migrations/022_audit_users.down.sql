@@ -0,0 +1 @@
+ALTER TABLE audit_history DROP COLUMN IF EXISTS user_id;
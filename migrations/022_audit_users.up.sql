@@ -0,0 +1,2 @@
+-- Who made each recorded change
+ALTER TABLE audit_history ADD COLUMN IF NOT EXISTS user_id INTEGER REFERENCES users(id) ON DELETE SET NULL;